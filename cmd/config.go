@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Emyrk/screeps-watcher/watch"
+	"github.com/rs/zerolog"
+
+	"github.com/coder/serpent"
+)
+
+func (r *Root) configCmd() *serpent.Command {
+	cmd := &serpent.Command{
+		Use:   "config",
+		Short: "Work with the config file.",
+	}
+	cmd.AddSubcommands(r.configCheck())
+	return cmd
+}
+
+func (r *Root) configCheck() *serpent.Command {
+	var (
+		configPath   string
+		authenticate bool
+	)
+	cmd := &serpent.Command{
+		Use:   "check",
+		Short: "Validate the config file and report every problem found.",
+		Options: serpent.OptionSet{
+			configOption(&configPath),
+			{
+				Name:        "authenticate",
+				Description: "Also check the credentials of every server work.",
+				Flag:        "authenticate",
+				Default:     "false",
+				Value:       serpent.BoolOf(&authenticate),
+			},
+		},
+		Handler: func(i *serpent.Invocation) error {
+			data, err := os.ReadFile(configPath)
+			if err != nil {
+				return fmt.Errorf("read config: %w", err)
+			}
+
+			config, err := watch.ParseConfig(configPath, data)
+			if err != nil {
+				count := 1
+				if joined, ok := err.(interface{ Unwrap() []error }); ok {
+					count = len(joined.Unwrap())
+				}
+				_, _ = fmt.Fprintln(i.Stderr, err.Error())
+				return fmt.Errorf("config has %d problem(s)", count)
+			}
+
+			if authenticate {
+				failed := make([]error, 0)
+				for _, server := range config.Servers {
+					err := checkAuth(i, config, server)
+					if err != nil {
+						failed = append(failed, fmt.Errorf("server %q: %w", server.Name, err))
+						_, _ = fmt.Fprintf(i.Stdout, "%s: authentication failed: %v\n", server.Name, err)
+						continue
+					}
+					_, _ = fmt.Fprintf(i.Stdout, "%s: authenticated\n", server.Name)
+				}
+				if len(failed) > 0 {
+					return errors.Join(failed...)
+				}
+			}
+
+			_, _ = fmt.Fprintf(i.Stdout, "%s: ok, %d server(s)\n", configPath, len(config.Servers))
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+func checkAuth(i *serpent.Invocation, config watch.WatchConfig, server watch.WatcherOptions) error {
+	// Pyroscope is not needed to check credentials, and the check must not
+	// read or write the state of a running watcher.
+	config.Pyroscope = watch.PyroscopeSettings{}
+	config.DataDir = ""
+	w, err := watch.New(config, server, zerolog.Nop())
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(i.Context(), time.Second*30)
+	defer cancel()
+	return w.Authenticate(ctx)
+}
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Emyrk/screeps-watcher/watch"
+	"github.com/rs/zerolog"
+)
+
+// reloadConfig re-applies the config whenever the config file content or a
+// secret file it references changes, or the process receives SIGHUP. A config
+// that fails to load or apply is logged and the previous config keeps running.
+func reloadConfig(ctx context.Context, opts *cliWatcherConfig, manager *watch.Manager, interval time.Duration, lastHash [32]byte, logger zerolog.Logger) {
+	logger = logger.With().Str("config_path", opts.ConfigPath).Logger()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// A nil channel blocks forever, which disables polling.
+	var poll <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.Info().Msg("received SIGHUP, reloading config")
+		case <-poll:
+			hash := configHash(opts)
+			if hash == lastHash {
+				continue
+			}
+			logger.Info().Msg("config file changed, reloading config")
+		}
+
+		lastHash = configHash(opts)
+		config, servers, err := loadConfig(opts, logger)
+		if err != nil {
+			logger.Error().Err(err).Msg("reload config failed, keeping previous config")
+			continue
+		}
+
+		err = manager.Apply(config, servers)
+		if err != nil {
+			logger.Error().Err(err).Msg("apply config failed, keeping previous config")
+			continue
+		}
+		logger.Info().Int("num_watchers", len(servers)).Msg("config reloaded")
+	}
+}
+
+// configHash returns the sha256 of the config file content and of the
+// password and token files it references, or the zero hash if the config
+// cannot be read. Environment variables are fixed for the life of the process
+// and token commands are only run again on SIGHUP, so neither is part of the
+// hash.
+func configHash(opts *cliWatcherConfig) [32]byte {
+	data, err := os.ReadFile(opts.ConfigPath)
+	if err != nil {
+		return [32]byte{}
+	}
+
+	h := sha256.New()
+	h.Write(data)
+	// A config that does not parse has no secret files to check, and will
+	// fail to reload anyway.
+	config, _ := watch.ParseConfig(opts.ConfigPath, data)
+	servers := append([]watch.WatcherOptions{opts.Additional.Value}, config.Servers...)
+	for _, server := range servers {
+		for _, file := range []string{server.PasswordFile, server.TokenFile} {
+			if file == "" {
+				continue
+			}
+			secret, _ := os.ReadFile(file)
+			h.Write([]byte(file))
+			h.Write(secret)
+		}
+	}
+
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum
+}
@@ -75,8 +75,8 @@ func (r *Root) rooms(do roomAPICall) *serpent.Command {
 
 			watcher := watchers[0]
 
-			if shard == "" && len(watcher.MemorySegments) == 1 {
-				shard = watcher.MemorySegments[0].Shard
+			if shard == "" && len(watcher.Segments()) == 1 {
+				shard = watcher.Segments()[0].Shard
 			}
 			if shard == "" {
 				return fmt.Errorf("must choose a --shard")
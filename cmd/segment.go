@@ -4,15 +4,17 @@ import (
 	"encoding/json"
 	"fmt"
 
+	"github.com/Emyrk/screeps-watcher/watch/memory"
 	"github.com/coder/serpent"
 )
 
 func (r *Root) segment() *serpent.Command {
 	var (
-		cliOpts = new(cliWatcherConfig).SingleWatcher()
-		segment int64
-		shard   string
-		pretty  bool
+		cliOpts  = new(cliWatcherConfig).SingleWatcher()
+		segment  int64
+		shard    string
+		encoding string
+		pretty   bool
 	)
 	cmd := &serpent.Command{
 		Use: "pull-segment",
@@ -42,6 +44,13 @@ func (r *Root) segment() *serpent.Command {
 				Flag:        "shard",
 				Value:       serpent.StringOf(&shard),
 			},
+			serpent.Option{
+				Name:        "encoding",
+				Description: "How the segment is compressed, detected if not set.",
+				Required:    false,
+				Flag:        "encoding",
+				Value:       serpent.StringOf(&encoding),
+			},
 		},
 		Handler: func(i *serpent.Invocation) error {
 			logger := r.Logger(i)
@@ -54,13 +63,13 @@ func (r *Root) segment() *serpent.Command {
 
 			watcher := watchers[0]
 
-			if len(watcher.MemorySegments) == 1 {
-				shard = watcher.MemorySegments[0].Shard
+			if len(watcher.Segments()) == 1 {
+				shard = watcher.Segments()[0].Shard
 			}
 			if shard == "" {
 				return fmt.Errorf("must choose a --shard")
 			}
-			data, _, err := watcher.MemorySegment(ctx, int(segment), shard)
+			data, _, err := watcher.MemorySegment(ctx, int(segment), shard, memory.DecodeOptions{Encoding: encoding})
 			if err != nil {
 				return fmt.Errorf("fetch memory segment: %w", err)
 			}
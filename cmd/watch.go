@@ -1,61 +1,189 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/Emyrk/screeps-watcher/watch"
+	"github.com/Emyrk/screeps-watcher/watch/admin"
+	"github.com/Emyrk/screeps-watcher/watch/graphite"
+	"github.com/Emyrk/screeps-watcher/watch/otlp"
+	"github.com/Emyrk/screeps-watcher/watch/remotewrite"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
-	"gopkg.in/yaml.v3"
 
 	"github.com/coder/serpent"
 )
 
 func (r *Root) WatchCmd() *serpent.Command {
 	var (
-		cliOpts = new(cliWatcherConfig)
+		cliOpts         = new(cliWatcherConfig)
+		reloadInterval  time.Duration
+		listenAddress   string
+		pprof           bool
+		shutdownTimeout time.Duration
 	)
 	cmd := &serpent.Command{
-		Use:     "watch",
-		Options: serpent.OptionSet{},
+		Use: "watch",
+		Options: serpent.OptionSet{
+			{
+				Name:        "config-reload-interval",
+				Description: "How often to check the config file for changes. The config is also reloaded on SIGHUP. Set to 0 to only reload on SIGHUP.",
+				Flag:        "config-reload-interval",
+				Env:         "SCREEPS_CONFIG_RELOAD_INTERVAL",
+				Default:     "10s",
+				Value:       serpent.DurationOf(&reloadInterval),
+			},
+			{
+				Name:        "listen-address",
+				Description: "Address to serve metrics, health checks and the targets page on.",
+				Flag:        "listen-address",
+				Env:         "SCREEPS_LISTEN_ADDRESS",
+				Default:     ":2112",
+				Value:       serpent.StringOf(&listenAddress),
+			},
+			{
+				Name:        "pprof",
+				Description: "Serve go profiling endpoints under /debug/pprof/.",
+				Flag:        "pprof",
+				Env:         "SCREEPS_PPROF",
+				Default:     "false",
+				Value:       serpent.BoolOf(&pprof),
+			},
+			{
+				Name:        "shutdown-timeout",
+				Description: "How long to wait on SIGINT or SIGTERM for in flight scrapes, profile uploads and http requests to finish.",
+				Flag:        "shutdown-timeout",
+				Env:         "SCREEPS_SHUTDOWN_TIMEOUT",
+				Default:     "30s",
+				Value:       serpent.DurationOf(&shutdownTimeout),
+			},
+		},
 		Handler: func(i *serpent.Invocation) error {
 			logger := r.Logger(i)
-			ctx := i.Context()
+			ctx, stop := i.SignalNotifyContext(i.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
 
-			watchers, err := configureWatchers(cliOpts, logger)
+			// Hash before loading so a change made during startup is
+			// picked up by the first reload check.
+			hash := configHash(cliOpts)
+			config, servers, err := loadConfig(cliOpts, logger)
 			if err != nil {
 				return err
 			}
 
+			manager := watch.NewManager(ctx, logger)
 			reg := prometheus.NewRegistry()
-			for _, watcher := range watchers {
-				go watcher.Watch(ctx)
-				err := reg.Register(watcher)
+			err = reg.Register(manager)
+			if err != nil {
+				logger.Error().Err(err).Msg("register watchers")
+				return fmt.Errorf("register watchers: %w", err)
+			}
+
+			// Exporters start before the watchers, so the watchers can send
+			// their logs and profiles to them.
+			var exporters sync.WaitGroup
+			for _, rwConfig := range config.RemoteWrite {
+				exporter, err := remotewrite.New(rwConfig, reg, logger.With().Str("service", "remote_write").Logger())
+				if err != nil {
+					return fmt.Errorf("new remote write: %w", err)
+				}
+				exporter.WithHistory(manager.RemoteWriteHistory)
+				manager.AddHistoryConsumer(exporter.Name())
+				err = reg.Register(exporter)
+				if err != nil {
+					return fmt.Errorf("register remote write %q: %w", rwConfig.URL, err)
+				}
+				exporters.Add(1)
+				go func() {
+					defer exporters.Done()
+					exporter.Run(ctx)
+				}()
+			}
+			if config.Graphite.Address != "" {
+				exporter, err := graphite.New(config.Graphite, manager.GraphiteSamples, logger.With().Str("service", "graphite").Logger())
+				if err != nil {
+					return fmt.Errorf("new graphite exporter: %w", err)
+				}
+				err = reg.Register(exporter)
+				if err != nil {
+					return fmt.Errorf("register graphite exporter: %w", err)
+				}
+				exporters.Add(1)
+				go func() {
+					defer exporters.Done()
+					exporter.Run(ctx)
+				}()
+			}
+			if config.OTLP.Endpoint != "" {
+				exporter, err := otlp.New(config.OTLP, reg, logger.With().Str("service", "otlp").Logger())
 				if err != nil {
-					logger.Error().Err(err).Str("server", watcher.Name).Msg("register watcher")
-					return fmt.Errorf("register watcher: %w", err)
+					return fmt.Errorf("new otlp exporter: %w", err)
 				}
+				err = reg.Register(exporter)
+				if err != nil {
+					return fmt.Errorf("register otlp exporter: %w", err)
+				}
+				manager.SetOTLP(exporter)
+				exporters.Add(1)
+				go func() {
+					defer exporters.Done()
+					exporter.Run(ctx)
+				}()
+			}
+
+			err = manager.Apply(config, servers)
+			if err != nil {
+				logger.Error().Err(err).Msg("apply config")
+				return fmt.Errorf("apply config: %w", err)
 			}
+			logger.Info().
+				Str("config_path", cliOpts.ConfigPath).
+				Str("pyroscope", config.Pyroscope.Address).
+				Int("num_watchers", len(servers)).
+				Msg("watching")
+
+			go reloadConfig(ctx, cliOpts, manager, reloadInterval, hash, logger)
 
-			handler := promhttp.HandlerFor(reg, promhttp.HandlerOpts{
-				Registry: reg,
+			handler := admin.New(manager, reg, admin.Options{
+				Pprof: pprof,
 			})
 
-			//go func() {
-			//	mux := http.NewServeMux()
-			//	mux.Handle("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
-			//	err := http.ListenAndServe(":6060", mux)
-			//	if err != nil {
-			//		logger.Error().Err(err).Msg("pprof")
-			//	}
-			//}()
+			srv := &http.Server{
+				Addr:    listenAddress,
+				Handler: handler,
+			}
+			serveErr := make(chan error, 1)
+			go func() {
+				logger.Info().Str("address", listenAddress).Msg("serving admin http")
+				serveErr <- srv.ListenAndServe()
+			}()
+
+			select {
+			case err = <-serveErr:
+				logger.Error().Err(err).Msg("serve admin http")
+				err = fmt.Errorf("serve admin http: %w", err)
+			case <-ctx.Done():
+				logger.Info().Msg("shutting down")
+			}
+			// Later signals kill the process instead of waiting.
+			stop()
 
-			return http.ListenAndServe(":2112", handler)
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			return errors.Join(
+				err,
+				shutdown("admin http", srv.Shutdown(shutdownCtx), logger),
+				shutdown("watchers", manager.Shutdown(shutdownCtx), logger),
+				shutdown("exporters", wait(shutdownCtx, &exporters), logger),
+			)
 		},
 	}
 
@@ -79,16 +207,21 @@ func (c *cliWatcherConfig) SingleWatcher() *cliWatcherConfig {
 	return c
 }
 
-func (c *cliWatcherConfig) Attach(cmd *serpent.Command) {
-	cmd.Options = append(cmd.Options, serpent.Option{
+// configOption is the path of the config file.
+func configOption(path *string) serpent.Option {
+	return serpent.Option{
 		Name:          "config",
 		Description:   "YAML config file to use.",
 		Required:      false,
 		Flag:          "config",
 		FlagShorthand: "c",
 		Default:       "config.yaml",
-		Value:         serpent.StringOf(&c.ConfigPath),
-	},
+		Value:         serpent.StringOf(path),
+	}
+}
+
+func (c *cliWatcherConfig) Attach(cmd *serpent.Command) {
+	cmd.Options = append(cmd.Options, configOption(&c.ConfigPath),
 		// Manual configuration for a single server. Used for 1 off commands.
 		serpent.Option{
 			Name:        "server-config",
@@ -115,42 +248,38 @@ func (c *cliWatcherConfig) Attach(cmd *serpent.Command) {
 	}
 }
 
-func configureWatchers(opts *cliWatcherConfig, logger zerolog.Logger) ([]*watch.Watcher, error) {
-	watchConfigs := make([]watch.WatcherOptions, 0)
-	if opts.Additional.Value.URL != "" {
-		if opts.single {
-			if opts.Additional.Value.Name == "" {
-				opts.Additional.Value.Name = "manual"
-			}
-			if opts.SelectServer == "" {
-				opts.SelectServer = opts.Additional.Value.Name
-			}
-		}
-		watchConfigs = append(watchConfigs, opts.Additional.Value)
+// shutdown logs a part of the process that failed to stop cleanly.
+func shutdown(name string, err error, logger zerolog.Logger) error {
+	if err != nil {
+		logger.Error().Err(err).Str("component", name).Msg("shutdown failed")
+		return fmt.Errorf("shut down %s: %w", name, err)
 	}
+	logger.Info().Str("component", name).Msg("shut down")
+	return nil
+}
 
-	_, err := os.Stat(opts.ConfigPath)
-	var config watch.WatchConfig
-	// If the config exists, parse it.
-	if !os.IsNotExist(err) {
-		yamlData, err := os.ReadFile(opts.ConfigPath)
-		if err != nil {
-			logger.Error().Err(err).Str("config", opts.ConfigPath).Msg("read config")
-			return nil, fmt.Errorf("read config: %w", err)
-		}
+// wait waits for the group, or until ctx is done.
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
 
-		err = yaml.Unmarshal(yamlData, &config)
-		if err != nil {
-			logger.Error().Err(err).Str("config", opts.ConfigPath).Msg("unmarshal config")
-			return nil, fmt.Errorf("unmarshal config: %w", err)
-		}
-	} else {
-		if opts.Additional.Value.URL == "" {
-			return nil, fmt.Errorf("config file does not exist: %s", opts.ConfigPath)
-		}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func configureWatchers(opts *cliWatcherConfig, logger zerolog.Logger) ([]*watch.Watcher, error) {
+	config, allConfigs, err := loadConfig(opts, logger)
+	if err != nil {
+		return nil, err
 	}
 
-	allConfigs := append(watchConfigs, config.Servers...)
 	watchers := make([]*watch.Watcher, 0, len(allConfigs))
 	for _, server := range allConfigs {
 		watcher, err := watch.New(config, server, logger.With().Str("service", "watcher").Logger())
@@ -188,3 +317,47 @@ func configureWatchers(opts *cliWatcherConfig, logger zerolog.Logger) ([]*watch.
 
 	return watchers, nil
 }
+
+// loadConfig reads the config file and returns the global config along with
+// every server to watch, including the one passed on the command line.
+func loadConfig(opts *cliWatcherConfig, logger zerolog.Logger) (watch.WatchConfig, []watch.WatcherOptions, error) {
+	watchConfigs := make([]watch.WatcherOptions, 0)
+	if opts.Additional.Value.URL != "" {
+		if opts.single {
+			if opts.Additional.Value.Name == "" {
+				opts.Additional.Value.Name = "manual"
+			}
+			if opts.SelectServer == "" {
+				opts.SelectServer = opts.Additional.Value.Name
+			}
+		}
+		err := opts.Additional.Value.Validate()
+		if err != nil {
+			return watch.WatchConfig{}, nil, fmt.Errorf("invalid server-config: %w", err)
+		}
+		watchConfigs = append(watchConfigs, opts.Additional.Value)
+	}
+
+	_, err := os.Stat(opts.ConfigPath)
+	var config watch.WatchConfig
+	// If the config exists, parse it.
+	if !os.IsNotExist(err) {
+		yamlData, err := os.ReadFile(opts.ConfigPath)
+		if err != nil {
+			logger.Error().Err(err).Str("config", opts.ConfigPath).Msg("read config")
+			return config, nil, fmt.Errorf("read config: %w", err)
+		}
+
+		config, err = watch.ParseConfig(opts.ConfigPath, yamlData)
+		if err != nil {
+			logger.Error().Err(err).Str("config", opts.ConfigPath).Msg("parse config")
+			return config, nil, fmt.Errorf("parse config: %w", err)
+		}
+	} else {
+		if opts.Additional.Value.URL == "" {
+			return config, nil, fmt.Errorf("config file does not exist: %s", opts.ConfigPath)
+		}
+	}
+
+	return config, append(watchConfigs, config.Servers...), nil
+}
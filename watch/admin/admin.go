@@ -0,0 +1,95 @@
+package admin
+
+import (
+	_ "embed"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/Emyrk/screeps-watcher/watch"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+//go:embed targets.html
+var targetsHTML string
+
+var targetsTemplate = template.Must(template.New("targets").Funcs(template.FuncMap{
+	"since": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return time.Since(t).Round(time.Second).String() + " ago"
+	},
+	"ms": func(d time.Duration) string {
+		return d.Round(time.Millisecond).String()
+	},
+}).Parse(targetsHTML))
+
+// Status is what the admin server needs to know about the running watchers.
+type Status interface {
+	Ready() bool
+	Targets() []watch.TargetStatus
+}
+
+type Options struct {
+	// Pprof exposes the go profiling endpoints under /debug/pprof/.
+	Pprof bool
+}
+
+// New returns the handler for the admin server.
+//
+//	/metrics    prometheus metrics of the registry
+//	/healthz    always ok while the process is serving
+//	/readyz     ok once every watcher is ready
+//	/targets    status of every scrape target, html or json with ?format=json
+func New(status Status, reg *prometheus.Registry, opts Options) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{
+		Registry: reg,
+	}))
+	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(rw http.ResponseWriter, _ *http.Request) {
+		if !status.Ready() {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = rw.Write([]byte("not ready\n"))
+			return
+		}
+		_, _ = rw.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/targets", func(rw http.ResponseWriter, r *http.Request) {
+		targets := status.Targets()
+		if r.URL.Query().Get("format") == "json" {
+			rw.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(rw).Encode(targets)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := targetsTemplate.Execute(rw, targets)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(rw, r)
+			return
+		}
+		http.Redirect(rw, r, "/targets", http.StatusFound)
+	})
+
+	if opts.Pprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	return mux
+}
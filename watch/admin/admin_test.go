@@ -0,0 +1,61 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Emyrk/screeps-watcher/watch"
+	"github.com/Emyrk/screeps-watcher/watch/admin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeStatus struct {
+	ready   bool
+	targets []watch.TargetStatus
+}
+
+func (f *fakeStatus) Ready() bool                   { return f.ready }
+func (f *fakeStatus) Targets() []watch.TargetStatus { return f.targets }
+
+func TestAdmin(t *testing.T) {
+	status := &fakeStatus{
+		targets: []watch.TargetStatus{
+			{
+				Server:     "Screeps.com",
+				Shard:      "shard3",
+				Target:     "metrics:77",
+				Health:     watch.HealthDown,
+				LastScrape: time.Now(),
+				LastError:  "non-200 status code: 500",
+			},
+		},
+	}
+	srv := httptest.NewServer(admin.New(status, prometheus.NewRegistry(), admin.Options{}))
+	t.Cleanup(srv.Close)
+
+	get := func(path string) *http.Response {
+		resp, err := http.Get(srv.URL + path)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		return resp
+	}
+
+	require.Equal(t, http.StatusOK, get("/healthz").StatusCode)
+	require.Equal(t, http.StatusServiceUnavailable, get("/readyz").StatusCode)
+	status.ready = true
+	require.Equal(t, http.StatusOK, get("/readyz").StatusCode)
+	require.Equal(t, http.StatusOK, get("/metrics").StatusCode)
+	require.Equal(t, http.StatusOK, get("/targets").StatusCode)
+	require.Equal(t, http.StatusNotFound, get("/debug/pprof/").StatusCode)
+
+	var targets []watch.TargetStatus
+	err := json.NewDecoder(get("/targets?format=json").Body).Decode(&targets)
+	require.NoError(t, err)
+	require.Len(t, targets, 1)
+	require.Equal(t, "metrics:77", targets[0].Target)
+	require.Equal(t, "non-200 status code: 500", targets[0].LastError)
+}
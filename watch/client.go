@@ -3,16 +3,37 @@ package watch
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Emyrk/screeps-watcher/watch/memory"
+	"github.com/Emyrk/screeps-watcher/watch/ratelimit"
 )
 
+const (
+	authMePath        = "/api/auth/me"
+	marketStatsPath   = "/api/game/market/stats"
+	memorySegmentPath = "/api/user/memory-segment"
+)
+
+// ErrDecode is returned when a memory segment cannot be decoded.
+var ErrDecode = errors.New("decode memory segment")
+
+// StatusError is returned when the api responds with an unexpected status.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("non-200 status code: %d", e.StatusCode)
+}
+
 // https://screeps.com/api/game/market/stats?resourceType=energy&shard=shard3
 func (w *Watcher) Market(ctx context.Context, resourceType string, shard string) (json.RawMessage, error) {
 	vals := url.Values{
@@ -23,35 +44,7 @@ func (w *Watcher) Market(ctx context.Context, resourceType string, shard string)
 		vals.Set("shard", shard)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "GET", w.URL.ResolveReference(&url.URL{
-		Path:     "/api/game/market/stats",
-		RawQuery: vals.Encode(),
-	}).String(), nil)
-	if err != nil {
-		return nil, fmt.Errorf("new request: %w", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := w.AuthMethod.AuthenticatedRequest(w.cli, req)
-	if err != nil {
-		return nil, fmt.Errorf("do request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusTooManyRequests {
-		w.marketApiRateLimitUntil = w.rateLimtResetAt(resp)
-		return nil, fmt.Errorf("rate limit hit")
-	}
-
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("non-200 status code: %d", resp.StatusCode)
-	}
-
-	respData, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("read all: %w", err)
-	}
-	return respData, nil
+	return w.get(ctx, marketStatsPath, vals)
 }
 
 func (w *Watcher) RoomObjects(ctx context.Context, room string, shard string) (json.RawMessage, error) {
@@ -60,36 +53,7 @@ func (w *Watcher) RoomObjects(ctx context.Context, room string, shard string) (j
 		"shard": []string{shard},
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "GET", w.URL.ResolveReference(&url.URL{
-		Path:     "/api/game/room-objects",
-		RawQuery: vals.Encode(),
-	}).String(), nil)
-	if err != nil {
-		return nil, fmt.Errorf("new request: %w", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := w.AuthMethod.AuthenticatedRequest(w.cli, req)
-	if err != nil {
-		return nil, fmt.Errorf("do request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusTooManyRequests {
-		w.memorySegmentRateLimitUntil = w.rateLimtResetAt(resp)
-		return nil, fmt.Errorf("rate limit hit")
-	}
-
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("non-200 status code: %d", resp.StatusCode)
-	}
-
-	respData, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("read all: %w", err)
-	}
-
-	return respData, nil
+	return w.get(ctx, "/api/game/room-objects", vals)
 }
 
 func (w *Watcher) RoomOverview(ctx context.Context, room string, shard string) (json.RawMessage, error) {
@@ -99,36 +63,7 @@ func (w *Watcher) RoomOverview(ctx context.Context, room string, shard string) (
 		"shard":    []string{shard},
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "GET", w.URL.ResolveReference(&url.URL{
-		Path:     "/api/game/room-overview",
-		RawQuery: vals.Encode(),
-	}).String(), nil)
-	if err != nil {
-		return nil, fmt.Errorf("new request: %w", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := w.AuthMethod.AuthenticatedRequest(w.cli, req)
-	if err != nil {
-		return nil, fmt.Errorf("do request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusTooManyRequests {
-		w.memorySegmentRateLimitUntil = w.rateLimtResetAt(resp)
-		return nil, fmt.Errorf("rate limit hit")
-	}
-
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("non-200 status code: %d", resp.StatusCode)
-	}
-
-	respData, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("read all: %w", err)
-	}
-
-	return respData, nil
+	return w.get(ctx, "/api/game/room-overview", vals)
 }
 
 func (w *Watcher) RoomTerrain(ctx context.Context, room string, shard string) (json.RawMessage, error) {
@@ -139,92 +74,113 @@ func (w *Watcher) RoomTerrain(ctx context.Context, room string, shard string) (j
 		"shard":   []string{shard},
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "GET", w.URL.ResolveReference(&url.URL{
-		Path:     "/api/game/room-terrain",
-		RawQuery: vals.Encode(),
-	}).String(), nil)
+	return w.get(ctx, "/api/game/room-terrain", vals)
+}
+
+// https://github.com/screepers/node-screeps-api/blob/master/docs/Endpoints.md
+func (w *Watcher) MemorySegment(ctx context.Context, id int, shard string, opts memory.DecodeOptions) (json.RawMessage, int, error) {
+	vals := url.Values{
+		"segment": []string{strconv.Itoa(id)},
+		"shard":   []string{shard},
+	}
+
+	respData, err := w.get(ctx, memorySegmentPath, vals)
 	if err != nil {
-		return nil, fmt.Errorf("new request: %w", err)
+		return nil, -1, err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := w.AuthMethod.AuthenticatedRequest(w.cli, req)
+	decoded, err := memory.Decode(respData, opts)
 	if err != nil {
-		return nil, fmt.Errorf("do request: %w", err)
+		return nil, -1, fmt.Errorf("%w: %w", ErrDecode, err)
 	}
-	defer resp.Body.Close()
+	return decoded, len(respData), nil
+}
 
-	if resp.StatusCode == http.StatusTooManyRequests {
-		w.memorySegmentRateLimitUntil = w.rateLimtResetAt(resp)
-		return nil, fmt.Errorf("rate limit hit")
+// MemorySegments fetches several segments of a shard in a single request.
+// The decoded segments are returned in the order of ids.
+func (w *Watcher) MemorySegments(ctx context.Context, ids []int, shard string, opts memory.DecodeOptions) ([]json.RawMessage, int, error) {
+	strs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		strs = append(strs, strconv.Itoa(id))
+	}
+	vals := url.Values{
+		"segment": []string{strings.Join(strs, ",")},
+		"shard":   []string{shard},
 	}
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("non-200 status code: %d", resp.StatusCode)
+	respData, err := w.get(ctx, memorySegmentPath, vals)
+	if err != nil {
+		return nil, -1, err
 	}
 
-	respData, err := io.ReadAll(resp.Body)
+	decoded, err := memory.DecodeSegments(respData, opts)
 	if err != nil {
-		return nil, fmt.Errorf("read all: %w", err)
+		return nil, -1, fmt.Errorf("%w: %w", ErrDecode, err)
+	}
+	if len(decoded) != len(ids) {
+		return nil, -1, fmt.Errorf("%w: requested %d segments, got %d", ErrDecode, len(ids), len(decoded))
 	}
 
-	return respData, nil
+	segments := make([]json.RawMessage, 0, len(decoded))
+	for _, d := range decoded {
+		segments = append(segments, d)
+	}
+	return segments, len(respData), nil
 }
 
-// https://github.com/screepers/node-screeps-api/blob/master/docs/Endpoints.md
-func (w *Watcher) MemorySegment(ctx context.Context, id int, shard string) (json.RawMessage, int, error) {
-	vals := url.Values{
-		"segment": []string{strconv.Itoa(id)},
-		"shard":   []string{shard},
+// get makes an authenticated GET request to the api. Every request takes from
+// the rate limit budget first, and every response updates it.
+func (w *Watcher) get(ctx context.Context, path string, vals url.Values) ([]byte, error) {
+	endpoint := ratelimit.Endpoint(http.MethodGet, path)
+	err := w.RateLimits.Take(ctx, endpoint, w.rateLimitMaxWait)
+	if err != nil {
+		return nil, err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "GET", w.URL.ResolveReference(&url.URL{
-		Path:     "/api/user/memory-segment",
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, w.URL.ResolveReference(&url.URL{
+		Path:     path,
 		RawQuery: vals.Encode(),
 	}).String(), nil)
 	if err != nil {
-		return nil, -1, fmt.Errorf("new request: %w", err)
+		return nil, fmt.Errorf("new request: %w", err)
 	}
 
+	shard := vals.Get("shard")
+	if shard == "" {
+		shard = "none"
+	}
+	start := time.Now()
+	size := -1
+	defer func() {
+		w.stats.observeRequest(shard, scrapeTarget(ctx), path, time.Since(start), size)
+	}()
+
 	req.Header.Set("Content-Type", "application/json")
 	resp, err := w.AuthMethod.AuthenticatedRequest(w.cli, req)
 	if err != nil {
-		return nil, -1, fmt.Errorf("do request: %w", err)
+		return nil, fmt.Errorf("do request: %w", err)
 	}
 	defer resp.Body.Close()
 
+	w.RateLimits.Observe(endpoint, resp)
+	w.saveRateLimits(false)
 	if resp.StatusCode == http.StatusTooManyRequests {
-		w.memorySegmentRateLimitUntil = w.rateLimtResetAt(resp)
-		return nil, -1, fmt.Errorf("rate limit hit")
+		until := w.RateLimits.Until(endpoint)
+		w.logger.Error().
+			Str("endpoint", endpoint).
+			Time("reset", until).
+			Msg("rate limit hit")
+		return nil, &ratelimit.Error{Endpoint: endpoint, Until: until}
 	}
 
 	if resp.StatusCode != 200 {
-		return nil, -1, fmt.Errorf("non-200 status code: %d", resp.StatusCode)
+		return nil, &StatusError{StatusCode: resp.StatusCode}
 	}
 
 	respData, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, -1, fmt.Errorf("read all: %w", err)
-	}
-
-	decoded, err := memory.Decode(respData)
-	if err != nil {
-		return nil, -1, fmt.Errorf("decode: %w", err)
-	}
-	return decoded, len(respData), nil
-}
-
-func (w *Watcher) rateLimtResetAt(resp *http.Response) time.Time {
-	sleepUntil := time.Now().Add(time.Minute * 10)
-	reset := resp.Header.Get("X-RateLimit-Reset")
-	if reset != "" {
-		resetAt, err := strconv.ParseInt(reset, 10, 64)
-		if err == nil {
-			sleepUntil = time.Unix(resetAt, 0).Add(time.Second * 5)
-		}
-		w.logger.Error().
-			Time("reset", sleepUntil).
-			Msg("rate limit hit")
+		return nil, fmt.Errorf("read all: %w", err)
 	}
-	return sleepUntil
+	size = len(respData)
+	return respData, nil
 }
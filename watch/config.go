@@ -0,0 +1,515 @@
+package watch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	pathpkg "path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Emyrk/screeps-watcher/watch/graphite"
+	"github.com/Emyrk/screeps-watcher/watch/memcollector"
+	"github.com/Emyrk/screeps-watcher/watch/memory"
+	"github.com/Emyrk/screeps-watcher/watch/otlp"
+	"github.com/Emyrk/screeps-watcher/watch/screepssocket"
+	"gopkg.in/yaml.v3"
+)
+
+var envVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces every ${VAR} in the scalar values of the config with the
+// value of the environment variable. Values are expanded after the yaml is
+// parsed, so a '#', ':', quote or newline in a variable is kept as it is.
+// Only the braced form is expanded, so a bare '$' in a password is left alone.
+// Keys and comments are not expanded. Unset variables are an error rather
+// than silently becoming empty strings.
+func expandEnv(node *yaml.Node) error {
+	var missing []string
+	var walk func(n *yaml.Node)
+	walk = func(n *yaml.Node) {
+		switch n.Kind {
+		case yaml.DocumentNode, yaml.SequenceNode:
+			for _, c := range n.Content {
+				walk(c)
+			}
+		case yaml.MappingNode:
+			for i := 1; i < len(n.Content); i += 2 {
+				walk(n.Content[i])
+			}
+		case yaml.ScalarNode:
+			if !envVar.MatchString(n.Value) {
+				return
+			}
+			n.Value = envVar.ReplaceAllStringFunc(n.Value, func(match string) string {
+				name := envVar.FindStringSubmatch(match)[1]
+				value, ok := os.LookupEnv(name)
+				if !ok {
+					missing = append(missing, name)
+					return match
+				}
+				return value
+			})
+			if n.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+				// A plain value is typed by what it expands to, so
+				// "metrics_segment: ${SEGMENT}" is a number.
+				n.Tag = ""
+			}
+		}
+	}
+	walk(node)
+	if len(missing) > 0 {
+		return fmt.Errorf("environment variables not set: %v", missing)
+	}
+	return nil
+}
+
+// ConfigError is a single problem with the config.
+type ConfigError struct {
+	File string
+	// Line is 0 when the problem cannot be tied to a line.
+	Line int
+	// Path is the yaml path of the problem, eg "servers[0].targets[1]".
+	Path    string
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	var sb strings.Builder
+	if e.File != "" {
+		sb.WriteString(e.File)
+		if e.Line > 0 {
+			sb.WriteString(":" + strconv.Itoa(e.Line))
+		}
+		sb.WriteString(": ")
+	}
+	if e.Path != "" {
+		sb.WriteString(e.Path + ": ")
+	}
+	sb.WriteString(e.Message)
+	return sb.String()
+}
+
+var typeErrorLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// ParseConfig parses the yaml config, expands environment variables in its
+// values and validates it. Unknown keys are an error. Every problem found is
+// returned joined together, each one a ConfigError. The file is only used in
+// the error messages.
+func ParseConfig(file string, data []byte) (WatchConfig, error) {
+	var config WatchConfig
+	var root yaml.Node
+	err := yaml.Unmarshal(data, &root)
+	if err != nil {
+		return config, ConfigError{File: file, Message: err.Error()}
+	}
+	if len(root.Content) == 0 {
+		// An empty config is valid, it just watches nothing.
+		return config, nil
+	}
+
+	// A node cannot be decoded with KnownFields, so unknown keys are found by
+	// decoding the text. Its type errors are from values not yet expanded,
+	// those of the expanded nodes are used instead.
+	var msgs []string
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var typeErr *yaml.TypeError
+	if errors.As(dec.Decode(&WatchConfig{}), &typeErr) {
+		for _, msg := range typeErr.Errors {
+			if strings.Contains(msg, " not found in type ") {
+				msgs = append(msgs, msg)
+			}
+		}
+	}
+
+	err = expandEnv(&root)
+	if err != nil {
+		return config, ConfigError{File: file, Message: err.Error()}
+	}
+	err = root.Decode(&config)
+	if errors.As(err, &typeErr) {
+		msgs = append(msgs, typeErr.Errors...)
+	} else if err != nil {
+		return config, ConfigError{File: file, Message: err.Error()}
+	}
+	if len(msgs) > 0 {
+		errs := make([]error, 0, len(msgs))
+		for _, msg := range msgs {
+			cerr := ConfigError{File: file, Message: msg}
+			if m := typeErrorLine.FindStringSubmatch(msg); m != nil {
+				cerr.Line, _ = strconv.Atoi(m[1])
+				cerr.Message = m[2]
+			}
+			errs = append(errs, cerr)
+		}
+		return config, errors.Join(errs...)
+	}
+
+	var ps problems
+	config.validate(&ps)
+	errs := make([]error, 0, len(ps))
+	for _, p := range ps {
+		p.File = file
+		p.Line = nodeLine(&root, p.path...)
+		errs = append(errs, p.ConfigError)
+	}
+	return config, errors.Join(errs...)
+}
+
+type problem struct {
+	ConfigError
+	path []any
+}
+
+// problems collects validation problems by yaml path. Path elements are
+// either mapping keys (string) or sequence indexes (int).
+type problems []problem
+
+func (ps *problems) add(msg string, path ...any) {
+	*ps = append(*ps, problem{
+		ConfigError: ConfigError{Path: formatPath(path), Message: msg},
+		path:        path,
+	})
+}
+
+func (ps problems) err() error {
+	errs := make([]error, 0, len(ps))
+	for _, p := range ps {
+		errs = append(errs, p.ConfigError)
+	}
+	return errors.Join(errs...)
+}
+
+func formatPath(path []any) string {
+	var sb strings.Builder
+	for _, p := range path {
+		switch p := p.(type) {
+		case int:
+			sb.WriteString("[" + strconv.Itoa(p) + "]")
+		default:
+			if sb.Len() > 0 {
+				sb.WriteString(".")
+			}
+			sb.WriteString(fmt.Sprint(p))
+		}
+	}
+	return sb.String()
+}
+
+// nodeLine finds the line of the deepest node along the path that exists.
+func nodeLine(node *yaml.Node, path ...any) int {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := node.Line
+	for _, p := range path {
+		var next *yaml.Node
+		switch p := p.(type) {
+		case int:
+			if node.Kind == yaml.SequenceNode && p < len(node.Content) {
+				next = node.Content[p]
+			}
+		case string:
+			if node.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(node.Content); i += 2 {
+					if node.Content[i].Value == p {
+						next = node.Content[i+1]
+						line = node.Content[i].Line
+						break
+					}
+				}
+			}
+		}
+		if next == nil {
+			return line
+		}
+		node = next
+		line = node.Line
+	}
+	return line
+}
+
+// Validate returns every problem in the config joined together.
+func (c WatchConfig) Validate() error {
+	var ps problems
+	c.validate(&ps)
+	return ps.err()
+}
+
+func (c WatchConfig) validate(ps *problems) {
+	if c.Pyroscope.Address != "" {
+		validateURL(ps, c.Pyroscope.Address, "pyroscope", "address")
+	}
+
+	if c.Graphite.Address != "" {
+		if _, _, err := net.SplitHostPort(c.Graphite.Address); err != nil {
+			ps.add("address must be host:port", "graphite", "address")
+		}
+		validateInterval(ps, c.Graphite.Interval, "graphite", "interval")
+		if c.Graphite.Template != "" {
+			if err := graphite.ValidateTemplate(c.Graphite.Template); err != nil {
+				ps.add(err.Error(), "graphite", "template")
+			}
+		}
+		for i, t := range c.Graphite.Templates {
+			if _, err := pathpkg.Match(t.Match, ""); err != nil {
+				ps.add(fmt.Sprintf("invalid glob %q", t.Match), "graphite", "templates", i, "match")
+			}
+			if err := graphite.ValidateTemplate(t.Template); err != nil {
+				ps.add(err.Error(), "graphite", "templates", i, "template")
+			}
+		}
+	}
+
+	if c.OTLP.Endpoint != "" {
+		switch c.OTLP.Protocol {
+		case "", otlp.ProtocolGRPC, otlp.ProtocolHTTP:
+			if err := otlp.ValidateEndpoint(c.OTLP.Protocol, c.OTLP.Endpoint); err != nil {
+				ps.add(err.Error(), "otlp", "endpoint")
+			}
+		default:
+			ps.add(fmt.Sprintf("unknown protocol %q, must be %q or %q", c.OTLP.Protocol, otlp.ProtocolGRPC, otlp.ProtocolHTTP), "otlp", "protocol")
+		}
+		for i, signal := range c.OTLP.Signals {
+			if !slices.Contains(otlp.Signals, signal) {
+				ps.add(fmt.Sprintf("unknown signal %q, must be one of %s", signal, strings.Join(otlp.Signals, ", ")), "otlp", "signals", i)
+			}
+		}
+		validateInterval(ps, c.OTLP.Interval, "otlp", "interval")
+		validateInterval(ps, c.OTLP.BatchInterval, "otlp", "batch_interval")
+		if c.OTLP.QueueSize < 0 {
+			ps.add("queue_size must not be negative", "otlp", "queue_size")
+		}
+	}
+
+	for i, rw := range c.RemoteWrite {
+		if rw.URL == "" {
+			ps.add("url is required", "remote_write", i)
+		} else {
+			validateURL(ps, rw.URL, "remote_write", i, "url")
+		}
+		validateInterval(ps, rw.Interval, "remote_write", i, "interval")
+		if rw.QueueSize < 0 {
+			ps.add("must not be negative", "remote_write", i, "queue_size")
+		}
+		if rw.Password != "" && rw.BearerToken != "" {
+			ps.add("cannot use both basic auth and a bearer_token", "remote_write", i)
+		}
+	}
+
+	names := make(map[string]int)
+	for i, server := range c.Servers {
+		path := []any{"servers", i}
+		if first, ok := names[server.Name]; ok {
+			ps.add(fmt.Sprintf("duplicate server name %q, also used by servers[%d]", server.Name, first), append(path, "name")...)
+		} else {
+			names[server.Name] = i
+		}
+		if server.Name == "" {
+			ps.add("name is required", path...)
+		}
+		server.validate(ps, path...)
+	}
+}
+
+// Validate returns every problem with a single server config joined
+// together.
+func (opts WatcherOptions) Validate() error {
+	var ps problems
+	opts.validate(&ps)
+	return ps.err()
+}
+
+func (opts WatcherOptions) validate(ps *problems, path ...any) {
+	at := func(elems ...any) []any {
+		return append(slices.Clone(path), elems...)
+	}
+
+	if opts.URL == "" {
+		ps.add("url is required", path...)
+	} else {
+		validateURL(ps, opts.URL, at("url")...)
+	}
+
+	passwords := countSet(opts.Password, opts.PasswordFile)
+	tokens := countSet(opts.Token, opts.TokenFile, opts.TokenCommand)
+	if passwords > 1 {
+		ps.add("only one of password and password_file can be set", path...)
+	}
+	if tokens > 1 {
+		ps.add("only one of token, token_file and token_command can be set", path...)
+	}
+	if passwords > 0 && tokens > 0 {
+		ps.add("cannot use both a password and a token", path...)
+	}
+
+	validateInterval(ps, opts.MetricsInterval, at("metrics_scrape_interval")...)
+	validateInterval(ps, opts.MarketInterval, at("market_scrape_interval")...)
+	if opts.RateLimitMaxWait < 0 {
+		ps.add("must not be negative", at("rate_limit_max_wait")...)
+	}
+
+	if len(opts.MemorySegments) == 0 && len(opts.Markets) == 0 && len(opts.WebsocketChannels) == 0 {
+		ps.add("nothing to watch, configure targets, markets or websocket_channels", path...)
+	}
+
+	validateInterval(ps, opts.ShardDiscoveryInterval, at("shard_discovery_interval")...)
+	validateInterval(ps, opts.TickInterval, at("tick_interval")...)
+
+	validateRelabelConfigs(ps, opts.MetricRelabelConfigs, at("metric_relabel_configs")...)
+
+	shards := make(map[string]int)
+	for i, t := range opts.MemorySegments {
+		validateShard(ps, t.Shard, at("targets", i, "shard")...)
+		for j, shard := range t.Shards {
+			validateShard(ps, shard, at("targets", i, "shards", j)...)
+		}
+		if !t.discovers() {
+			shard := t.Shard
+			if shard == "" {
+				shard = "none"
+			}
+			if first, ok := shards[shard]; ok {
+				ps.add(fmt.Sprintf("shard %q already has a target at targets[%d]", shard, first), at("targets", i)...)
+			} else {
+				shards[shard] = i
+			}
+		}
+		metrics, profile := t.MetricSegmentIDs(), t.ProfileSegmentIDs()
+		if len(metrics) == 0 && len(profile) == 0 {
+			ps.add("target needs a metrics_segment or a profile_segment", at("targets", i)...)
+		}
+		if t.StaleAfterTicks < 0 {
+			ps.add("must not be negative", at("targets", i, "stale_after_ticks")...)
+		}
+		if t.Limits.MaxSeries < 0 {
+			ps.add("must not be negative", at("targets", i, "limits", "max_series")...)
+		}
+		if t.Limits.MaxSeriesPerMetric < 0 {
+			ps.add("must not be negative", at("targets", i, "limits", "max_series_per_metric")...)
+		}
+		if t.Limits.Action != "" && !slices.Contains(memcollector.LimitActions, t.Limits.Action) {
+			ps.add(fmt.Sprintf("unknown action %q, must be one of %s", t.Limits.Action, strings.Join(memcollector.LimitActions, ", ")), at("targets", i, "limits", "action")...)
+		}
+		validateRelabelConfigs(ps, t.MetricRelabelConfigs, at("targets", i, "metric_relabel_configs")...)
+		for j, key := range t.Values.ArrayKeys {
+			if key == "" {
+				ps.add("must not be empty", at("targets", i, "values", "array_keys", j)...)
+			}
+		}
+		if t.Format != "" && !slices.Contains(memcollector.Formats, t.Format) {
+			ps.add(fmt.Sprintf("unknown format %q, must be one of %s", t.Format, strings.Join(memcollector.Formats, ", ")), at("targets", i, "format")...)
+		}
+		if t.Encoding != "" && !slices.Contains(memory.Encodings(), t.Encoding) {
+			ps.add(fmt.Sprintf("unknown encoding %q, must be one of %s", t.Encoding, strings.Join(memory.Encodings(), ", ")), at("targets", i, "encoding")...)
+		}
+		seen := make(map[int]string)
+		checkSegments := func(key string, ids []int, single bool) {
+			for j, id := range ids {
+				p := at("targets", i, key)
+				if !single {
+					p = append(p, j)
+				}
+				validateSegment(ps, id, p...)
+				if other, ok := seen[id]; ok {
+					ps.add(fmt.Sprintf("segment %d is already used by %s", id, other), p...)
+				}
+				seen[id] = key
+			}
+		}
+		if t.Metrics != nil {
+			checkSegments("metrics_segment", []int{*t.Metrics}, true)
+		}
+		checkSegments("metrics_segments", t.MetricsSegments, false)
+		if t.Profile != nil {
+			checkSegments("profile_segment", []int{*t.Profile}, true)
+		}
+		checkSegments("profile_segments", t.ProfileSegments, false)
+	}
+
+	for i, m := range opts.Markets {
+		if m.ResourceType == "" {
+			ps.add("resource_type is required", at("markets", i)...)
+		}
+		if isGlob(m.Shard) {
+			ps.add("markets do not support shard globs", at("markets", i, "shard")...)
+		}
+		validateShard(ps, m.Shard, at("markets", i, "shard")...)
+	}
+
+	for i, c := range opts.WebsocketChannels {
+		if !slices.Contains(screepssocket.Channels, c) {
+			ps.add(fmt.Sprintf("unknown channel %q, must be one of %v", c, screepssocket.Channels), at("websocket_channels", i)...)
+		}
+	}
+}
+
+// MaxSegment is the highest memory segment id.
+const MaxSegment = 99
+
+var shardName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func validateShard(ps *problems, shard string, path ...any) {
+	if isGlob(shard) {
+		if _, err := pathpkg.Match(shard, ""); err != nil {
+			ps.add(fmt.Sprintf("invalid shard glob %q", shard), path...)
+		}
+		return
+	}
+	if shard != "" && !shardName.MatchString(shard) {
+		ps.add(fmt.Sprintf("invalid shard name %q", shard), path...)
+	}
+}
+
+func validateSegment(ps *problems, segment int, path ...any) {
+	if segment < 0 || segment > MaxSegment {
+		ps.add(fmt.Sprintf("segment %d must be between 0 and %d", segment, MaxSegment), path...)
+	}
+}
+
+func validateInterval(ps *problems, interval time.Duration, path ...any) {
+	if interval != 0 && interval < time.Second {
+		ps.add(fmt.Sprintf("interval %s must be at least 1s", interval), path...)
+	}
+}
+
+func validateRelabelConfigs(ps *problems, configs []memcollector.RelabelConfig, path ...any) {
+	for i, cfg := range configs {
+		err := cfg.Validate()
+		if err != nil {
+			ps.add(err.Error(), append(slices.Clone(path), i)...)
+		}
+	}
+}
+
+func validateURL(ps *problems, raw string, path ...any) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		ps.add(fmt.Sprintf("invalid url: %v", err), path...)
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		ps.add(fmt.Sprintf("url %q must start with http:// or https://", raw), path...)
+		return
+	}
+	if u.Host == "" {
+		ps.add(fmt.Sprintf("url %q has no host", raw), path...)
+	}
+}
+
+func countSet(values ...string) int {
+	set := 0
+	for _, v := range values {
+		if v != "" {
+			set++
+		}
+	}
+	return set
+}
@@ -0,0 +1,162 @@
+package watch_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Emyrk/screeps-watcher/watch"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfigEnv(t *testing.T) {
+	t.Setenv("SCREEPS_TEST_TOKEN", "secret")
+
+	config, err := watch.ParseConfig("config.yaml", []byte(`
+servers:
+  - name: test
+    url: https://screeps.com
+    username: pa$$word
+    token: ${SCREEPS_TEST_TOKEN} # Not ${SCREEPS_TEST_UNSET}
+    websocket_channels: [console]
+`))
+	require.NoError(t, err)
+	require.Equal(t, "secret", config.Servers[0].Token)
+	require.Equal(t, "pa$$word", config.Servers[0].Username)
+
+	_, err = watch.ParseConfig("config.yaml", []byte(`token: ${SCREEPS_TEST_UNSET}`))
+	require.ErrorContains(t, err, "SCREEPS_TEST_UNSET")
+
+	// Values are expanded after parsing, so they cannot change the yaml.
+	for _, value := range []string{
+		"abc #123",
+		"abc: def",
+		`it's "quoted"`,
+		"abc\ntoken_file: /etc/passwd",
+		"- [abc]",
+	} {
+		t.Setenv("SCREEPS_TEST_PASSWORD", value)
+		config, err := watch.ParseConfig("config.yaml", []byte(`
+servers:
+  - name: test
+    url: https://screeps.com
+    username: user # ${SCREEPS_TEST_UNSET} is in a comment
+    password: ${SCREEPS_TEST_PASSWORD}
+    websocket_channels: [console]
+  - name: quoted
+    url: https://screeps.com
+    username: user
+    password: "${SCREEPS_TEST_PASSWORD}"
+    websocket_channels: [console]
+`))
+		require.NoError(t, err, value)
+		require.Equal(t, value, config.Servers[0].Password, value)
+		require.Equal(t, value, config.Servers[1].Password, value)
+		require.Empty(t, config.Servers[0].TokenFile, value)
+	}
+
+	// Plain values are typed by what they expand to.
+	t.Setenv("SCREEPS_TEST_SEGMENT", "77")
+	config, err = watch.ParseConfig("config.yaml", []byte(`
+servers:
+  - name: test
+    url: https://screeps.com
+    token: token
+    targets:
+      - metrics_segment: ${SCREEPS_TEST_SEGMENT}
+        shard: shard3
+`))
+	require.NoError(t, err)
+	require.Equal(t, 77, *config.Servers[0].MemorySegments[0].Metrics)
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	_, err := watch.ParseConfig("config.yaml", []byte(`servers:
+  - name: test
+    url: https://screeps.com
+    targets:
+      - segment: 77
+        shard: shard3
+`))
+	require.EqualError(t, err, "config.yaml:5: field segment not found in type watch.MemoryTargets")
+
+	_, err = watch.ParseConfig("config.yaml", []byte(`servers:
+  - name: test
+    url: screeps.com
+    metrics_scrape_interval: 10ms
+    targets:
+      - metrics_segment: 100
+        shard: shard3
+    websocket_channels:
+      - console
+      - logs
+  - name: test
+    url: http://localhost:21025
+`))
+	require.EqualError(t, err, strings.Join([]string{
+		`config.yaml:3: servers[0].url: url "screeps.com" must start with http:// or https://`,
+		`config.yaml:4: servers[0].metrics_scrape_interval: interval 10ms must be at least 1s`,
+		`config.yaml:6: servers[0].targets[0].metrics_segment: segment 100 must be between 0 and 99`,
+		`config.yaml:10: servers[0].websocket_channels[1]: unknown channel "logs", must be one of [console cpu]`,
+		`config.yaml:11: servers[1].name: duplicate server name "test", also used by servers[0]`,
+		`config.yaml:11: servers[1]: nothing to watch, configure targets, markets or websocket_channels`,
+	}, "\n"))
+}
+
+func TestSecrets(t *testing.T) {
+	segment := 77
+	server := watch.WatcherOptions{
+		Name:           "test",
+		URL:            "http://localhost:21025",
+		Username:       "user",
+		MemorySegments: []watch.MemoryTargets{{Metrics: &segment}},
+	}
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("from-file\n"), 0600))
+
+	t.Run("File", func(t *testing.T) {
+		opts := server
+		opts.TokenFile = tokenFile
+		w, err := watch.New(watch.WatchConfig{}, opts, zerolog.Nop())
+		require.NoError(t, err)
+		token, err := w.AuthMethod.Token(context.Background(), nil, nil)
+		require.NoError(t, err)
+		require.Equal(t, "from-file", token)
+	})
+
+	t.Run("Command", func(t *testing.T) {
+		opts := server
+		opts.TokenCommand = "echo from-command"
+		w, err := watch.New(watch.WatchConfig{}, opts, zerolog.Nop())
+		require.NoError(t, err)
+		token, err := w.AuthMethod.Token(context.Background(), nil, nil)
+		require.NoError(t, err)
+		require.Equal(t, "from-command", token)
+	})
+
+	t.Run("MissingFile", func(t *testing.T) {
+		opts := server
+		opts.PasswordFile = filepath.Join(t.TempDir(), "missing")
+		_, err := watch.New(watch.WatchConfig{}, opts, zerolog.Nop())
+		require.ErrorContains(t, err, `resolve password for "test"`)
+	})
+
+	t.Run("FailedCommand", func(t *testing.T) {
+		opts := server
+		opts.TokenCommand = "exit 1"
+		_, err := watch.New(watch.WatchConfig{}, opts, zerolog.Nop())
+		require.ErrorContains(t, err, `resolve token for "test"`)
+	})
+
+	t.Run("Ambiguous", func(t *testing.T) {
+		opts := server
+		opts.Token = "literal"
+		opts.TokenFile = tokenFile
+		_, err := watch.New(watch.WatchConfig{}, opts, zerolog.Nop())
+		require.ErrorContains(t, err, `resolve token for "test"`)
+	})
+}
@@ -0,0 +1,249 @@
+// Package graphite writes metrics to Graphite/Carbon with the plaintext
+// protocol, keeping the tree structure of the memory segments.
+package graphite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// DefaultTemplate is the path of every metric without a matching template.
+const DefaultTemplate = "screeps.{server}.{username}.{shard}.{path}"
+
+type Config struct {
+	// Address is the host:port of the Carbon plaintext listener. Graphite
+	// export is disabled if empty.
+	Address  string        `yaml:"address"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// Template turns a metric into a path. "{path}" is the path of the
+	// metric in the segment, and "{label}" is the value of a label. Labels
+	// not used by the template are appended in label name order.
+	Template string `yaml:"template"`
+	// Templates override Template for metrics whose dotted segment path
+	// matches. The first match wins.
+	Templates []Template `yaml:"templates"`
+	// Tags writes the labels not used by the template as graphite tags
+	// instead of appending them to the path.
+	Tags bool `yaml:"tags"`
+}
+
+type Template struct {
+	// Match is a glob on the dotted segment path, like "cpu.*".
+	Match    string `yaml:"match"`
+	Template string `yaml:"template"`
+}
+
+// Sample is a single metric to write.
+type Sample struct {
+	Path   []string
+	Labels map[string]string
+	Value  float64
+}
+
+// Source returns the samples to write on every push.
+type Source func() []Sample
+
+var placeholder = regexp.MustCompile(`^\{([A-Za-z_][A-Za-z0-9_]*)\}$`)
+
+// ValidateTemplate returns an error if a component of the template is
+// neither a literal nor a single placeholder.
+func ValidateTemplate(template string) error {
+	for _, part := range strings.Split(template, ".") {
+		if part == "" {
+			return fmt.Errorf("template %q has an empty component", template)
+		}
+		if strings.ContainsAny(part, "{}") && !placeholder.MatchString(part) {
+			return fmt.Errorf("template %q component %q must be a literal or a single {placeholder}", template, part)
+		}
+	}
+	return nil
+}
+
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9_\-]`)
+
+// sanitize makes a value safe to use as a single path component.
+func sanitize(s string) string {
+	return unsafeChars.ReplaceAllString(s, "_")
+}
+
+// Line renders a sample as a plaintext protocol line, without the newline.
+func (c Config) Line(s Sample, at time.Time) string {
+	dotted := strings.Join(s.Path, ".")
+	template := c.Template
+	if template == "" {
+		template = DefaultTemplate
+	}
+	for _, t := range c.Templates {
+		if ok, _ := path.Match(t.Match, dotted); ok {
+			template = t.Template
+			break
+		}
+	}
+
+	used := make(map[string]bool)
+	parts := make([]string, 0)
+	for _, part := range strings.Split(template, ".") {
+		m := placeholder.FindStringSubmatch(part)
+		switch {
+		case m == nil:
+			parts = append(parts, part)
+		case m[1] == "path":
+			for _, p := range s.Path {
+				parts = append(parts, sanitize(p))
+			}
+		default:
+			used[m[1]] = true
+			// Missing labels are left out, so one template fits metrics
+			// with and without a shard.
+			if v, ok := s.Labels[m[1]]; ok && v != "" {
+				parts = append(parts, sanitize(v))
+			}
+		}
+	}
+
+	rest := make([]string, 0)
+	for k := range s.Labels {
+		if !used[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+
+	var tags strings.Builder
+	for _, k := range rest {
+		if c.Tags {
+			_, _ = fmt.Fprintf(&tags, ";%s=%s", sanitize(k), sanitize(s.Labels[k]))
+		} else {
+			parts = append(parts, sanitize(s.Labels[k]))
+		}
+	}
+
+	return fmt.Sprintf("%s%s %s %d",
+		strings.Join(parts, "."), tags.String(),
+		strconv.FormatFloat(s.Value, 'f', -1, 64), at.Unix())
+}
+
+var _ prometheus.Collector = (*Exporter)(nil)
+
+// Exporter periodically writes the samples of the source to Carbon. Graphite
+// is best effort, a failed push is not retried.
+type Exporter struct {
+	cfg    Config
+	source Source
+	logger zerolog.Logger
+	now    func() time.Time
+
+	sent     prometheus.Counter
+	failures prometheus.Counter
+}
+
+func New(cfg Config, source Source, logger zerolog.Logger) (*Exporter, error) {
+	if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+		return nil, fmt.Errorf("invalid graphite address %q: %w", cfg.Address, err)
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = time.Minute
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = time.Second * 10
+	}
+
+	return &Exporter{
+		cfg:    cfg,
+		source: source,
+		logger: logger,
+		now:    time.Now,
+		sent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "screeps",
+			Subsystem: "graphite",
+			Name:      "sent_total",
+			Help:      "Metrics written to graphite.",
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "screeps",
+			Subsystem: "graphite",
+			Name:      "failures_total",
+			Help:      "Failed pushes to graphite.",
+		}),
+	}, nil
+}
+
+func (e *Exporter) SetNow(f func() time.Time) {
+	e.now = f
+}
+
+// Run pushes every interval until ctx is canceled.
+func (e *Exporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := e.Push(ctx)
+		if err != nil && ctx.Err() == nil {
+			e.logger.Warn().Err(err).Str("address", e.cfg.Address).Msg("graphite push failed")
+		}
+	}
+}
+
+// Push writes the current samples over a new connection.
+func (e *Exporter) Push(ctx context.Context) error {
+	at := e.now()
+	var buf bytes.Buffer
+	count := 0
+	for _, s := range e.source() {
+		if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+			continue
+		}
+		buf.WriteString(e.cfg.Line(s, at))
+		buf.WriteByte('\n')
+		count++
+	}
+	if count == 0 {
+		return nil
+	}
+
+	dialer := net.Dialer{Timeout: e.cfg.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", e.cfg.Address)
+	if err != nil {
+		e.failures.Inc()
+		return fmt.Errorf("dial graphite: %w", err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetWriteDeadline(time.Now().Add(e.cfg.Timeout))
+	_, err = conn.Write(buf.Bytes())
+	if err != nil {
+		e.failures.Inc()
+		return fmt.Errorf("write graphite: %w", err)
+	}
+	e.sent.Add(float64(count))
+	return nil
+}
+
+func (e *Exporter) Describe(descs chan<- *prometheus.Desc) {
+	e.sent.Describe(descs)
+	e.failures.Describe(descs)
+}
+
+func (e *Exporter) Collect(metrics chan<- prometheus.Metric) {
+	e.sent.Collect(metrics)
+	e.failures.Collect(metrics)
+}
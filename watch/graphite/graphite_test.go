@@ -0,0 +1,106 @@
+package graphite_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Emyrk/screeps-watcher/watch/graphite"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLine(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	sample := graphite.Sample{
+		Path:   []string{"room", "intents"},
+		Labels: map[string]string{"server": "main", "username": "me", "shard": "shard3", "room": "E11S53", "intent": "harvest"},
+		Value:  2.5,
+	}
+
+	testCases := []struct {
+		Name   string
+		Config graphite.Config
+		Sample graphite.Sample
+		Line   string
+	}{
+		{
+			Name:   "Default",
+			Sample: sample,
+			Line:   "screeps.main.me.shard3.room.intents.harvest.E11S53 2.5 1700000000",
+		},
+		{
+			Name:   "Tags",
+			Config: graphite.Config{Tags: true},
+			Sample: sample,
+			Line:   "screeps.main.me.shard3.room.intents;intent=harvest;room=E11S53 2.5 1700000000",
+		},
+		{
+			Name: "Templates",
+			Config: graphite.Config{
+				Template: "stats.{username}.{path}",
+				Templates: []graphite.Template{
+					{Match: "room.*", Template: "rooms.{shard}.{room}.{path}.{intent}"},
+				},
+			},
+			Sample: sample,
+			Line:   "rooms.shard3.E11S53.room.intents.harvest.main.me 2.5 1700000000",
+		},
+		{
+			Name: "MissingLabel",
+			Sample: graphite.Sample{
+				Path:   []string{"websocket", "cpu_last"},
+				Labels: map[string]string{"server": "main", "username": "me.name"},
+				Value:  14,
+			},
+			Line: "screeps.main.me_name.websocket.cpu_last 14 1700000000",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			require.Equal(t, tc.Line, tc.Config.Line(tc.Sample, at))
+		})
+	}
+}
+
+func TestPush(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	lines := make(chan string, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	e, err := graphite.New(graphite.Config{Address: l.Addr().String()}, func() []graphite.Sample {
+		return []graphite.Sample{
+			{Path: []string{"cpu", "used"}, Labels: map[string]string{"server": "main"}, Value: 12},
+			{Path: []string{"cpu", "bucket"}, Labels: map[string]string{"server": "main"}, Value: 9800},
+		}
+	}, zerolog.Nop())
+	require.NoError(t, err)
+	e.SetNow(func() time.Time { return time.Unix(1700000000, 0) })
+	require.NoError(t, e.Push(context.Background()))
+
+	got := make([]string, 0)
+	for line := range lines {
+		got = append(got, line)
+	}
+	require.Equal(t, []string{
+		"screeps.main.cpu.used 12 1700000000",
+		"screeps.main.cpu.bucket 9800 1700000000",
+	}, got)
+}
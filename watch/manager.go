@@ -0,0 +1,257 @@
+package watch
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/Emyrk/screeps-watcher/watch/otlp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+var _ prometheus.Collector = (*Manager)(nil)
+
+// Manager owns the set of running watchers. It is registered once in the
+// top level registry and fans out collection to whatever watchers are
+// currently running, so watchers can come and go without touching the
+// registry.
+//
+// A watcher's Describe output changes as it lazily registers market and
+// websocket metrics, so registering each watcher directly would make it
+// impossible to cleanly unregister it later.
+type Manager struct {
+	ctx    context.Context
+	logger zerolog.Logger
+
+	mu      sync.RWMutex
+	global  WatchConfig
+	running map[string]*runningWatcher
+	// wg tracks every started watcher, including stopped ones that are
+	// still flushing.
+	wg       sync.WaitGroup
+	shutdown bool
+	otlp     *otlp.Exporter
+	// historyConsumers read the history of every watcher.
+	historyConsumers []string
+}
+
+type runningWatcher struct {
+	opts WatcherOptions
+	// secrets is the hash of the resolved credentials, which the options
+	// only reference.
+	secrets [32]byte
+	watcher *Watcher
+	cancel  context.CancelFunc
+	// done is closed once the watcher has stopped.
+	done chan struct{}
+}
+
+// NewManager creates an empty manager. All watchers started by the manager
+// are stopped when ctx is canceled.
+func NewManager(ctx context.Context, logger zerolog.Logger) *Manager {
+	return &Manager{
+		ctx:     ctx,
+		logger:  logger,
+		running: make(map[string]*runningWatcher),
+	}
+}
+
+// SetOTLP sends the console logs and profiles of every watcher started after
+// to the exporter.
+func (m *Manager) SetOTLP(exporter *otlp.Exporter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.otlp = exporter
+}
+
+// AddHistoryConsumer keeps the history samples of every watcher started after
+// until the consumer reads them. History is only kept if it has a consumer.
+func (m *Manager) AddHistoryConsumer(consumer string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.historyConsumers = append(m.historyConsumers, consumer)
+}
+
+// Apply diffs the given servers against the running watchers. Watchers whose
+// options and secrets are unchanged keep running, changed watchers are
+// rebuilt, and removed watchers are stopped. Secret files and token commands
+// are read again on every call. If any new watcher fails to build, nothing is
+// changed and the previous configuration keeps running.
+func (m *Manager) Apply(global WatchConfig, servers []WatcherOptions) error {
+	seen := make(map[string]bool, len(servers))
+	for _, server := range servers {
+		if seen[server.Name] {
+			return fmt.Errorf("duplicate server name %q", server.Name)
+		}
+		seen[server.Name] = true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.shutdown {
+		return fmt.Errorf("manager is shut down")
+	}
+
+	// Global settings are shared by all watchers, so a change there
+	// rebuilds everything.
+	globalChanged := !reflect.DeepEqual(m.global.Pyroscope, global.Pyroscope) ||
+		m.global.DataDir != global.DataDir
+
+	// Build everything before stopping anything, so a bad config leaves the
+	// old watchers untouched.
+	built := make(map[string]*Watcher)
+	secrets := make(map[string][32]byte, len(servers))
+	for _, server := range servers {
+		hash, err := secretsHash(server)
+		if err != nil {
+			return err
+		}
+		secrets[server.Name] = hash
+
+		existing, ok := m.running[server.Name]
+		if ok && !globalChanged && reflect.DeepEqual(existing.opts, server) && existing.secrets == hash {
+			continue
+		}
+
+		watcher, err := New(global, server, m.logger.With().Str("service", "watcher").Logger())
+		if err != nil {
+			return fmt.Errorf("new watcher %q: %w", server.Name, err)
+		}
+		if m.otlp != nil {
+			watcher.WithOTLP(m.otlp)
+		}
+		for _, consumer := range m.historyConsumers {
+			watcher.WithHistoryConsumer(consumer)
+		}
+		built[server.Name] = watcher
+	}
+
+	// Replaced watchers are stopped before their replacement starts, so two
+	// watchers never share the rate limits or the state of a server.
+	replaced := make(map[string]<-chan struct{})
+	for name, rw := range m.running {
+		_, rebuilt := built[name]
+		if seen[name] && !rebuilt {
+			continue
+		}
+		rw.cancel()
+		delete(m.running, name)
+		if rebuilt {
+			replaced[name] = rw.done
+		}
+		m.logger.Info().Str("server", name).Msg("stopped watcher")
+	}
+
+	for _, server := range servers {
+		watcher, ok := built[server.Name]
+		if !ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(m.ctx)
+		done := make(chan struct{})
+		m.running[server.Name] = &runningWatcher{
+			opts:    server,
+			secrets: secrets[server.Name],
+			watcher: watcher,
+			cancel:  cancel,
+			done:    done,
+		}
+		previous := replaced[server.Name]
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			defer close(done)
+			if previous != nil {
+				select {
+				case <-previous:
+				case <-ctx.Done():
+					return
+				}
+				// The old watcher saved its rate limits as it stopped,
+				// after this one was built.
+				watcher.restoreRateLimits()
+			}
+			watcher.Watch(ctx)
+		}()
+		m.logger.Info().Str("server", server.Name).Msg("started watcher")
+	}
+
+	m.global = global
+	return nil
+}
+
+// Shutdown stops every watcher and waits for them to finish, or until ctx is
+// done. No watchers can be started after.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.shutdown = true
+	for name, rw := range m.running {
+		rw.cancel()
+		delete(m.running, name)
+	}
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("wait for watchers to stop: %w", ctx.Err())
+	}
+}
+
+// Watchers returns the running watchers sorted by name.
+func (m *Manager) Watchers() []*Watcher {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	watchers := make([]*Watcher, 0, len(m.running))
+	for _, rw := range m.running {
+		watchers = append(watchers, rw.watcher)
+	}
+	sort.Slice(watchers, func(i, j int) bool {
+		return watchers[i].Name < watchers[j].Name
+	})
+	return watchers
+}
+
+// Ready is true once every running watcher is ready.
+func (m *Manager) Ready() bool {
+	for _, w := range m.Watchers() {
+		if !w.Ready() {
+			return false
+		}
+	}
+	return true
+}
+
+// Targets returns the status of every target of every running watcher.
+func (m *Manager) Targets() []TargetStatus {
+	targets := make([]TargetStatus, 0)
+	for _, w := range m.Watchers() {
+		targets = append(targets, w.Targets()...)
+	}
+	return targets
+}
+
+// Describe sends no descriptors, which makes the manager an unchecked
+// collector. The set of metrics changes as watchers are added and removed.
+func (m *Manager) Describe(_ chan<- *prometheus.Desc) {}
+
+func (m *Manager) Collect(metrics chan<- prometheus.Metric) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, rw := range m.running {
+		rw.watcher.Collect(metrics)
+	}
+}
@@ -0,0 +1,151 @@
+package watch_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Emyrk/screeps-watcher/watch"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManagerApply(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	segment := 77
+	server := func(name string) watch.WatcherOptions {
+		return watch.WatcherOptions{
+			Name:     name,
+			URL:      srv.URL,
+			Username: "user",
+			Token:    "token",
+			MemorySegments: []watch.MemoryTargets{
+				{Shard: "shard0", Metrics: &segment},
+			},
+		}
+	}
+
+	m := watch.NewManager(ctx, zerolog.Nop())
+	err := m.Apply(watch.WatchConfig{}, []watch.WatcherOptions{server("a"), server("b")})
+	require.NoError(t, err)
+	before := m.Watchers()
+	require.Len(t, before, 2)
+
+	// Unchanged "a" is kept, changed "b" is rebuilt, new "c" is added.
+	changed := server("b")
+	changed.Username = "other"
+	err = m.Apply(watch.WatchConfig{}, []watch.WatcherOptions{server("a"), changed, server("c")})
+	require.NoError(t, err)
+	after := m.Watchers()
+	require.Len(t, after, 3)
+	require.Same(t, before[0], after[0])
+	require.NotSame(t, before[1], after[1])
+	require.Equal(t, "other", after[1].Username)
+
+	// A bad config is rejected and the previous watchers keep running.
+	err = m.Apply(watch.WatchConfig{}, []watch.WatcherOptions{server("a"), {Name: "bad"}})
+	require.Error(t, err)
+	require.Equal(t, after, m.Watchers())
+
+	err = m.Apply(watch.WatchConfig{}, []watch.WatcherOptions{server("a"), server("a")})
+	require.ErrorContains(t, err, "duplicate")
+
+	// Removing a server stops it.
+	err = m.Apply(watch.WatchConfig{}, []watch.WatcherOptions{server("c")})
+	require.NoError(t, err)
+	require.Len(t, m.Watchers(), 1)
+	require.Equal(t, "c", m.Watchers()[0].Name)
+}
+
+func TestManagerRotateSecret(t *testing.T) {
+	var mu sync.Mutex
+	var tokens []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tokens = append(tokens, r.Header.Get("X-Token"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+	seen := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(tokens)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("old\n"), 0o600))
+	server := watch.WatcherOptions{
+		Name:              "a",
+		URL:               srv.URL,
+		Username:          "user",
+		TokenFile:         tokenFile,
+		WebsocketChannels: []string{"cpu"},
+	}
+
+	m := watch.NewManager(ctx, zerolog.Nop())
+	require.NoError(t, m.Apply(watch.WatchConfig{}, []watch.WatcherOptions{server}))
+	require.Eventually(t, func() bool {
+		return slices.Contains(seen(), "old")
+	}, time.Second*5, time.Millisecond*10)
+	before := m.Watchers()
+
+	// The options are the same, but the file they point to is not.
+	require.NoError(t, os.WriteFile(tokenFile, []byte("new\n"), 0o600))
+	require.NoError(t, m.Apply(watch.WatchConfig{}, []watch.WatcherOptions{server}))
+	require.NotSame(t, before[0], m.Watchers()[0])
+	require.Eventually(t, func() bool {
+		return slices.Contains(seen(), "new")
+	}, time.Second*5, time.Millisecond*10)
+
+	// The old watcher stopped before the new one started.
+	got := seen()
+	first := slices.Index(got, "new")
+	require.NotContains(t, got[first:], "old")
+
+	// Nothing changed, so nothing is rebuilt.
+	after := m.Watchers()
+	require.NoError(t, m.Apply(watch.WatchConfig{}, []watch.WatcherOptions{server}))
+	require.Same(t, after[0], m.Watchers()[0])
+}
+
+func TestManagerShutdown(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+
+	segment := 77
+	m := watch.NewManager(context.Background(), zerolog.Nop())
+	err := m.Apply(watch.WatchConfig{}, []watch.WatcherOptions{{
+		Name:           "a",
+		URL:            srv.URL,
+		Token:          "token",
+		MemorySegments: []watch.MemoryTargets{{Shard: "shard0", Metrics: &segment}},
+	}})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	require.NoError(t, m.Shutdown(ctx))
+	require.Empty(t, m.Watchers())
+
+	err = m.Apply(watch.WatchConfig{}, nil)
+	require.ErrorContains(t, err, "shut down")
+}
@@ -4,6 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -15,6 +19,11 @@ import (
 
 var _ prometheus.Collector = (*Collector)(nil)
 
+// maxHistorySamples is how many history samples are kept for consumers that
+// have not read them yet. The oldest are dropped first. No samples are kept
+// until a consumer is added with WithHistoryConsumer.
+const maxHistorySamples = 50000
+
 type Collector struct {
 	logger      zerolog.Logger
 	namespace   string
@@ -22,21 +31,73 @@ type Collector struct {
 
 	metricCount prometheus.Gauge
 	segmentSize *prometheus.GaugeVec
+	keyErrors   *prometheus.CounterVec
+	// sanitized counts series that were changed or dropped to be exported.
+	sanitized *prometheus.CounterVec
+	// issues are the series issues of the last segment, so each is only
+	// logged when it first shows up.
+	issues      map[seriesIssue]struct{}
 	lastUpdated prometheus.Gauge
 	metrics     atomic.Pointer[map[string][]prometheusMetric]
 	now         func() time.Time
 
-	profilePusher *profiling.PyroscopePusher
+	// segmentTick is the tick the bot wrote the segment in, -1 if unknown.
+	segmentTick      atomic.Int64
+	segmentTickGauge prometheus.Gauge
+	// gameTick is the current tick of the shard, -1 if unknown.
+	gameTick        atomic.Int64
+	segmentAgeGauge prometheus.Gauge
+	// staleAfterTicks hides the segment metrics once the segment is this
+	// many ticks old. 0 never hides them.
+	staleAfterTicks int64
+	limits          Limits
+	relabelRules    []relabelRule
+	valueOptions    ValueOptions
+	// format is the format of the metrics segment, FormatAuto if empty.
+	format string
+	// limited counts series removed to fit the limits.
+	limited *prometheus.CounterVec
+	// limitEvents are those of the last segment, so each is only logged
+	// when it first shows up.
+	limitEvents map[limitEvent]struct{}
+
+	// historyMu guards the history samples not yet read by every consumer.
+	historyMu sync.Mutex
+	// historyTick is the newest tick of the history that was ingested, -1 if
+	// none was.
+	historyTick int64
+	history     []HistorySample
+	// historyStart is the sequence number of history[0]. Cursors are the
+	// sequence number of the next sample each consumer reads.
+	historyStart   uint64
+	historyCursors map[string]uint64
+	latestHistory  atomic.Pointer[historyEntry]
+
+	// metaMu guards the metadata of metrics, kept across segments because
+	// the bot only writes it now and then.
+	metaMu sync.RWMutex
+	meta   map[string]metricMeta
+
+	// ingestMu guards the parser and descriptors, which are reused across
+	// segments.
+	ingestMu sync.Mutex
+	parser   *parser
+	descs    map[string]*prometheus.Desc
+	// built are the metrics Collect sends, made once per segment.
+	built atomic.Pointer[[]prometheus.Metric]
+
+	profilePusher profiling.Pusher
 }
 
 // New
 // labels are the label constants on all metrics.
 func New(logger zerolog.Logger, namespace string, labels prometheus.Labels) *Collector {
-	return &Collector{
+	c := &Collector{
 		logger:      logger,
 		namespace:   namespace,
 		constLabels: labels,
 		now:         time.Now,
+		parser:      newParser(),
 		segmentSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Namespace:   namespace,
 			Subsystem:   "watcher",
@@ -44,6 +105,27 @@ func New(logger zerolog.Logger, namespace string, labels prometheus.Labels) *Col
 			Help:        "Size of the memory segment in bytes.",
 			ConstLabels: labels,
 		}, []string{"type"}),
+		keyErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "watcher",
+			Name:        "key_errors_total",
+			Help:        "Keys of the memory segment that could not be parsed and were skipped.",
+			ConstLabels: labels,
+		}, []string{"type"}),
+		sanitized: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "watcher",
+			Name:        "sanitized_series_total",
+			Help:        "Series of the memory segment that were renamed, filled with missing labels or dropped to be exported.",
+			ConstLabels: labels,
+		}, []string{"action", "reason"}),
+		limited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "watcher",
+			Name:        "limited_series_total",
+			Help:        "Series of the memory segment removed by truncating or aggregating to fit the series limits.",
+			ConstLabels: labels,
+		}, []string{"action", "metric"}),
 		lastUpdated: prometheus.NewGauge(prometheus.GaugeOpts{
 			Namespace:   namespace,
 			Subsystem:   "watcher",
@@ -58,22 +140,102 @@ func New(logger zerolog.Logger, namespace string, labels prometheus.Labels) *Col
 			Help:        "Number of metrics in the memory segment.",
 			ConstLabels: labels,
 		}),
+		segmentTickGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "watcher",
+			Name:        "segment_tick",
+			Help:        "Game tick the memory segment was written in.",
+			ConstLabels: labels,
+		}),
+		segmentAgeGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "watcher",
+			Name:        "segment_age_ticks",
+			Help:        "Ticks since the memory segment was written.",
+			ConstLabels: labels,
+		}),
 	}
+	c.segmentTick.Store(-1)
+	c.gameTick.Store(-1)
+	c.historyTick = -1
+	c.historyCursors = make(map[string]uint64)
+	c.meta = make(map[string]metricMeta)
+	c.issues = make(map[seriesIssue]struct{})
+	c.limitEvents = make(map[limitEvent]struct{})
+	return c
 }
 
 func (c *Collector) SupportsProfiling() bool {
 	return c.profilePusher != nil
 }
 
-func (c *Collector) WithPusher(pusher *profiling.PyroscopePusher) *Collector {
+func (c *Collector) WithPusher(pusher profiling.Pusher) *Collector {
 	c.profilePusher = pusher
 	return c
 }
 
+// WithHistoryConsumer keeps the history samples of later segments until the
+// consumer reads them with History.
+func (c *Collector) WithHistoryConsumer(consumer string) *Collector {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+	if _, ok := c.historyCursors[consumer]; !ok {
+		c.historyCursors[consumer] = c.historyStart + uint64(len(c.history))
+	}
+	return c
+}
+
+// WithStaleAfter stops exposing the segment metrics once the segment has not
+// been written for this many ticks. The game tick has to be set with
+// SetGameTick for this to work.
+func (c *Collector) WithStaleAfter(ticks int64) *Collector {
+	c.staleAfterTicks = ticks
+	return c
+}
+
+// WithRelabelConfigs applies the rules to the series of every segment, after
+// it is parsed. Rules should be validated first, invalid rules are logged and
+// skipped.
+func (c *Collector) WithRelabelConfigs(configs []RelabelConfig) *Collector {
+	c.relabelRules = c.relabelRules[:0]
+	for i, cfg := range configs {
+		rule, err := cfg.compile()
+		if err != nil {
+			c.logger.Error().Err(err).Int("rule", i).Msg("skipping invalid relabel rule")
+			continue
+		}
+		c.relabelRules = append(c.relabelRules, rule)
+	}
+	return c
+}
+
+// WithValueOptions chooses how arrays, booleans and strings are read.
+func (c *Collector) WithValueOptions(opts ValueOptions) *Collector {
+	c.valueOptions = opts
+	return c
+}
+
+// WithFormat sets the format of the metrics segment, one of Formats.
+func (c *Collector) WithFormat(format string) *Collector {
+	c.format = format
+	return c
+}
+
+// WithLimits caps the series of the segment.
+func (c *Collector) WithLimits(limits Limits) *Collector {
+	c.limits = limits
+	return c
+}
+
 func (c *Collector) SetNow(f func() time.Time) {
 	c.now = f
 }
 
+// SetGameTick sets the current game tick of the shard.
+func (c *Collector) SetGameTick(tick int64) {
+	c.gameTick.Store(tick)
+}
+
 func (c *Collector) Describe(descs chan<- *prometheus.Desc) {
 	prometheus.DescribeByCollect(c, descs)
 }
@@ -84,64 +246,478 @@ func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 		return
 	}
 
+	age, known := c.age()
+	if segmentTick := c.segmentTick.Load(); segmentTick >= 0 {
+		c.segmentTickGauge.Set(float64(segmentTick))
+		ch <- c.segmentTickGauge
+	}
+	if known {
+		c.segmentAgeGauge.Set(float64(age))
+		ch <- c.segmentAgeGauge
+	}
+
+	if !c.stale(age, known) {
+		if built := c.built.Load(); built != nil {
+			for _, pm := range *built {
+				ch <- pm
+			}
+		}
+	}
+
+	ch <- c.lastUpdated
+	c.segmentSize.Collect(ch)
+	c.keyErrors.Collect(ch)
+	c.sanitized.Collect(ch)
+	c.limited.Collect(ch)
+	ch <- c.metricCount
+}
+
+// build makes the metrics Collect sends from the last segment, so a scrape
+// does not create them again. Descriptors are reused from the last build.
+func (c *Collector) build() {
+	c.ingestMu.Lock()
+	defer c.ingestMu.Unlock()
+
+	metrics := c.metrics.Load()
+	if metrics == nil {
+		return
+	}
+	descs := make(map[string]*prometheus.Desc, len(c.descs))
+	built := make([]prometheus.Metric, 0, len(*metrics))
 	for k, v := range *metrics {
 		for _, metric := range v {
-			descLabels := make([]string, 0)
-			labelValues := make([]string, 0)
-			for lk, lv := range metric.Labels {
-				labelValues = append(labelValues, lv)
-				descLabels = append(descLabels, lk)
+			pm, ok := c.constMetric(k, metric, descs)
+			if !ok {
+				continue
+			}
+			if !metric.Timestamp.IsZero() {
+				pm = prometheus.NewMetricWithTimestamp(metric.Timestamp, pm)
 			}
+			built = append(built, pm)
+		}
+	}
 
-			// Truncating to get consistency for tests.
-			value := math.Trunc(metric.Value*10000) / 10000
-			pm, err := prometheus.NewConstMetric(
-				prometheus.NewDesc(
-					fmt.Sprintf("%s_%s", c.namespace, k),
-					"Metric from screeps memory segment.",
-					descLabels,
-					c.constLabels,
-				),
-				prometheus.GaugeValue,
-				value,
-				labelValues...,
-			)
-			if err != nil {
-				c.logger.Warn().
-					Str("metric_name", k).
-					Strs("labels", labelValues).
-					Err(err).
-					Msg("failed to create metric")
+	// The newest history sample of each series is exposed with the time
+	// it was written at. Series in the segment itself win.
+	if latest := c.latestHistory.Load(); latest != nil {
+		for k, v := range latest.metrics {
+			if _, ok := (*metrics)[k]; ok {
 				continue
 			}
-			ch <- pm
+			for _, metric := range v {
+				pm, ok := c.constMetric(k, metric, descs)
+				if ok {
+					built = append(built, prometheus.NewMetricWithTimestamp(latest.at, pm))
+				}
+			}
 		}
 	}
 
-	ch <- c.lastUpdated
-	c.segmentSize.Collect(ch)
-	ch <- c.metricCount
+	// Only the descriptors still in use are kept.
+	c.descs = descs
+	c.built.Store(&built)
+}
+
+// constMetric creates a metric, with descriptors from the last build added to
+// descs.
+func (c *Collector) constMetric(name string, metric prometheusMetric, descs map[string]*prometheus.Desc) (prometheus.Metric, bool) {
+	descLabels := make([]string, 0, len(metric.Labels))
+	for lk := range metric.Labels {
+		descLabels = append(descLabels, lk)
+	}
+	sort.Strings(descLabels)
+	labelValues := make([]string, 0, len(descLabels))
+	for _, lk := range descLabels {
+		labelValues = append(labelValues, metric.Labels[lk])
+	}
+
+	help := c.help(name)
+	key := strings.Join(append([]string{name, help}, descLabels...), "\xff")
+	desc, ok := descs[key]
+	if !ok {
+		desc, ok = c.descs[key]
+		if !ok {
+			desc = prometheus.NewDesc(
+				fmt.Sprintf("%s_%s", c.namespace, name),
+				help,
+				descLabels,
+				c.constLabels,
+			)
+		}
+		descs[key] = desc
+	}
+	var pm prometheus.Metric
+	var err error
+	switch metric.Type {
+	case typeHistogram:
+		pm, err = prometheus.NewConstHistogram(desc, metric.Count, metric.Sum, metric.Buckets, labelValues...)
+	case typeSummary:
+		pm, err = prometheus.NewConstSummary(desc, metric.Count, metric.Sum, metric.Quantiles, labelValues...)
+	case typeCounter:
+		pm, err = prometheus.NewConstMetric(desc, prometheus.CounterValue, metric.Value, labelValues...)
+	default:
+		// Truncating to get consistency for tests.
+		value := math.Trunc(metric.Value*10000) / 10000
+		pm, err = prometheus.NewConstMetric(desc, prometheus.GaugeValue, value, labelValues...)
+	}
+	if err != nil {
+		c.logger.Warn().
+			Str("metric_name", name).
+			Strs("labels", labelValues).
+			Err(err).
+			Msg("failed to create metric")
+		return nil, false
+	}
+	return pm, true
+}
+
+// help is the help text of a metric, with its unit if the bot declared one.
+func (c *Collector) help(name string) string {
+	c.metaMu.RLock()
+	m := c.meta[name]
+	c.metaMu.RUnlock()
+
+	help := m.Help
+	if help == "" {
+		help = "Metric from screeps memory segment."
+	}
+	if m.Unit != "" {
+		help = fmt.Sprintf("%s Unit: %s.", help, m.Unit)
+	}
+	return help
+}
+
+// age is how many ticks ago the segment was written, if both the segment tick
+// and the game tick are known.
+func (c *Collector) age() (int64, bool) {
+	segmentTick, gameTick := c.segmentTick.Load(), c.gameTick.Load()
+	if segmentTick < 0 || gameTick < 0 {
+		return 0, false
+	}
+	return gameTick - segmentTick, true
+}
+
+func (c *Collector) stale(age int64, known bool) bool {
+	return known && c.staleAfterTicks > 0 && age > c.staleAfterTicks
+}
+
+// Sample is a single metric of the segment, with its place in the segment
+// tree.
+type Sample struct {
+	// Path is the keys leading to the metric, without their labels.
+	Path []string
+	// Labels include the constant labels of the collector.
+	Labels map[string]string
+	Value  float64
+}
+
+// Samples returns the metrics of the last segment, for exporters that keep
+// the tree structure of the segment.
+func (c *Collector) Samples() []Sample {
+	metrics := c.metrics.Load()
+	if metrics == nil || c.stale(c.age()) {
+		return nil
+	}
+
+	samples := make([]Sample, 0)
+	for _, v := range *metrics {
+		for _, metric := range v {
+			for _, value := range metric.flatten() {
+				path := slices.Clone(metric.Path)
+				if len(path) > 0 {
+					path[len(path)-1] += value.Suffix
+				}
+				samples = append(samples, Sample{
+					Path:   path,
+					Labels: c.flatLabels(metric, value),
+					Value:  value.Value,
+				})
+			}
+		}
+	}
+	return samples
+}
+
+// labels are the labels of a metric, including the constant labels.
+func (c *Collector) labels(metric prometheusMetric) map[string]string {
+	labels := make(map[string]string, len(c.constLabels)+len(metric.Labels))
+	for lk, lv := range c.constLabels {
+		labels[lk] = lv
+	}
+	for lk, lv := range metric.Labels {
+		labels[lk] = lv
+	}
+	return labels
+}
+
+// flatLabels are the labels of a single value of a metric.
+func (c *Collector) flatLabels(metric prometheusMetric, value flatValue) map[string]string {
+	labels := c.labels(metric)
+	for lk, lv := range value.Labels {
+		labels[lk] = lv
+	}
+	return labels
+}
+
+// HistorySample is a metric from the history ring buffer of the segment.
+type HistorySample struct {
+	// Name includes the namespace.
+	Name string
+	// Labels include the constant labels of the collector.
+	Labels map[string]string
+	Value  float64
+	Tick   int64
+	Time   time.Time
+}
+
+// History returns the history samples the consumer has not read yet, oldest
+// first. Each consumer, like a remote write endpoint, reads every sample once.
+func (c *Collector) History(consumer string) []HistorySample {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	cursor := max(c.historyCursors[consumer], c.historyStart)
+	samples := slices.Clone(c.history[cursor-c.historyStart:])
+	c.historyCursors[consumer] = c.historyStart + uint64(len(c.history))
+
+	// Drop what every consumer has read.
+	read := c.historyCursors[consumer]
+	for _, cursor := range c.historyCursors {
+		read = min(read, cursor)
+	}
+	if read > c.historyStart {
+		c.history = c.history[read-c.historyStart:]
+		c.historyStart = read
+	}
+	return samples
+}
+
+// DiscardHistory drops the history that has not been read, while still
+// skipping its ticks in later segments. Used for history that was already
+// read before a restart.
+func (c *Collector) DiscardHistory() {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+	c.historyStart += uint64(len(c.history))
+	c.history = nil
+}
+
+// ingestHistory keeps the history entries newer than any seen before.
+func (c *Collector) ingestHistory(seg segment) {
+	if len(seg.history) == 0 {
+		return
+	}
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	// Private servers can be reset back to tick 0.
+	if seg.tick >= 0 && seg.tick < c.historyTick {
+		c.historyTick = -1
+	}
+	for _, entry := range seg.history {
+		if entry.tick <= c.historyTick {
+			continue
+		}
+		c.historyTick = entry.tick
+		if len(c.historyCursors) == 0 {
+			// Nothing reads the history, only its ticks are tracked.
+			continue
+		}
+		for name, metrics := range entry.metrics {
+			for _, metric := range metrics {
+				for _, value := range metric.flatten() {
+					c.history = append(c.history, HistorySample{
+						Name:   fmt.Sprintf("%s_%s%s", c.namespace, name, value.Suffix),
+						Labels: c.flatLabels(metric, value),
+						Value:  value.Value,
+						Tick:   entry.tick,
+						Time:   entry.at,
+					})
+				}
+			}
+		}
+	}
+	if over := len(c.history) - maxHistorySamples; over > 0 {
+		c.history = c.history[over:]
+		c.historyStart += uint64(over)
+	}
+
+	latest := seg.history[len(seg.history)-1]
+	c.latestHistory.Store(&latest)
+}
+
+// sanitize makes the metrics of the segment and its history valid to export.
+// This happens once per segment, instead of failing on every scrape.
+func (c *Collector) sanitize(seg *segment) {
+	var issues []seriesIssue
+	var found []seriesIssue
+	seg.metrics, found = sanitize(seg.metrics, c.constLabels)
+	issues = append(issues, found...)
+	for i := range seg.history {
+		seg.history[i].metrics, found = sanitize(seg.history[i].metrics, c.constLabels)
+		issues = append(issues, found...)
+	}
+
+	meta := make(map[string]metricMeta, len(seg.meta))
+	for name, m := range seg.meta {
+		meta[sanitizeName(name)] = m
+	}
+	seg.meta = meta
+
+	current := make(map[seriesIssue]struct{}, len(issues))
+	for _, issue := range issues {
+		c.sanitized.WithLabelValues(issue.Action, issue.Reason).Inc()
+		if _, ok := c.issues[issue]; !ok {
+			c.logger.Warn().Str("metric_name", issue.Name).Str("action", issue.Action).Str("reason", issue.Reason).Msg("sanitized segment series")
+		}
+		current[issue] = struct{}{}
+	}
+	c.issues = current
+}
+
+// limit applies the series limits to the segment and its history.
+func (c *Collector) limit(seg *segment) error {
+	events, err := c.limits.limit(seg.metrics)
+	if err != nil {
+		return err
+	}
+	for _, entry := range seg.history {
+		found, err := c.limits.limit(entry.metrics)
+		if err != nil {
+			return fmt.Errorf("history tick %d: %w", entry.tick, err)
+		}
+		events = append(events, found...)
+	}
+
+	current := make(map[limitEvent]struct{}, len(events))
+	for _, e := range events {
+		c.limited.WithLabelValues(e.Action, e.Name).Add(float64(e.Removed))
+		if _, ok := c.limitEvents[e]; !ok {
+			c.logger.Warn().
+				Str("metric_name", e.Name).
+				Str("action", e.Action).
+				Str("label", e.Label).
+				Int("removed", e.Removed).
+				Msg("metric over the series limit")
+		}
+		current[e] = struct{}{}
+	}
+	c.limitEvents = current
+	return nil
+}
+
+// storeMeta remembers the metadata of a segment. Metrics the segment has no
+// metadata for keep what an earlier segment declared.
+func (c *Collector) storeMeta(meta map[string]metricMeta) {
+	if len(meta) == 0 {
+		return
+	}
+	c.metaMu.Lock()
+	defer c.metaMu.Unlock()
+	for name, m := range meta {
+		c.meta[name] = m
+	}
+}
+
+// Meta returns the remembered metric metadata, in the format of the
+// metadata section of the segment. Nil if there is none.
+func (c *Collector) Meta() json.RawMessage {
+	c.metaMu.RLock()
+	defer c.metaMu.RUnlock()
+	if len(c.meta) == 0 {
+		return nil
+	}
+
+	obj := make(map[string]map[string]string, len(c.meta))
+	for name, m := range c.meta {
+		fields := make(map[string]string)
+		if m.Help != "" {
+			fields["help"] = m.Help
+		}
+		if m.Unit != "" {
+			fields["unit"] = m.Unit
+		}
+		obj[name] = fields
+	}
+	data, _ := json.Marshal(obj)
+	return data
+}
+
+// SetMeta sets metric metadata, like that returned by Meta before a restart.
+func (c *Collector) SetMeta(data json.RawMessage) error {
+	var v any
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return fmt.Errorf("unmarshal: %w", err)
+	}
+	meta, err := meta(v)
+	if err != nil {
+		return err
+	}
+	c.storeMeta(meta)
+	c.build()
+	return nil
 }
 
 func (c *Collector) SetMetricMemory(memory json.RawMessage) (int, error) {
+	return c.SetMetricMemoryAt(memory, c.now())
+}
+
+// SetMetricMemoryAt is SetMetricMemory for a segment read at an earlier time,
+// like one restored from disk.
+func (c *Collector) SetMetricMemoryAt(memory json.RawMessage, at time.Time) (int, error) {
 	c.segmentSize.WithLabelValues(fmt.Sprintf("metrics")).Set(float64(len(memory)))
 
-	metrics, err := memoryMetrics(memory)
+	seg, err := c.parse(memory)
 	if err != nil {
 		return 0, fmt.Errorf("read memory metrics: %w", err)
 	}
 
+	for _, keyErr := range seg.keyErrors {
+		c.logger.Warn().Err(keyErr).Msg("skipped segment key")
+		c.keyErrors.WithLabelValues("metrics").Inc()
+	}
+
+	seg.metrics = relabel(c.relabelRules, seg.metrics)
+	for i := range seg.history {
+		seg.history[i].metrics = relabel(c.relabelRules, seg.history[i].metrics)
+	}
+	c.sanitize(&seg)
+	err = c.limit(&seg)
+	if err != nil {
+		return 0, fmt.Errorf("series limit: %w", err)
+	}
+
 	count := 0
-	for _, v := range metrics {
+	for _, v := range seg.metrics {
 		count += len(v)
 	}
 
 	c.metricCount.Set(float64(count))
-	c.lastUpdated.Set(float64(c.now().Unix()))
-	c.metrics.Store(&metrics)
+	c.lastUpdated.Set(float64(at.Unix()))
+	c.segmentTick.Store(seg.tick)
+	c.storeMeta(seg.meta)
+	c.metrics.Store(&seg.metrics)
+	c.ingestHistory(seg)
+	c.build()
 	return count, nil
 }
 
+// parse reads a metrics segment in the format of the collector.
+func (c *Collector) parse(memory []byte) (segment, error) {
+	format := c.format
+	if format == "" || format == FormatAuto {
+		format = detectFormat(memory)
+	}
+	if format != FormatJSON {
+		return textMetrics(memory, format)
+	}
+
+	c.ingestMu.Lock()
+	defer c.ingestMu.Unlock()
+	return c.parser.memoryMetrics(memory, c.valueOptions)
+}
+
 func (c *Collector) SetProfileMemory(name string, memory json.RawMessage) (int, error) {
 	c.segmentSize.WithLabelValues(fmt.Sprintf("profile")).Set(float64(len(memory)))
 
@@ -0,0 +1,172 @@
+package memcollector
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// keyLabel is a label declared in a segment key.
+type keyLabel struct {
+	Name  string
+	Value string
+}
+
+// keyError is a key of the segment that could not be parsed. The key and
+// everything under it are skipped.
+type keyError struct {
+	// Path is the path of the parent of the key, without labels.
+	Path []string
+	Key  string
+	Err  error
+}
+
+func (e keyError) Error() string {
+	return fmt.Sprintf("key %q: %s", strings.Join(slices.Concat(e.Path, []string{e.Key}), "."), e.Err)
+}
+
+// parseKey splits a segment key into its name and labels. Labels go in
+// braces after the name, like `intents{intent=harvest,room="E1S1"}`. Quoted
+// values can have any character, with the escapes of JSON strings. Unquoted
+// values end at the next comma or brace.
+func parseKey(key string) (string, []keyLabel, error) {
+	var name strings.Builder
+	var labels []keyLabel
+	for i := 0; i < len(key); {
+		switch key[i] {
+		case '{':
+			group, n, err := parseLabels(key[i+1:])
+			if err != nil {
+				return "", nil, err
+			}
+			labels = append(labels, group...)
+			i += n + 1
+		case '}':
+			return "", nil, fmt.Errorf("unexpected } at %d", i)
+		default:
+			name.WriteByte(key[i])
+			i++
+		}
+	}
+
+	for i := range labels {
+		for _, prev := range labels[:i] {
+			if prev.Name == labels[i].Name {
+				return "", nil, fmt.Errorf("duplicate label %q", labels[i].Name)
+			}
+		}
+	}
+	return name.String(), labels, nil
+}
+
+// parseLabels parses the labels of a brace group, starting after the
+// opening brace. It returns how many bytes it read, including the closing
+// brace.
+func parseLabels(s string) ([]keyLabel, int, error) {
+	var labels []keyLabel
+	i := 0
+	for {
+		i = skipSpaces(s, i)
+		if i < len(s) && s[i] == '}' {
+			return labels, i + 1, nil
+		}
+
+		start := i
+		for i < len(s) && !strings.ContainsRune("=,{}\"", rune(s[i])) {
+			i++
+		}
+		name := strings.TrimSpace(s[start:i])
+		if i >= len(s) || s[i] != '=' {
+			return nil, 0, fmt.Errorf("label %q has no value", name)
+		}
+		if name == "" {
+			return nil, 0, fmt.Errorf("label with no name")
+		}
+		i = skipSpaces(s, i+1)
+
+		var value string
+		var err error
+		if i < len(s) && s[i] == '"' {
+			value, i, err = parseQuoted(s, i+1)
+			if err != nil {
+				return nil, 0, fmt.Errorf("label %q: %w", name, err)
+			}
+		} else {
+			start := i
+			for i < len(s) && !strings.ContainsRune(",{}", rune(s[i])) {
+				if s[i] == '=' || s[i] == '"' {
+					return nil, 0, fmt.Errorf("label %q: unquoted value has %q, quote the value", name, s[i])
+				}
+				i++
+			}
+			value = strings.TrimSpace(s[start:i])
+		}
+		labels = append(labels, keyLabel{Name: name, Value: value})
+
+		i = skipSpaces(s, i)
+		switch {
+		case i >= len(s):
+			return nil, 0, fmt.Errorf("missing }")
+		case s[i] == ',':
+			i++
+		case s[i] == '}':
+			return labels, i + 1, nil
+		default:
+			return nil, 0, fmt.Errorf("label %q: unexpected %q after value", name, s[i])
+		}
+	}
+}
+
+// parseQuoted reads a quoted value starting after the opening quote, and
+// returns the index after the closing quote.
+func parseQuoted(s string, i int) (string, int, error) {
+	var value strings.Builder
+	for ; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return value.String(), i + 1, nil
+		case '\\':
+			i++
+			if i >= len(s) {
+				return "", 0, fmt.Errorf("unterminated escape")
+			}
+			switch s[i] {
+			case '"', '\\', '/':
+				value.WriteByte(s[i])
+			case 'n':
+				value.WriteByte('\n')
+			case 'r':
+				value.WriteByte('\r')
+			case 't':
+				value.WriteByte('\t')
+			case 'b':
+				value.WriteByte('\b')
+			case 'f':
+				value.WriteByte('\f')
+			case 'u':
+				if i+4 >= len(s) {
+					return "", 0, fmt.Errorf("short \\u escape")
+				}
+				r, err := strconv.ParseUint(s[i+1:i+5], 16, 16)
+				if err != nil {
+					return "", 0, fmt.Errorf("invalid \\u escape %q", s[i+1:i+5])
+				}
+				value.WriteRune(rune(r))
+				i += 4
+			default:
+				return "", 0, fmt.Errorf("unknown escape \\%c", s[i])
+			}
+		default:
+			value.WriteByte(s[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated quote")
+}
+
+func skipSpaces(s string, i int) int {
+	for i < len(s) && s[i] == ' ' {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,85 @@
+package memcollector_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Emyrk/screeps-watcher/watch/memcollector"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyLabels(t *testing.T) {
+	const keyError = `test_watcher_key_errors_total{type="metrics"} 1`
+	for _, tc := range []struct {
+		name string
+		key  string
+		// want is the series of the key, empty if the key is skipped.
+		want string
+	}{
+		{name: "no labels", key: `cpu`, want: `test_cpu 1`},
+		{name: "unquoted", key: `cpu{room=E1S1,creep=a}`, want: `test_cpu{creep="a",room="E1S1"} 1`},
+		{name: "spaces", key: `cpu{ room = E1S1 , creep=a }`, want: `test_cpu{creep="a",room="E1S1"} 1`},
+		{name: "groups", key: `cpu{room=E1S1}{creep=a}`, want: `test_cpu{creep="a",room="E1S1"} 1`},
+		{name: "empty value", key: `cpu{room=}`, want: `test_cpu{room=""} 1`},
+		{name: "quoted delimiters", key: `cpu{room="E1,S1}{=",creep=a}`, want: `test_cpu{creep="a",room="E1,S1}{="} 1`},
+		{name: "escaped quote", key: `cpu{room="E1\"S1"}`, want: `test_cpu{room="E1\"S1"} 1`},
+		{name: "escaped backslash", key: `cpu{room="E1\\S1"}`, want: `test_cpu{room="E1\\S1"} 1`},
+		{name: "escaped unicode", key: `cpu{room="\u00451"}`, want: `test_cpu{room="E1"} 1`},
+
+		{name: "unterminated quote", key: `cpu{room="E1S1}`},
+		{name: "unterminated escape", key: `cpu{room="E1S1\`},
+		{name: "unknown escape", key: `cpu{room="E1\,S1"}`},
+		{name: "short unicode escape", key: `cpu{room="\u45"}`},
+		{name: "invalid unicode escape", key: `cpu{room="\uzzzz"}`},
+		{name: "unquoted equals", key: `cpu{room=E1=S1}`},
+		{name: "unquoted quote", key: `cpu{room=E1"S1}`},
+		{name: "after quote", key: `cpu{room="E1"S1}`},
+		{name: "empty label name", key: `cpu{=E1S1}`},
+		{name: "no value", key: `cpu{room}`},
+		{name: "missing brace", key: `cpu{room=E1S1`},
+		{name: "unexpected brace", key: `cpu}`},
+		{name: "duplicate label", key: `cpu{room=E1S1,room=E2S2}`},
+		{name: "duplicate label in groups", key: `cpu{room=E1S1}{room=E2S2}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := json.Marshal(tc.key)
+			require.NoError(t, err)
+			c := memcollector.New(zerolog.Nop(), "test", nil)
+			_, err = c.SetMetricMemory([]byte(`{` + string(key) + `: 1, "creeps": 2}`))
+			require.NoError(t, err)
+
+			reg := prometheus.NewRegistry()
+			reg.MustRegister(c)
+			dump := RegistryDump(reg)
+			// Other keys are never skipped.
+			require.Contains(t, dump, "test_creeps 2")
+			if tc.want == "" {
+				require.NotContains(t, dump, "test_cpu")
+				require.Contains(t, dump, keyError)
+				return
+			}
+			require.Contains(t, dump, tc.want)
+			require.NotContains(t, dump, "key_errors_total{")
+		})
+	}
+}
+
+func TestKeyErrorsCounted(t *testing.T) {
+	c := memcollector.New(zerolog.Nop(), "test", nil)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+
+	// A skipped key is counted on every scrape it is in, as are the keys
+	// nested in the history.
+	_, err := c.SetMetricMemory([]byte(`{"__tick": 2, "__history": [
+		{"__tick": 1, "__time": 1700000000000, "cpu{": 1}
+	], "cpu{room": 1, "bad}": {"nested": 1}, "creeps": 2}`))
+	require.NoError(t, err)
+	require.Contains(t, RegistryDump(reg), `test_watcher_key_errors_total{type="metrics"} 3`)
+
+	_, err = c.SetMetricMemory([]byte(`{"cpu{room": 1, "creeps": 2}`))
+	require.NoError(t, err)
+	require.Contains(t, RegistryDump(reg), `test_watcher_key_errors_total{type="metrics"} 4`)
+}
@@ -0,0 +1,211 @@
+package memcollector
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// What to do when a segment has more series than its limits allow.
+const (
+	// LimitReject fails the scrape, the last segment within the limits keeps
+	// being served.
+	LimitReject = "reject"
+	// LimitTruncate drops the series over the limit.
+	LimitTruncate = "truncate"
+	// LimitAggregate removes the label with the most values from the metrics
+	// over the limit, summing the series that become the same. Summaries lose
+	// their quantiles, and histograms have the bounds of every series. Metrics
+	// that are still over the limit are truncated.
+	LimitAggregate = "aggregate"
+)
+
+// LimitActions are the valid limit actions.
+var LimitActions = []string{LimitReject, LimitTruncate, LimitAggregate}
+
+// Limits cap the series a segment can have, so a bug in the bot cannot
+// export a series per creep. Histograms and summaries count as one series.
+type Limits struct {
+	// MaxSeries is the most series of the segment. 0 is no limit.
+	MaxSeries int `yaml:"max_series"`
+	// MaxSeriesPerMetric is the most series of a single metric name. 0 is no
+	// limit.
+	MaxSeriesPerMetric int `yaml:"max_series_per_metric"`
+	// Action is one of LimitActions, LimitReject if empty.
+	Action string `yaml:"action"`
+}
+
+// limitEvent is a metric that had series removed to fit the limits.
+type limitEvent struct {
+	Name   string
+	Action string
+	// Label is the label that was aggregated away, if any.
+	Label   string
+	Removed int
+}
+
+// limit applies the limits to the metrics of a segment.
+func (l Limits) limit(metrics map[string][]prometheusMetric) ([]limitEvent, error) {
+	if l.MaxSeries <= 0 && l.MaxSeriesPerMetric <= 0 {
+		return nil, nil
+	}
+
+	var events []limitEvent
+	names := make([]string, 0, len(metrics))
+	total := 0
+	for name, series := range metrics {
+		names = append(names, name)
+		total += len(series)
+	}
+	sort.Strings(names)
+
+	if l.MaxSeriesPerMetric > 0 {
+		for _, name := range names {
+			if len(metrics[name]) <= l.MaxSeriesPerMetric {
+				continue
+			}
+			if l.Action == LimitReject || l.Action == "" {
+				return nil, fmt.Errorf("metric %s has %d series, more than max_series_per_metric %d", name, len(metrics[name]), l.MaxSeriesPerMetric)
+			}
+			found := l.reduce(metrics, name, l.MaxSeriesPerMetric)
+			for _, e := range found {
+				total -= e.Removed
+			}
+			events = append(events, found...)
+		}
+	}
+
+	if l.MaxSeries > 0 && total > l.MaxSeries {
+		if l.Action == LimitReject || l.Action == "" {
+			return nil, fmt.Errorf("segment has %d series, more than max_series %d", total, l.MaxSeries)
+		}
+		// Take from the metric with the most series until within the limit.
+		for total > l.MaxSeries {
+			largest := names[0]
+			for _, name := range names {
+				if len(metrics[name]) > len(metrics[largest]) {
+					largest = name
+				}
+			}
+			// Cut the largest down to the next largest, or as far as needed.
+			next := 0
+			for _, name := range names {
+				if name != largest {
+					next = max(next, len(metrics[name]))
+				}
+			}
+			target := max(next, len(metrics[largest])-(total-l.MaxSeries))
+			if target == len(metrics[largest]) {
+				target--
+			}
+			found := l.reduce(metrics, largest, max(target, 0))
+			for _, e := range found {
+				total -= e.Removed
+			}
+			events = append(events, found...)
+		}
+	}
+	return events, nil
+}
+
+// reduce brings a metric down to at most n series.
+func (l Limits) reduce(metrics map[string][]prometheusMetric, name string, n int) []limitEvent {
+	var events []limitEvent
+	series := metrics[name]
+	if l.Action == LimitAggregate {
+		for len(series) > n {
+			label := widestLabel(series)
+			if label == "" {
+				break
+			}
+			before := len(series)
+			series = aggregate(series, label)
+			events = append(events, limitEvent{Name: name, Action: LimitAggregate, Label: label, Removed: before - len(series)})
+		}
+	}
+	if len(series) > n {
+		events = append(events, limitEvent{Name: name, Action: LimitTruncate, Removed: len(series) - n})
+		series = series[:n]
+	}
+	metrics[name] = series
+	return events
+}
+
+// widestLabel is the label with the most distinct values.
+func widestLabel(series []prometheusMetric) string {
+	values := make(map[string]map[string]struct{})
+	for _, m := range series {
+		for k, v := range m.Labels {
+			if values[k] == nil {
+				values[k] = make(map[string]struct{})
+			}
+			values[k][v] = struct{}{}
+		}
+	}
+	widest := ""
+	for k, v := range values {
+		if widest == "" || len(v) > len(values[widest]) || (len(v) == len(values[widest]) && k < widest) {
+			widest = k
+		}
+	}
+	return widest
+}
+
+// aggregate removes a label from the series, summing those that become the
+// same.
+func aggregate(series []prometheusMetric, label string) []prometheusMetric {
+	out := make([]prometheusMetric, 0, len(series))
+	index := make(map[string]int)
+	for _, m := range series {
+		labels := make(map[string]string, len(m.Labels))
+		for k, v := range m.Labels {
+			if k != label {
+				labels[k] = v
+			}
+		}
+		m.Labels = labels
+
+		sig := signature(labels)
+		i, ok := index[sig]
+		if !ok {
+			index[sig] = len(out)
+			if m.Type == typeSummary {
+				m.Quantiles = nil
+			}
+			out = append(out, m)
+			continue
+		}
+		sum := &out[i]
+		sum.Value += m.Value
+		sum.Count += m.Count
+		sum.Sum += m.Sum
+		if m.Buckets != nil {
+			// Series can have different bounds, so the sum has all of them.
+			buckets := make(map[float64]uint64, len(sum.Buckets)+len(m.Buckets))
+			for le := range sum.Buckets {
+				buckets[le] = cumulativeCount(sum.Buckets, le) + cumulativeCount(m.Buckets, le)
+			}
+			for le := range m.Buckets {
+				buckets[le] = cumulativeCount(sum.Buckets, le) + cumulativeCount(m.Buckets, le)
+			}
+			sum.Buckets = buckets
+		}
+	}
+	return out
+}
+
+// cumulativeCount is the count of the histogram at a bound it might not have.
+// The count of the next lower bound is carried forward, as it is the most
+// that is known to be at or below le.
+func cumulativeCount(buckets map[float64]uint64, le float64) uint64 {
+	if c, ok := buckets[le]; ok {
+		return c
+	}
+	lower, count := math.Inf(-1), uint64(0)
+	for bound, c := range buckets {
+		if bound < le && bound > lower {
+			lower, count = bound, c
+		}
+	}
+	return count
+}
@@ -3,102 +3,762 @@ package memcollector
 import (
 	"encoding/json"
 	"fmt"
+	"maps"
+	"math"
 	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/Emyrk/screeps-watcher/watch/memory"
 )
 
-func memoryMetrics(data json.RawMessage) (map[string][]prometheusMetric, error) {
-	stats := make(map[string]interface{})
-	err := json.Unmarshal(data, &stats)
+// segment is a parsed metrics segment.
+type segment struct {
+	metrics map[string][]prometheusMetric
+	// tick is the game tick the segment was written in if the bot wrote
+	// one, otherwise -1.
+	tick    int64
+	history []historyEntry
+	meta    map[string]metricMeta
+	// keyErrors are the keys that could not be parsed, in the segment and
+	// its history.
+	keyErrors []keyError
+}
+
+// metricMeta describes a metric, by its name without the namespace.
+type metricMeta struct {
+	Help string
+	Unit string
+}
+
+// historyEntry is the metrics of an earlier tick, from the ring buffer in the
+// segment.
+type historyEntry struct {
+	tick    int64
+	at      time.Time
+	metrics map[string][]prometheusMetric
+}
+
+// ValueOptions choose how values other than numbers and objects are read.
+type ValueOptions struct {
+	// Legacy exports arrays, booleans, strings and nulls as 0, and fails the
+	// segment if they are at the top level, like before they were supported.
+	Legacy bool `yaml:"legacy"`
+	// ArrayKeys are fields that identify the objects of an array. The first
+	// field an object has becomes a label of its series instead of the index.
+	ArrayKeys []string `yaml:"array_keys"`
+}
+
+// parser parses segments. It keeps what it parsed from the keys of earlier
+// segments, because a bot writes the same keys every time.
+type parser struct {
+	nodes []jsonNode
+	// strs interns keys and string values.
+	strs map[string]string
+	// keys are parsed keys by the raw key.
+	keys map[string]parsedKey
+	// names are metric names by their parent name and key name.
+	names map[[2]string]string
+}
+
+// maxCached is how many entries each cache of the parser holds before it is
+// cleared, so a bot writing ever new keys does not grow it forever.
+const maxCached = 1 << 16
+
+func newParser() *parser {
+	return &parser{
+		strs:  make(map[string]string),
+		keys:  make(map[string]parsedKey),
+		names: make(map[[2]string]string),
+	}
+}
+
+// parsedKey is a key split into its name and labels.
+type parsedKey struct {
+	name   string
+	labels []keyLabel
+	err    error
+	// part is the name as part of a metric name.
+	part string
+}
+
+// intern returns the bytes as a string, without allocating if they were seen
+// before.
+func (p *parser) intern(b []byte) string {
+	if s, ok := p.strs[string(b)]; ok {
+		return s
+	}
+	if len(p.strs) >= maxCached {
+		clear(p.strs)
+	}
+	s := string(b)
+	p.strs[s] = s
+	return s
+}
+
+func (p *parser) parseKey(key string) parsedKey {
+	if pk, ok := p.keys[key]; ok {
+		return pk
+	}
+	if len(p.keys) >= maxCached {
+		clear(p.keys)
+	}
+	name, labels, err := parseKey(key)
+	pk := parsedKey{name: name, labels: labels, err: err, part: strings.ReplaceAll(name, ".", "_")}
+	p.keys[key] = pk
+	return pk
+}
+
+// join makes the metric name of a key from the name of its parent. Repeated
+// underscores from nameless groups are collapsed, and the leading underscore
+// of top level keys is removed.
+func (p *parser) join(parent, part string) string {
+	if name, ok := p.names[[2]string{parent, part}]; ok {
+		return name
+	}
+	if len(p.names) >= maxCached {
+		clear(p.names)
+	}
+	name := cleanName(parent + "_" + part)
+	p.names[[2]string{parent, part}] = name
+	return name
+}
+
+// cleanName collapses repeated underscores and removes a leading one.
+func cleanName(name string) string {
+	if strings.Contains(name, "__") {
+		name = repeatedUnderscores.ReplaceAllString(name, "_")
+	}
+	return strings.TrimPrefix(name, "_")
+}
+
+// memoryMetrics parses the metrics in the segment, along with its history
+// sorted by tick.
+func (p *parser) memoryMetrics(data json.RawMessage, opts ValueOptions) (segment, error) {
+	doc, err := scanJSON(data, p.nodes)
+	p.nodes = doc.nodes
 	if err != nil {
-		return nil, fmt.Errorf("unmarshal: %w", err)
-	}
-
-	// Pull all the metrics from the memory segment.
-	metrics := make(map[string][]prometheusMetric)
-	for k, v := range stats {
-		switch v := v.(type) {
-		case map[string]interface{}:
-			next(metrics, k, v)
-		case float64:
-			// Top level metric. Annoying, but this is ok.
-			next(metrics, "", map[string]interface{}{k: v})
-		default:
-			// Log an error
-			return nil, fmt.Errorf("parse top level, unknown type: %T", v)
+		return segment{}, fmt.Errorf("unmarshal: %w", err)
+	}
+	if doc.nodes[0].kind != jsonObject {
+		return segment{}, fmt.Errorf("unmarshal: segment must be an object, found %s", doc.typeName(0))
+	}
+
+	seg := segment{tick: -1}
+	if i := doc.member(0, memory.TickKey); i >= 0 {
+		if doc.nodes[i].kind != jsonNumber {
+			return segment{}, fmt.Errorf("%s must be a number, found %s", memory.TickKey, doc.typeName(i))
+		}
+		t, err := doc.float(i)
+		if err != nil {
+			return segment{}, fmt.Errorf("%s: %w", memory.TickKey, err)
+		}
+		seg.tick = int64(t)
+	}
+
+	if i := doc.member(0, memory.HistoryKey); i >= 0 {
+		seg.history, seg.keyErrors, err = p.history(doc, i, opts)
+		if err != nil {
+			return segment{}, fmt.Errorf("parse %s: %w", memory.HistoryKey, err)
+		}
+	}
+
+	if i := doc.member(0, memory.MetaKey); i >= 0 {
+		v, err := doc.decode(i)
+		if err == nil {
+			seg.meta, err = meta(v)
+		}
+		if err != nil {
+			return segment{}, fmt.Errorf("parse %s: %w", memory.MetaKey, err)
+		}
+	}
+
+	var keyErrors []keyError
+	seg.metrics, keyErrors, err = p.parseMetrics(doc, 0, opts, memory.TickKey, memory.HistoryKey, memory.MetaKey)
+	if err != nil {
+		return segment{}, err
+	}
+	seg.keyErrors = append(seg.keyErrors, keyErrors...)
+	return seg, nil
+}
+
+// meta parses the metadata of metrics. Names can use dots like the segment
+// tree does, so "cpu.used" and "cpu_used" are the same metric.
+func meta(v any) (map[string]metricMeta, error) {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("must be an object, found %T", v)
+	}
+
+	metas := make(map[string]metricMeta, len(obj))
+	for name, v := range obj {
+		fields, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s must be an object, found %T", name, v)
+		}
+		var m metricMeta
+		for k, v := range fields {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s.%s must be a string, found %T", name, k, v)
+			}
+			switch k {
+			case "help":
+				m.Help = s
+			case "unit":
+				m.Unit = s
+			default:
+				return nil, fmt.Errorf("%s has unknown field %q, must be help or unit", name, k)
+			}
 		}
+		metas[strings.ReplaceAll(name, ".", "_")] = m
+	}
+	return metas, nil
+}
+
+// history parses the ring buffer of earlier ticks.
+func (p *parser) history(doc jsonDoc, list int, opts ValueOptions) ([]historyEntry, []keyError, error) {
+	if doc.nodes[list].kind != jsonArray {
+		return nil, nil, fmt.Errorf("must be a list, found %s", doc.typeName(list))
 	}
 
-	return metrics, nil
+	var entries []historyEntry
+	var errs []keyError
+	var err error
+	i := 0
+	doc.children(list, func(item int) bool {
+		if doc.nodes[item].kind != jsonObject {
+			err = fmt.Errorf("entry %d must be an object, found %s", i, doc.typeName(item))
+			return false
+		}
+		tick, ok := doc.memberFloat(item, memory.TickKey)
+		if !ok {
+			err = fmt.Errorf("entry %d must have a numeric %s", i, memory.TickKey)
+			return false
+		}
+		ms, ok := doc.memberFloat(item, memory.TimeKey)
+		if !ok {
+			err = fmt.Errorf("entry %d must have a numeric %s", i, memory.TimeKey)
+			return false
+		}
+
+		metrics, keyErrors, parseErr := p.parseMetrics(doc, item, opts, memory.TickKey, memory.TimeKey)
+		if parseErr != nil {
+			err = fmt.Errorf("entry %d: %w", i, parseErr)
+			return false
+		}
+		errs = append(errs, keyErrors...)
+		entries = append(entries, historyEntry{
+			tick:    int64(tick),
+			at:      time.UnixMilli(int64(ms)),
+			metrics: metrics,
+		})
+		i++
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].tick < entries[j].tick
+	})
+	return entries, errs, nil
+}
+
+// parseMetrics pulls all the metrics from an object of the segment, skipping
+// the reserved keys, along with the keys that could not be parsed.
+func (p *parser) parseMetrics(doc jsonDoc, obj int, opts ValueOptions, reserved ...string) (map[string][]prometheusMetric, []keyError, error) {
+	w := &walker{
+		doc:     doc,
+		p:       p,
+		metrics: make(map[string][]prometheusMetric),
+		opts:    opts,
+	}
+	skip := func(child int) bool {
+		return slices.Contains(reserved, w.key(child))
+	}
+
+	if opts.Legacy {
+		var err error
+		doc.children(obj, func(c int) bool {
+			switch doc.nodes[c].kind {
+			case jsonObject, jsonNumber:
+			default:
+				if skip(c) || w.key(c) == memory.TypeKey {
+					return true
+				}
+				// Log an error
+				err = fmt.Errorf("parse top level, unknown type: %s", doc.typeName(c))
+				return false
+			}
+			return true
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	typ, err := w.declaredType(obj, typeGauge)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = w.next("", map[string]string{}, nil, typ, obj, skip)
+	if err != nil {
+		return nil, nil, err
+	}
+	return w.metrics, w.errs, nil
+}
+
+// metricType is the type of a metric. A subtree of the segment declares its
+// type with memory.TypeKey, and everything under it has that type.
+type metricType string
+
+const (
+	typeGauge     metricType = "gauge"
+	typeCounter   metricType = "counter"
+	typeHistogram metricType = "histogram"
+	typeSummary   metricType = "summary"
+)
+
+// declaredType is the type the object declares, or the type of its parent.
+func (w *walker) declaredType(obj int, parent metricType) (metricType, error) {
+	i := w.doc.member(obj, memory.TypeKey)
+	if i < 0 {
+		return parent, nil
+	}
+	var v any = w.str(i)
+	if w.doc.nodes[i].kind != jsonString {
+		var err error
+		v, err = w.doc.decode(i)
+		if err != nil {
+			return "", err
+		}
+	}
+	switch typ := metricType(fmt.Sprint(v)); typ {
+	case typeGauge, typeCounter, typeHistogram, typeSummary:
+		return typ, nil
+	default:
+		return "", fmt.Errorf("unknown %s %q, must be gauge, counter, histogram or summary", memory.TypeKey, v)
+	}
 }
 
 type prometheusMetric struct {
 	Labels map[string]string
 	Value  float64
+	// Path is the keys leading to the metric in the segment, without their
+	// labels. Keys with dots are split into several components.
+	Path []string
+	Type metricType
+	// Histograms and summaries have a count and sum instead of a value.
+	Count uint64
+	Sum   float64
+	// Buckets are the cumulative counts of a histogram by upper bound.
+	Buckets map[float64]uint64
+	// Quantiles are the values of a summary by quantile.
+	Quantiles map[float64]float64
+	// Timestamp is when the value was observed, if the segment says.
+	Timestamp time.Time
+}
+
+// flatValue is a single value of a metric.
+type flatValue struct {
+	// Suffix is appended to the metric name, like "_sum".
+	Suffix string
+	// Labels are added to the labels of the metric, like "le".
+	Labels map[string]string
+	Value  float64
+}
+
+// flatten turns a metric into single values, the way the text format writes
+// histograms and summaries: a value per bucket or quantile, a sum and a count.
+func (m prometheusMetric) flatten() []flatValue {
+	switch m.Type {
+	case typeHistogram:
+		values := make([]flatValue, 0, len(m.Buckets)+3)
+		for _, le := range sortedKeys(m.Buckets) {
+			values = append(values, flatValue{Suffix: "_bucket", Labels: map[string]string{"le": formatFloat(le)}, Value: float64(m.Buckets[le])})
+		}
+		return append(values,
+			flatValue{Suffix: "_bucket", Labels: map[string]string{"le": "+Inf"}, Value: float64(m.Count)},
+			flatValue{Suffix: "_sum", Value: m.Sum},
+			flatValue{Suffix: "_count", Value: float64(m.Count)},
+		)
+	case typeSummary:
+		values := make([]flatValue, 0, len(m.Quantiles)+2)
+		for _, q := range sortedKeys(m.Quantiles) {
+			values = append(values, flatValue{Labels: map[string]string{"quantile": formatFloat(q)}, Value: m.Quantiles[q]})
+		}
+		return append(values,
+			flatValue{Suffix: "_sum", Value: m.Sum},
+			flatValue{Suffix: "_count", Value: float64(m.Count)},
+		)
+	default:
+		return []flatValue{{Value: m.Value}}
+	}
+}
+
+func sortedKeys[V any](m map[float64]V) []float64 {
+	keys := make([]float64, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Float64s(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// distribution parses a histogram or summary object. Histograms have
+// "buckets" of cumulative counts by upper bound, summaries have "quantiles"
+// of values by quantile, and both have a "sum" and a "count".
+func distribution(typ metricType, data map[string]interface{}) (prometheusMetric, error) {
+	m := prometheusMetric{Type: typ}
+	sum, ok := data["sum"].(float64)
+	if !ok {
+		return m, fmt.Errorf("%s must have a numeric sum", typ)
+	}
+	m.Sum = sum
+
+	key := "buckets"
+	if typ == typeSummary {
+		key = "quantiles"
+	}
+	values, ok := data[key].(map[string]interface{})
+	if !ok {
+		return m, fmt.Errorf("%s must have an object of %s", typ, key)
+	}
+
+	count, hasCount := data["count"].(float64)
+	m.Buckets = make(map[float64]uint64)
+	m.Quantiles = make(map[float64]float64)
+	for k, v := range values {
+		bound, err := strconv.ParseFloat(k, 64)
+		if err != nil {
+			return m, fmt.Errorf("%s %s key %q is not a number", typ, key, k)
+		}
+		value, ok := v.(float64)
+		if !ok {
+			return m, fmt.Errorf("%s %s %q must be a number, found %T", typ, key, k, v)
+		}
+		switch {
+		case typ == typeSummary:
+			m.Quantiles[bound] = value
+		case math.IsInf(bound, 1):
+			// The +Inf bucket is the count.
+			if !hasCount {
+				count, hasCount = value, true
+			}
+		default:
+			m.Buckets[bound] = uint64(value)
+		}
+	}
+	if !hasCount {
+		return m, fmt.Errorf("%s must have a numeric count", typ)
+	}
+	m.Count = uint64(count)
+	return m, nil
+}
+
+// treePath appends the components of a key name to the path of its parent.
+func treePath(parent []string, name string) []string {
+	path := slices.Clone(parent)
+	for _, part := range strings.Split(name, ".") {
+		if part != "" {
+			path = append(path, part)
+		}
+	}
+	return path
 }
 
-var labels, _ = regexp.Compile(`\{[^}]*\}`)
 var repeatedUnderscores, _ = regexp.Compile(`_+`)
 
+// walker walks the JSON data of a segment and collects its metrics.
+type walker struct {
+	doc     jsonDoc
+	p       *parser
+	metrics map[string][]prometheusMetric
+	// errs are the keys that could not be parsed.
+	errs []keyError
+	opts ValueOptions
+	// members is scratch space to find the duplicate keys of an object.
+	members map[string]int
+}
+
+// key is the key of an object member.
+func (w *walker) key(i int) string {
+	if !w.doc.nodes[i].keyEscaped {
+		return w.p.intern(w.doc.keyBytes(i))
+	}
+	n := w.doc.nodes[i]
+	key, err := unquote(w.doc.data[n.keyStart-1 : n.keyEnd+1])
+	if err != nil {
+		// The scanner checked the quotes, so only a broken escape gets here.
+		return string(w.doc.keyBytes(i))
+	}
+	return key
+}
+
+// str is the value of a string node.
+func (w *walker) str(i int) string {
+	n := w.doc.nodes[i]
+	if !n.escaped {
+		return w.p.intern(w.doc.data[n.start:n.end])
+	}
+	s, err := unquote(w.doc.raw(i))
+	if err != nil {
+		return string(w.doc.data[n.start:n.end])
+	}
+	return s
+}
+
 // next recursively walks the JSON data and extracts all the metrics.
-// One decision made is that the metric name will have all its labels at the
-// final recursion level. An alternative would be to parse them, and pass the
-// parsed labels down the recursion chain. That would be more efficient, but
-// this was easier to debug with all the data in one place.
-// And this scrape interval is infrequent, so the performance hit does
-// not matter.
-func next(src map[string][]prometheusMetric, parent string, data map[string]interface{}) {
-	for k, v := range data {
-		// Create the parent metric name with all their labels.
-		parent = strings.ReplaceAll(parent, ".", "_")
-		metricName := fmt.Sprintf("%s_%s", parent, k)
-		var value float64
-		switch v := v.(type) {
-		case map[string]interface{}:
-			next(src, metricName, v)
+// Labels are parsed from each key and passed down the recursion chain, so a
+// metric has the labels of every level above it. Keys that do not parse are
+// added to errs and skipped along with everything under them. Members skip
+// returns true for are ignored, skip can be nil.
+func (w *walker) next(parent string, parentLabels map[string]string, parentPath []string, typ metricType, obj int, skip func(child int) bool) error {
+	shadowed := w.shadowed(obj)
+	var err error
+	w.doc.children(obj, func(c int) bool {
+		if skip != nil && skip(c) {
+			return true
+		}
+		if slices.Contains(shadowed, c) {
+			return true
+		}
+		k := w.key(c)
+		if k == memory.TypeKey {
+			return true
+		}
+		pk := w.p.parseKey(k)
+		keyErr := pk.err
+		if keyErr == nil {
+			keyErr = checkDuplicates(parentLabels, pk.labels)
+		}
+		if keyErr != nil {
+			w.errs = append(w.errs, keyError{Path: parentPath, Key: k, Err: keyErr})
+			return true
+		}
+
+		// Create the metric name from the parent name.
+		metricName := w.p.join(parent, pk.part)
+		path := treePath(parentPath, pk.name)
+		labels := parentLabels
+		if len(pk.labels) > 0 {
+			labels = maps.Clone(parentLabels)
+			for _, l := range pk.labels {
+				labels[l.Name] = l.Value
+			}
+		}
+
+		err = w.value(c, k, metricName, labels, path, typ)
+		return err == nil
+	})
+	return err
+}
+
+// shadowed returns the members of an object with the same key as a later
+// member. The last duplicate wins, like it did when segments were decoded
+// into maps.
+func (w *walker) shadowed(obj int) []int {
+	if w.members == nil {
+		w.members = make(map[string]int)
+	}
+	clear(w.members)
+	count := 0
+	w.doc.children(obj, func(c int) bool {
+		w.members[w.key(c)] = c
+		count++
+		return true
+	})
+	if len(w.members) == count {
+		return nil
+	}
+
+	var shadowed []int
+	w.doc.children(obj, func(c int) bool {
+		if w.members[w.key(c)] != c {
+			shadowed = append(shadowed, c)
+		}
+		return true
+	})
+	return shadowed
+}
+
+// value extracts the metrics of the value of a key. Labels are shared by the
+// metrics, they must be copied before they are changed.
+func (w *walker) value(i int, key, metricName string, labels map[string]string, path []string, typ metricType) error {
+	metric := prometheusMetric{Type: typ}
+	switch w.doc.nodes[i].kind {
+	case jsonObject:
+		return w.object(i, key, metricName, labels, path, typ, nil)
+	case jsonNumber:
+		v, err := w.doc.float(i)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		metric.Value = v
+	case jsonTrue:
+		if !w.opts.Legacy {
+			metric.Value = 1
+		}
+	case jsonFalse:
+	case jsonString:
+		if !w.opts.Legacy {
+			return w.info(key, metricName, labels, path, w.str(i))
+		}
+	case jsonArray:
+		if !w.opts.Legacy {
+			return w.array(i, key, metricName, labels, path, typ)
+		}
+	case jsonNull:
+		if !w.opts.Legacy {
+			// Null is no value.
+			return nil
+		}
+	}
+	if metric.Type == typeHistogram || metric.Type == typeSummary {
+		// Only the distribution object itself can be one.
+		return fmt.Errorf("%s: %s values must be objects, found %s", key, metric.Type, w.doc.typeName(i))
+	}
+
+	metric.Labels = labels
+	metric.Path = path
+	w.add(metricName, metric)
+	return nil
+}
+
+// object extracts the metrics of an object, which is a distribution if it
+// declares itself one.
+func (w *walker) object(i int, key, metricName string, labels map[string]string, path []string, typ metricType, skip func(child int) bool) error {
+	childType, err := w.declaredType(i, typ)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	if childType != typeHistogram && childType != typeSummary {
+		return w.next(metricName, labels, path, childType, i, skip)
+	}
+
+	v, err := w.doc.decode(i)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	metric, err := distribution(childType, v.(map[string]interface{}))
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	metric.Labels = labels
+	metric.Path = path
+	w.add(metricName, metric)
+	return nil
+}
+
+// info exports a string as an info metric, with the string as the value of
+// a label named after the key.
+func (w *walker) info(key, metricName string, labels map[string]string, path []string, v string) error {
+	label := "value"
+	if len(path) > 0 {
+		label = path[len(path)-1]
+	}
+	if _, ok := labels[label]; ok {
+		w.errs = append(w.errs, keyError{Path: path[:max(len(path)-1, 0)], Key: key, Err: fmt.Errorf("label %q of the string is already set by a parent", label)})
+		return nil
+	}
+
+	infoLabels := maps.Clone(labels)
+	infoLabels[label] = v
+	w.add(cleanName(metricName+"_info"), prometheusMetric{
+		Type:   typeGauge,
+		Labels: infoLabels,
+		Value:  1,
+		Path:   slices.Concat(path[:max(len(path)-1, 0)], []string{label + "_info"}),
+	})
+	return nil
+}
+
+// array exports each item of an array with a label of its index, or of its
+// key field if it is an object with one.
+func (w *walker) array(list int, key, metricName string, labels map[string]string, path []string, typ metricType) error {
+	var err error
+	i := -1
+	w.doc.children(list, func(item int) bool {
+		i++
+		label, value := w.indexLabel(labels), strconv.Itoa(i)
+		field := -1
+		if w.doc.nodes[item].kind == jsonObject {
+			if f, name, fieldValue, ok := w.arrayKey(item); ok {
+				field, label, value = f, name, fieldValue
+			}
+		}
+		if _, ok := labels[label]; ok {
+			w.errs = append(w.errs, keyError{Path: path, Key: key, Err: fmt.Errorf("label %q of item %d is already set by a parent", label, i)})
+			return true
+		}
+
+		itemLabels := maps.Clone(labels)
+		itemLabels[label] = value
+		itemPath := slices.Concat(path, []string{value})
+		if field >= 0 {
+			// The key field is a label, not a metric.
+			err = w.object(item, key, metricName, itemLabels, itemPath, typ, func(child int) bool {
+				return child == field
+			})
+		} else {
+			err = w.value(item, key, metricName, itemLabels, itemPath, typ)
+		}
+		return err == nil
+	})
+	return err
+}
+
+// indexLabel is "index", or "index2" and so on for arrays in arrays.
+func (w *walker) indexLabel(labels map[string]string) string {
+	label := "index"
+	for n := 2; ; n++ {
+		if _, ok := labels[label]; !ok {
+			return label
+		}
+		label = fmt.Sprintf("index%d", n)
+	}
+}
+
+// arrayKey finds the first of the array keys the object has.
+func (w *walker) arrayKey(obj int) (int, string, string, bool) {
+	for _, field := range w.opts.ArrayKeys {
+		i := w.doc.member(obj, field)
+		if i < 0 {
 			continue
-		case int:
-			value = float64(v)
-		case int32:
-			value = float64(v)
-		case int64:
-			value = float64(v)
-		case float32:
-			value = float64(v)
-		case float64:
-			value = v
-		}
-		// Each metric level can have labels.
-		// So find all the labels and remove them from the metric name.
-		rawLabels := labels.FindAllString(metricName, -1)
-		// Remove the labels from the metric name.
-		metricName = labels.ReplaceAllString(metricName, "")
-
-		// handle extracted labels
-		labelList := make([]string, 0, len(rawLabels))
-		for _, labels := range rawLabels {
-			// Get it down to just the key=value pairs.
-			labels = strings.Trim(labels, "{}")
-			// Append key=value pairs to the list.
-			labelList = append(labelList, strings.Split(labels, ",")...)
-		}
-
-		labels := make(map[string]string)
-		for _, l := range labelList {
-			parts := strings.Split(l, "=")
-			if len(parts) != 2 {
-				continue
+		}
+		switch w.doc.nodes[i].kind {
+		case jsonString:
+			return i, field, w.str(i), true
+		case jsonNumber:
+			v, err := w.doc.float(i)
+			if err == nil {
+				return i, field, formatFloat(v), true
 			}
-			labels[parts[0]] = parts[1]
 		}
+	}
+	return -1, "", "", false
+}
 
-		// Clean up any repeated underscores from nameless groups.
-		metricName = repeatedUnderscores.ReplaceAllString(metricName, "_")
-		// This *can* happen for flat metrics.
-		metricName = strings.TrimPrefix(metricName, "_")
-		src[metricName] = append(src[metricName], prometheusMetric{
-			Labels: labels,
-			Value:  value,
-		})
+func (w *walker) add(metricName string, metric prometheusMetric) {
+	w.metrics[metricName] = append(w.metrics[metricName], metric)
+}
+
+// checkDuplicates returns an error if a key sets a label a parent already
+// set.
+func checkDuplicates(parent map[string]string, labels []keyLabel) error {
+	for _, l := range labels {
+		if _, ok := parent[l.Name]; ok {
+			return fmt.Errorf("label %q is already set by a parent", l.Name)
+		}
 	}
+	return nil
 }
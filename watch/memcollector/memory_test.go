@@ -11,6 +11,8 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -20,6 +22,7 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
 )
 
 func TestCollector(t *testing.T) {
@@ -54,12 +57,33 @@ func TestGoldenFiles(t *testing.T) {
 			memory := filepath.Join("testdata", dir.Name(), "memory.json")
 			prom := filepath.Join("testdata", dir.Name(), "prometheus.txt")
 			memoryJSON, err := os.ReadFile(memory)
+			if os.IsNotExist(err) {
+				// Segments in a text format.
+				memory = filepath.Join("testdata", dir.Name(), "memory.txt")
+				memoryJSON, err = os.ReadFile(memory)
+			}
 			require.NoError(t, err)
 
 			promData, err := os.ReadFile(prom)
 			require.NoError(t, err)
 
 			c := memcollector.New(logger, "test", prometheus.Labels{"test": "test"})
+			// Relabel rules are optional.
+			rules, err := os.ReadFile(filepath.Join("testdata", dir.Name(), "relabel.yaml"))
+			if err == nil {
+				var configs []memcollector.RelabelConfig
+				require.NoError(t, yaml.Unmarshal(rules, &configs))
+				for _, cfg := range configs {
+					require.NoError(t, cfg.Validate())
+				}
+				c.WithRelabelConfigs(configs)
+			}
+			values, err := os.ReadFile(filepath.Join("testdata", dir.Name(), "values.yaml"))
+			if err == nil {
+				var opts memcollector.ValueOptions
+				require.NoError(t, yaml.Unmarshal(values, &opts))
+				c.WithValueOptions(opts)
+			}
 			c.SetNow(func() time.Time {
 				return time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
 			})
@@ -89,6 +113,272 @@ func TestGoldenFiles(t *testing.T) {
 
 }
 
+func TestStaleSegment(t *testing.T) {
+	c := memcollector.New(zerolog.Nop(), "test", prometheus.Labels{"test": "test"}).WithStaleAfter(10)
+	_, err := c.SetMetricMemory([]byte(`{"__tick": 100, "creeps": 12}`))
+	require.NoError(t, err)
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+
+	c.SetGameTick(105)
+	dump := RegistryDump(reg)
+	require.Contains(t, dump, `test_creeps{test="test"} 12`)
+	require.Contains(t, dump, `test_watcher_segment_age_ticks{test="test"} 5`)
+
+	// The bot stopped writing the segment.
+	c.SetGameTick(111)
+	dump = RegistryDump(reg)
+	require.NotContains(t, dump, "test_creeps")
+	require.Contains(t, dump, `test_watcher_segment_age_ticks{test="test"} 11`)
+}
+
+func TestSamples(t *testing.T) {
+	c := memcollector.New(zerolog.Nop(), "test", prometheus.Labels{"shard": "shard3"})
+	_, err := c.SetMetricMemory([]byte(`{"room": {"{shard=3}": {"controller{owner=me}": {"level": 8}}}, "cpu.used": 12}`))
+	require.NoError(t, err)
+
+	samples := c.Samples()
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].Path, ".") < strings.Join(samples[j].Path, ".")
+	})
+	require.Equal(t, []memcollector.Sample{
+		{Path: []string{"cpu", "used"}, Labels: map[string]string{"shard": "shard3"}, Value: 12},
+		// The shard label of the segment is renamed, the constant label wins.
+		{Path: []string{"room", "controller", "level"}, Labels: map[string]string{"shard": "shard3", "exported_shard": "3", "owner": "me"}, Value: 8},
+	}, samples)
+}
+
+func TestTextConstLabel(t *testing.T) {
+	for name, memory := range map[string]string{
+		memcollector.FormatPrometheus:  "# TYPE cpu gauge\ncpu{shard=\"shard2\",room=\"E1S1\"} 12\ncpu{room=\"E2S2\"} 3\n",
+		memcollector.FormatOpenMetrics: "# TYPE cpu gauge\ncpu{shard=\"shard2\",room=\"E1S1\"} 12\ncpu{room=\"E2S2\"} 3\n# EOF\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := memcollector.New(zerolog.Nop(), "test", prometheus.Labels{"shard": "shard3"})
+			_, err := c.SetMetricMemory([]byte(memory))
+			require.NoError(t, err)
+
+			reg := prometheus.NewRegistry()
+			reg.MustRegister(c)
+			dump := RegistryDump(reg)
+			// The series is kept with its label renamed.
+			require.Contains(t, dump, `test_cpu{exported_shard="shard2",room="E1S1",shard="shard3"} 12`)
+			require.Contains(t, dump, `test_cpu{exported_shard="",room="E2S2",shard="shard3"} 3`)
+			require.Contains(t, dump, `test_watcher_sanitized_series_total{action="renamed",reason="const_label",shard="shard3"} 1`)
+		})
+	}
+}
+
+func TestDetectJSONArray(t *testing.T) {
+	c := memcollector.New(zerolog.Nop(), "test", nil)
+	_, err := c.SetMetricMemory([]byte(` [{"cpu": 1}]`))
+	require.ErrorContains(t, err, "segment must be an object, found []interface {}")
+}
+
+func TestHistory(t *testing.T) {
+	c := memcollector.New(zerolog.Nop(), "test", prometheus.Labels{"shard": "shard3"})
+	// Without a consumer no history is kept.
+	_, err := c.SetMetricMemory([]byte(`{"__tick": 100, "__history": [
+		{"__tick": 99, "__time": 1699999997000, "cpu": 5}
+	]}`))
+	require.NoError(t, err)
+	c.WithHistoryConsumer("remote")
+	require.Empty(t, c.History("remote"))
+
+	_, err = c.SetMetricMemory([]byte(`{"__tick": 102, "__history": [
+		{"__tick": 100, "__time": 1700000000000, "cpu": 10},
+		{"__tick": 101, "__time": 1700000003000, "cpu": 20}
+	]}`))
+	require.NoError(t, err)
+
+	require.Equal(t, []memcollector.HistorySample{
+		{Name: "test_cpu", Labels: map[string]string{"shard": "shard3"}, Value: 10, Tick: 100, Time: time.UnixMilli(1700000000000)},
+		{Name: "test_cpu", Labels: map[string]string{"shard": "shard3"}, Value: 20, Tick: 101, Time: time.UnixMilli(1700000003000)},
+	}, c.History("remote"))
+	require.Empty(t, c.History("remote"))
+
+	// The ring buffer still has tick 101, which was already read.
+	_, err = c.SetMetricMemory([]byte(`{"__tick": 103, "__history": [
+		{"__tick": 101, "__time": 1700000003000, "cpu": 20},
+		{"__tick": 102, "__time": 1700000006000, "cpu": 30}
+	]}`))
+	require.NoError(t, err)
+	require.Equal(t, []memcollector.HistorySample{
+		{Name: "test_cpu", Labels: map[string]string{"shard": "shard3"}, Value: 30, Tick: 102, Time: time.UnixMilli(1700000006000)},
+	}, c.History("remote"))
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	require.Contains(t, RegistryDump(reg), `test_cpu{shard="shard3"} 30 1700000006000`)
+}
+
+func TestMetaKept(t *testing.T) {
+	c := memcollector.New(zerolog.Nop(), "test", nil)
+	_, err := c.SetMetricMemory([]byte(`{"__meta": {"creeps": {"help": "Creeps alive."}}, "creeps": 12}`))
+	require.NoError(t, err)
+	// The bot does not write the metadata every tick.
+	_, err = c.SetMetricMemory([]byte(`{"creeps": 13}`))
+	require.NoError(t, err)
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	require.Contains(t, RegistryDump(reg), "# HELP test_creeps Creeps alive.")
+
+	// Restored after a restart.
+	restored := memcollector.New(zerolog.Nop(), "test", nil)
+	require.NoError(t, restored.SetMeta(c.Meta()))
+	_, err = restored.SetMetricMemory([]byte(`{"creeps": 13}`))
+	require.NoError(t, err)
+	reg = prometheus.NewRegistry()
+	reg.MustRegister(restored)
+	require.Contains(t, RegistryDump(reg), "# HELP test_creeps Creeps alive.")
+}
+
+func TestLimits(t *testing.T) {
+	// A series per creep, in two rooms.
+	memory := []byte(`{
+		"creep_cpu{room=E1S1,creep=a}": 1,
+		"creep_cpu{room=E1S1,creep=b}": 2,
+		"creep_cpu{room=E1S1,creep=c}": 3,
+		"creep_cpu{room=E2S2,creep=d}": 4,
+		"cpu": 10
+	}`)
+	collect := func(limits memcollector.Limits) (string, error) {
+		c := memcollector.New(zerolog.Nop(), "test", nil).WithLimits(limits)
+		_, err := c.SetMetricMemory(memory)
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(c)
+		return RegistryDump(reg), err
+	}
+
+	_, err := collect(memcollector.Limits{MaxSeriesPerMetric: 2})
+	require.ErrorContains(t, err, "max_series_per_metric")
+	_, err = collect(memcollector.Limits{MaxSeries: 4, Action: memcollector.LimitReject})
+	require.ErrorContains(t, err, "max_series")
+
+	dump, err := collect(memcollector.Limits{MaxSeriesPerMetric: 2, Action: memcollector.LimitAggregate})
+	require.NoError(t, err)
+	require.Contains(t, dump, `test_creep_cpu{room="E1S1"} 6`)
+	require.Contains(t, dump, `test_creep_cpu{room="E2S2"} 4`)
+	require.Contains(t, dump, `test_watcher_limited_series_total{action="aggregate",metric="creep_cpu"} 2`)
+
+	dump, err = collect(memcollector.Limits{MaxSeries: 3, Action: memcollector.LimitTruncate})
+	require.NoError(t, err)
+	require.Contains(t, dump, `test_cpu 10`)
+	require.Contains(t, dump, `test_watcher_limited_series_total{action="truncate",metric="creep_cpu"} 2`)
+	require.Contains(t, dump, `test_watcher_metric_count 3`)
+}
+
+func TestLimitsAggregateHistogramBounds(t *testing.T) {
+	// The rooms have different bounds, except for 1.
+	c := memcollector.New(zerolog.Nop(), "test", nil).WithLimits(memcollector.Limits{
+		MaxSeriesPerMetric: 1,
+		Action:             memcollector.LimitAggregate,
+	})
+	_, err := c.SetMetricMemory([]byte(`{
+		"wait{room=E1S1}": {"__type": "histogram", "sum": 2, "count": 3, "buckets": {"1": 1, "5": 2}},
+		"wait{room=E2S2}": {"__type": "histogram", "sum": 3, "count": 4, "buckets": {"1": 1, "10": 3}}
+	}`))
+	require.NoError(t, err)
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	dump := RegistryDump(reg)
+	require.Contains(t, dump, `test_wait_bucket{le="1"} 2`)
+	// E2S2 has no bound of 5, so its count at 1 is carried forward.
+	require.Contains(t, dump, `test_wait_bucket{le="5"} 3`)
+	require.Contains(t, dump, `test_wait_bucket{le="10"} 5`)
+	require.Contains(t, dump, `test_wait_bucket{le="+Inf"} 7`)
+	require.Contains(t, dump, `test_wait_sum 5`)
+	require.Contains(t, dump, `test_wait_count 7`)
+}
+
+func TestDuplicateKeys(t *testing.T) {
+	c := memcollector.New(zerolog.Nop(), "test", nil)
+	// The last duplicate wins, with everything under it.
+	_, err := c.SetMetricMemory([]byte(`{
+		"cpu": 1,
+		"room": {"energy": 10, "creeps": 3},
+		"cpu": 2,
+		"room": {"energy": 20},
+		"\u0063pu": 3
+	}`))
+	require.NoError(t, err)
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	dump := RegistryDump(reg)
+	require.Contains(t, dump, "test_cpu 3\n")
+	require.Contains(t, dump, "test_room_energy 20\n")
+	require.NotContains(t, dump, "test_room_creeps")
+	require.NotContains(t, dump, "sanitized_series_total")
+}
+
+func TestInvalidTypes(t *testing.T) {
+	for name, memory := range map[string]string{
+		"unknown":        `{"cpu": {"__type": "meter", "used": 1}}`,
+		"no count":       `{"wait": {"__type": "histogram", "sum": 1, "buckets": {"1": 1}}}`,
+		"bad bound":      `{"wait": {"__type": "histogram", "sum": 1, "count": 1, "buckets": {"big": 1}}}`,
+		"nested numbers": `{"waits": {"__type": "summary", "a": 1}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := memcollector.New(zerolog.Nop(), "test", nil)
+			_, err := c.SetMetricMemory([]byte(memory))
+			require.Error(t, err)
+		})
+	}
+}
+
+// largeSegment is the full golden segment copied until it is about 100KB,
+// the size of a busy bot's stats.
+func largeSegment(b *testing.B) []byte {
+	full, err := os.ReadFile("testdata/full/memory.json")
+	require.NoError(b, err)
+	var doc bytes.Buffer
+	doc.WriteString("{")
+	for i := 0; doc.Len() < 100_000; i++ {
+		if i > 0 {
+			doc.WriteString(",")
+		}
+		fmt.Fprintf(&doc, `"copy{copy=%d}":`, i)
+		doc.Write(full)
+	}
+	doc.WriteString("}")
+	return doc.Bytes()
+}
+
+func BenchmarkSetMetricMemory(b *testing.B) {
+	data := largeSegment(b)
+	c := memcollector.New(zerolog.Nop(), "test", prometheus.Labels{"test": "test"})
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := c.SetMetricMemory(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCollect(b *testing.B) {
+	c := memcollector.New(zerolog.Nop(), "test", prometheus.Labels{"test": "test"})
+	_, err := c.SetMetricMemory(largeSegment(b))
+	require.NoError(b, err)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ch := make(chan prometheus.Metric, 1024)
+		go func() {
+			c.Collect(ch)
+			close(ch)
+		}()
+		for range ch {
+		}
+	}
+}
+
 func RegistryDump(reg prometheus.Gatherer) string {
 	h := promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
 	rec := httptest.NewRecorder()
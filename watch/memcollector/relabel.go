@@ -0,0 +1,185 @@
+package memcollector
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Labels relabel rules can use besides the labels of a series. Other labels
+// starting with "__" can hold values between rules, and are removed after.
+// Series left without a name are dropped.
+const (
+	// NameLabel is the metric name without the namespace.
+	NameLabel = "__name__"
+	// PathLabel is the path of the metric in the segment, joined with dots.
+	PathLabel = "__path__"
+)
+
+// Relabel actions.
+const (
+	RelabelReplace   = "replace"
+	RelabelKeep      = "keep"
+	RelabelDrop      = "drop"
+	RelabelLabelMap  = "labelmap"
+	RelabelLabelDrop = "labeldrop"
+)
+
+// RelabelActions are the valid relabel actions.
+var RelabelActions = []string{RelabelReplace, RelabelKeep, RelabelDrop, RelabelLabelMap, RelabelLabelDrop}
+
+// RelabelConfig is a rule applied to the series of the segment, like a
+// Prometheus metric_relabel_configs rule.
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels"`
+	// Separator joins the values of the source labels, ";" if empty.
+	Separator string `yaml:"separator"`
+	// Regex is anchored at both ends, "(.*)" if empty.
+	Regex       string `yaml:"regex"`
+	TargetLabel string `yaml:"target_label"`
+	// Replacement is expanded with the groups of the regex, "$1" if empty.
+	Replacement string `yaml:"replacement"`
+	// Action is one of RelabelActions, RelabelReplace if empty.
+	Action string `yaml:"action"`
+}
+
+// relabelRule is a RelabelConfig with its defaults set and regex compiled.
+type relabelRule struct {
+	RelabelConfig
+	regex *regexp.Regexp
+}
+
+// Validate returns the first problem with the rule.
+func (r RelabelConfig) Validate() error {
+	_, err := r.compile()
+	return err
+}
+
+func (r RelabelConfig) compile() (relabelRule, error) {
+	if r.Separator == "" {
+		r.Separator = ";"
+	}
+	if r.Regex == "" {
+		r.Regex = "(.*)"
+	}
+	if r.Replacement == "" {
+		r.Replacement = "$1"
+	}
+	if r.Action == "" {
+		r.Action = RelabelReplace
+	}
+
+	_, err := regexp.Compile(r.Regex)
+	if err != nil {
+		return relabelRule{}, fmt.Errorf("invalid regex: %w", err)
+	}
+	regex := regexp.MustCompile("^(?:" + r.Regex + ")$")
+	switch r.Action {
+	case RelabelReplace:
+		if r.TargetLabel == "" {
+			return relabelRule{}, fmt.Errorf("replace needs a target_label")
+		}
+		fallthrough
+	case RelabelKeep, RelabelDrop:
+		if len(r.SourceLabels) == 0 {
+			return relabelRule{}, fmt.Errorf("%s needs source_labels", r.Action)
+		}
+	case RelabelLabelMap, RelabelLabelDrop:
+	default:
+		return relabelRule{}, fmt.Errorf("unknown action %q, must be one of %s", r.Action, strings.Join(RelabelActions, ", "))
+	}
+	return relabelRule{RelabelConfig: r, regex: regex}, nil
+}
+
+// relabel applies the rules to the metrics of a segment.
+func relabel(rules []relabelRule, metrics map[string][]prometheusMetric) map[string][]prometheusMetric {
+	if len(rules) == 0 {
+		return metrics
+	}
+
+	out := make(map[string][]prometheusMetric, len(metrics))
+	for name, series := range metrics {
+		for _, metric := range series {
+			labels := make(map[string]string, len(metric.Labels)+2)
+			for k, v := range metric.Labels {
+				labels[k] = v
+			}
+			labels[NameLabel] = name
+			labels[PathLabel] = strings.Join(metric.Path, ".")
+
+			if !relabelSeries(rules, labels) {
+				continue
+			}
+
+			newName := labels[NameLabel]
+			if newName == "" {
+				continue
+			}
+			if path := labels[PathLabel]; path != strings.Join(metric.Path, ".") {
+				metric.Path = treePath(nil, path)
+			}
+			for k := range labels {
+				if strings.HasPrefix(k, "__") {
+					delete(labels, k)
+				}
+			}
+			metric.Labels = labels
+			out[newName] = append(out[newName], metric)
+		}
+	}
+	return out
+}
+
+// relabelSeries applies the rules to the labels of a series. It returns false
+// if the series is dropped.
+func relabelSeries(rules []relabelRule, labels map[string]string) bool {
+	for _, r := range rules {
+		values := make([]string, 0, len(r.SourceLabels))
+		for _, l := range r.SourceLabels {
+			values = append(values, labels[l])
+		}
+		value := strings.Join(values, r.Separator)
+
+		switch r.Action {
+		case RelabelKeep:
+			if !r.regex.MatchString(value) {
+				return false
+			}
+		case RelabelDrop:
+			if r.regex.MatchString(value) {
+				return false
+			}
+		case RelabelReplace:
+			match := r.regex.FindStringSubmatchIndex(value)
+			if match == nil {
+				continue
+			}
+			target := string(r.regex.ExpandString(nil, r.TargetLabel, value, match))
+			result := string(r.regex.ExpandString(nil, r.Replacement, value, match))
+			if result == "" {
+				delete(labels, target)
+			} else {
+				labels[target] = result
+			}
+		case RelabelLabelMap:
+			mapped := make(map[string]string)
+			for k, v := range labels {
+				match := r.regex.FindStringSubmatchIndex(k)
+				if match == nil {
+					continue
+				}
+				mapped[string(r.regex.ExpandString(nil, r.Replacement, k, match))] = v
+			}
+			for k, v := range mapped {
+				labels[k] = v
+			}
+		case RelabelLabelDrop:
+			for k := range labels {
+				if r.regex.MatchString(k) {
+					delete(labels, k)
+				}
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,265 @@
+package memcollector
+
+import (
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Actions taken on a series that is not valid as it is.
+const (
+	actionRenamed = "renamed"
+	actionFilled  = "filled"
+	actionDropped = "dropped"
+)
+
+// seriesIssue is a series that had to be changed or dropped to be exported.
+type seriesIssue struct {
+	Name   string
+	Action string
+	Reason string
+}
+
+// sanitize makes the metrics of a segment valid to export. Invalid names and
+// label names are renamed, series of a name get the same label names, with
+// missing labels set to "", and series that cannot be exported are dropped.
+// Without this a single bad key fails the whole gather.
+func sanitize(metrics map[string][]prometheusMetric, constLabels prometheus.Labels) (map[string][]prometheusMetric, []seriesIssue) {
+	var issues []seriesIssue
+	issue := func(name, action, reason string) {
+		issues = append(issues, seriesIssue{Name: name, Action: action, Reason: reason})
+	}
+
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := make(map[string][]prometheusMetric, len(metrics))
+	for _, raw := range names {
+		name := sanitizeName(raw)
+		for _, metric := range metrics[raw] {
+			if name != raw {
+				issue(raw, actionRenamed, "invalid_name")
+			}
+			labels, reason := sanitizeLabels(metric.Labels)
+			if reason != "" {
+				issue(name, actionDropped, reason)
+				continue
+			}
+			if len(labels) != len(metric.Labels) {
+				issue(name, actionDropped, "duplicate_label")
+				continue
+			}
+			for k := range metric.Labels {
+				if _, ok := labels[k]; !ok {
+					issue(name, actionRenamed, "invalid_label_name")
+					break
+				}
+			}
+			labels, renamed := exportedLabels(labels, constLabels)
+			if renamed {
+				issue(name, actionRenamed, "const_label")
+			}
+			metric.Labels = labels
+			out[name] = append(out[name], metric)
+		}
+	}
+
+	for name, series := range out {
+		// Sorted so the same series win on every scrape.
+		sigs := make([]string, len(series))
+		order := make([]int, len(series))
+		for i, m := range series {
+			sigs[i] = signature(m.Labels)
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return sigs[order[i]] < sigs[order[j]]
+		})
+		sorted := make([]prometheusMetric, len(series))
+		for i, o := range order {
+			sorted[i] = series[o]
+		}
+		series = sorted
+
+		// A family has one type.
+		typ := series[0].Type
+		series = slices.DeleteFunc(series, func(m prometheusMetric) bool {
+			if m.Type != typ {
+				issue(name, actionDropped, "type_mismatch")
+				return true
+			}
+			return false
+		})
+
+		// Every series of a family has the same label names.
+		labelNames := make(map[string]struct{})
+		for _, m := range series {
+			for k := range m.Labels {
+				labelNames[k] = struct{}{}
+			}
+		}
+		for i, m := range series {
+			if len(m.Labels) == len(labelNames) {
+				continue
+			}
+			labels := maps.Clone(m.Labels)
+			for k := range labelNames {
+				if _, ok := labels[k]; !ok {
+					labels[k] = ""
+				}
+			}
+			series[i].Labels = labels
+			issue(name, actionFilled, "missing_labels")
+		}
+
+		seen := make(map[string]struct{}, len(series))
+		series = slices.DeleteFunc(series, func(m prometheusMetric) bool {
+			sig := signature(m.Labels)
+			if _, ok := seen[sig]; ok {
+				issue(name, actionDropped, "duplicate_series")
+				return true
+			}
+			seen[sig] = struct{}{}
+			return false
+		})
+		out[name] = series
+	}
+
+	// Histograms and summaries are written with suffixed names, which no
+	// other family can have.
+	for _, name := range names {
+		name = sanitizeName(name)
+		series := out[name]
+		if len(series) == 0 || (series[0].Type != typeHistogram && series[0].Type != typeSummary) {
+			continue
+		}
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			for range out[name+suffix] {
+				issue(name+suffix, actionDropped, "name_collision")
+			}
+			delete(out, name+suffix)
+		}
+	}
+	return out, issues
+}
+
+// sanitizeLabels renames invalid label names. It returns why the series has
+// to be dropped, if it does.
+func sanitizeLabels(labels map[string]string) (map[string]string, string) {
+	valid := true
+	for k := range labels {
+		if strings.HasPrefix(k, "__") {
+			return nil, "reserved_label"
+		}
+		valid = valid && sanitizeLabelName(k) == k
+	}
+	if valid {
+		// Series share label maps, which are only copied to be changed.
+		return labels, ""
+	}
+
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		name := sanitizeLabelName(k)
+		if strings.HasPrefix(name, "__") {
+			return nil, "reserved_label"
+		}
+		out[name] = v
+	}
+	return out, ""
+}
+
+// exportedLabels renames the labels that are also constant labels to
+// exported_<name>, like Prometheus does with labels that clash with target
+// labels. The labels are only copied if one is renamed.
+func exportedLabels(labels map[string]string, constLabels prometheus.Labels) (map[string]string, bool) {
+	clash := false
+	for k := range labels {
+		if _, ok := constLabels[k]; ok {
+			clash = true
+			break
+		}
+	}
+	if !clash {
+		return labels, false
+	}
+
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if _, ok := constLabels[k]; !ok {
+			out[k] = v
+		}
+	}
+	for k, v := range labels {
+		if _, ok := constLabels[k]; !ok {
+			continue
+		}
+		name := "exported_" + k
+		for {
+			_, taken := out[name]
+			_, constant := constLabels[name]
+			if !taken && !constant {
+				break
+			}
+			name = "exported_" + name
+		}
+		out[name] = v
+	}
+	return out, true
+}
+
+// sanitizeName replaces the characters a metric name cannot have with
+// underscores. The name is always prefixed with the namespace, so it can
+// start with a digit.
+func sanitizeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '_' || r == ':' || isAlphaNumeric(r) {
+			return r
+		}
+		return '_'
+	}, name)
+	name = repeatedUnderscores.ReplaceAllString(name, "_")
+	return strings.TrimPrefix(name, "_")
+}
+
+// sanitizeLabelName replaces the characters a label name cannot have with
+// underscores.
+func sanitizeLabelName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '_' || isAlphaNumeric(r) {
+			return r
+		}
+		return '_'
+	}, name)
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+func isAlphaNumeric(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
+
+// signature identifies a label set.
+func signature(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sig strings.Builder
+	for _, k := range keys {
+		sig.WriteString(k)
+		sig.WriteByte('=')
+		sig.WriteString(labels[k])
+		sig.WriteByte(0xff)
+	}
+	return sig.String()
+}
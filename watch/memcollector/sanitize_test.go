@@ -0,0 +1,143 @@
+package memcollector_test
+
+import (
+	"testing"
+
+	"github.com/Emyrk/screeps-watcher/watch/memcollector"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanitizeReasons(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		memory string
+		// sanitized are the counts of sanitized_series_total by action and
+		// reason, every other count must be missing.
+		sanitized map[[2]string]int
+		want      []string
+		missing   []string
+	}{
+		{
+			name:      "invalid_name",
+			memory:    `{"cpu-used{room=E1S1}": 1, "cpu-used{room=E2S2}": 2}`,
+			sanitized: map[[2]string]int{{"renamed", "invalid_name"}: 2},
+			want:      []string{`test_cpu_used{room="E1S1",shard="shard3"} 1`, `test_cpu_used{room="E2S2",shard="shard3"} 2`},
+		},
+		{
+			name:      "invalid_label_name",
+			memory:    `{"cpu{room-name=E1S1}": 1, "cpu{room-name=E2S2}": 2}`,
+			sanitized: map[[2]string]int{{"renamed", "invalid_label_name"}: 2},
+			want:      []string{`test_cpu{room_name="E1S1",shard="shard3"} 1`, `test_cpu{room_name="E2S2",shard="shard3"} 2`},
+		},
+		{
+			name:   "duplicate_label",
+			memory: `{"cpu{room-name=E1S1,room_name=E2S2}": 1, "creeps": 2}`,
+			// The invalid label name is never renamed, the series is
+			// dropped first.
+			sanitized: map[[2]string]int{{"dropped", "duplicate_label"}: 1},
+			missing:   []string{"test_cpu"},
+		},
+		{
+			name:      "const_label",
+			memory:    `{"cpu{shard=other}": 1, "cpu{shard=again}": 2}`,
+			sanitized: map[[2]string]int{{"renamed", "const_label"}: 2},
+			want:      []string{`test_cpu{exported_shard="other",shard="shard3"} 1`, `test_cpu{exported_shard="again",shard="shard3"} 2`},
+		},
+		{
+			name:      "const_label taken",
+			memory:    `{"cpu{exported_shard=taken,shard=other}": 1}`,
+			sanitized: map[[2]string]int{{"renamed", "const_label"}: 1},
+			want:      []string{`test_cpu{exported_exported_shard="other",exported_shard="taken",shard="shard3"} 1`},
+		},
+		{
+			name:      "reserved_label",
+			memory:    `{"cpu{__name__=x}": 1, "cpu{room=E1S1}": 2}`,
+			sanitized: map[[2]string]int{{"dropped", "reserved_label"}: 1},
+			want:      []string{`test_cpu{room="E1S1",shard="shard3"} 2`},
+			missing:   []string{`__name__`},
+		},
+		{
+			name:      "type_mismatch",
+			memory:    `{"cpu": {"__type": "counter", "total{room=E1S1}": 1}, "cpu_total{room=E2S2}": 2}`,
+			sanitized: map[[2]string]int{{"dropped", "type_mismatch"}: 1},
+			want:      []string{`test_cpu_total{room="E1S1",shard="shard3"} 1`},
+			missing:   []string{`room="E2S2"`},
+		},
+		{
+			name:      "missing_labels",
+			memory:    `{"cpu{room=E1S1}": 1, "cpu": 2}`,
+			sanitized: map[[2]string]int{{"filled", "missing_labels"}: 1},
+			want:      []string{`test_cpu{room="E1S1",shard="shard3"} 1`, `test_cpu{room="",shard="shard3"} 2`},
+		},
+		{
+			name:   "duplicate_series",
+			memory: `{"cpu-used": 1, "cpu_used": 2}`,
+			sanitized: map[[2]string]int{
+				{"renamed", "invalid_name"}:     1,
+				{"dropped", "duplicate_series"}: 1,
+			},
+			want: []string{`test_cpu_used{shard="shard3"}`},
+		},
+		{
+			name:      "name_collision",
+			memory:    `{"wait": {"__type": "histogram", "sum": 2, "count": 1, "buckets": {"5": 1}}, "wait_sum": 3, "wait_count{room=E1S1}": 4}`,
+			sanitized: map[[2]string]int{{"dropped", "name_collision"}: 2},
+			want:      []string{`test_wait_sum{shard="shard3"} 2`, `test_wait_count{shard="shard3"} 1`},
+			missing:   []string{`test_wait_sum{shard="shard3"} 3`, `room="E1S1"`},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := memcollector.New(zerolog.Nop(), "test", prometheus.Labels{"shard": "shard3"})
+			_, err := c.SetMetricMemory([]byte(tc.memory))
+			require.NoError(t, err)
+
+			reg := prometheus.NewRegistry()
+			reg.MustRegister(c)
+			families, err := reg.Gather()
+			require.NoError(t, err)
+			sanitized := make(map[[2]string]int)
+			for _, f := range families {
+				if f.GetName() != "test_watcher_sanitized_series_total" {
+					continue
+				}
+				for _, m := range f.GetMetric() {
+					labels := make(map[string]string)
+					for _, l := range m.GetLabel() {
+						labels[l.GetName()] = l.GetValue()
+					}
+					sanitized[[2]string{labels["action"], labels["reason"]}] = int(m.GetCounter().GetValue())
+				}
+			}
+			require.Equal(t, tc.sanitized, sanitized)
+
+			dump := RegistryDump(reg)
+			for _, want := range tc.want {
+				require.Contains(t, dump, want)
+			}
+			for _, missing := range tc.missing {
+				require.NotContains(t, dump, missing)
+			}
+		})
+	}
+}
+
+func TestSanitizeCountsEverySegment(t *testing.T) {
+	c := memcollector.New(zerolog.Nop(), "test", nil)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+
+	// Each series is counted on every segment it is in, the history
+	// included.
+	memory := []byte(`{"__tick": 2, "__history": [
+		{"__tick": 1, "__time": 1700000000000, "cpu-used": 1}
+	], "cpu-used": 2, "creeps{__name__=x}": 3}`)
+	for range 2 {
+		_, err := c.SetMetricMemory(memory)
+		require.NoError(t, err)
+	}
+	dump := RegistryDump(reg)
+	require.Contains(t, dump, `test_watcher_sanitized_series_total{action="renamed",reason="invalid_name"} 4`)
+	require.Contains(t, dump, `test_watcher_sanitized_series_total{action="dropped",reason="reserved_label"} 2`)
+}
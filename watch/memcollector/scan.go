@@ -0,0 +1,316 @@
+package memcollector
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// maxDepth is how deeply a segment can nest objects and arrays.
+const maxDepth = 512
+
+type jsonKind uint8
+
+const (
+	jsonNull jsonKind = iota
+	jsonFalse
+	jsonTrue
+	jsonNumber
+	jsonString
+	jsonArray
+	jsonObject
+)
+
+// jsonNode is a value of a JSON document. The nodes of a document are stored
+// in one slice in document order, so the children of an object or array
+// follow it instead of being decoded into maps and interfaces.
+type jsonNode struct {
+	kind jsonKind
+	// escaped is set on strings with escapes, keyEscaped on keys with them.
+	escaped    bool
+	keyEscaped bool
+	// keyStart and keyEnd are the key of an object member, without quotes.
+	keyStart, keyEnd int32
+	// start and end are the bytes of the value, without quotes for strings.
+	start, end int32
+	// size is the number of nodes of the value, including itself.
+	size int32
+}
+
+// jsonDoc is a scanned JSON document. Node 0 is the top level value.
+type jsonDoc struct {
+	data  []byte
+	nodes []jsonNode
+}
+
+// scanJSON scans a JSON document into nodes, reusing the nodes slice.
+func scanJSON(data []byte, nodes []jsonNode) (jsonDoc, error) {
+	s := scanner{data: data, nodes: nodes[:0]}
+	err := s.value(0, 0, false, 0)
+	if err == nil {
+		s.skipSpaces()
+		if s.i < len(s.data) {
+			err = s.errorf("unexpected data after the top level value")
+		}
+	}
+	return jsonDoc{data: data, nodes: s.nodes}, err
+}
+
+type scanner struct {
+	data  []byte
+	i     int
+	nodes []jsonNode
+}
+
+func (s *scanner) errorf(format string, args ...any) error {
+	return fmt.Errorf("offset %d: %s", s.i, fmt.Sprintf(format, args...))
+}
+
+func (s *scanner) skipSpaces() {
+	for s.i < len(s.data) {
+		switch s.data[s.i] {
+		case ' ', '\t', '\n', '\r':
+			s.i++
+		default:
+			return
+		}
+	}
+}
+
+func (s *scanner) value(keyStart, keyEnd int32, keyEscaped bool, depth int) error {
+	if depth > maxDepth {
+		return s.errorf("nested more than %d levels", maxDepth)
+	}
+	s.skipSpaces()
+	if s.i >= len(s.data) {
+		return s.errorf("unexpected end of data")
+	}
+
+	idx := len(s.nodes)
+	s.nodes = append(s.nodes, jsonNode{keyStart: keyStart, keyEnd: keyEnd, keyEscaped: keyEscaped, start: int32(s.i)})
+	switch c := s.data[s.i]; {
+	case c == '{':
+		s.nodes[idx].kind = jsonObject
+		s.i++
+		s.skipSpaces()
+		if s.i < len(s.data) && s.data[s.i] == '}' {
+			s.i++
+			break
+		}
+		for {
+			s.skipSpaces()
+			if s.i >= len(s.data) || s.data[s.i] != '"' {
+				return s.errorf("expected an object key")
+			}
+			ks, ke, escaped, err := s.string()
+			if err != nil {
+				return err
+			}
+			s.skipSpaces()
+			if s.i >= len(s.data) || s.data[s.i] != ':' {
+				return s.errorf("expected : after an object key")
+			}
+			s.i++
+			err = s.value(ks, ke, escaped, depth+1)
+			if err != nil {
+				return err
+			}
+			if done, err := s.separator('}'); err != nil || done {
+				if err != nil {
+					return err
+				}
+				break
+			}
+		}
+	case c == '[':
+		s.nodes[idx].kind = jsonArray
+		s.i++
+		s.skipSpaces()
+		if s.i < len(s.data) && s.data[s.i] == ']' {
+			s.i++
+			break
+		}
+		for {
+			err := s.value(0, 0, false, depth+1)
+			if err != nil {
+				return err
+			}
+			if done, err := s.separator(']'); err != nil || done {
+				if err != nil {
+					return err
+				}
+				break
+			}
+		}
+	case c == '"':
+		start, end, escaped, err := s.string()
+		if err != nil {
+			return err
+		}
+		s.nodes[idx].kind = jsonString
+		s.nodes[idx].escaped = escaped
+		s.nodes[idx].start = start
+		s.nodes[idx].end = end
+		s.nodes[idx].size = 1
+		return nil
+	case c == '-' || (c >= '0' && c <= '9'):
+		s.nodes[idx].kind = jsonNumber
+		for s.i < len(s.data) && isNumberByte(s.data[s.i]) {
+			s.i++
+		}
+	case s.literal("true"):
+		s.nodes[idx].kind = jsonTrue
+	case s.literal("false"):
+		s.nodes[idx].kind = jsonFalse
+	case s.literal("null"):
+		s.nodes[idx].kind = jsonNull
+	default:
+		return s.errorf("invalid character %q", c)
+	}
+	s.nodes[idx].end = int32(s.i)
+	s.nodes[idx].size = int32(len(s.nodes) - idx)
+	return nil
+}
+
+// separator reads the comma between values, or the closing byte. It returns
+// true if the value is done.
+func (s *scanner) separator(closing byte) (bool, error) {
+	s.skipSpaces()
+	if s.i >= len(s.data) {
+		return false, s.errorf("unexpected end of data")
+	}
+	switch s.data[s.i] {
+	case ',':
+		s.i++
+		return false, nil
+	case closing:
+		s.i++
+		return true, nil
+	default:
+		return false, s.errorf("expected , or %c", closing)
+	}
+}
+
+// string reads a string, returning the bytes between the quotes.
+func (s *scanner) string() (int32, int32, bool, error) {
+	s.i++
+	start := s.i
+	escaped := false
+	for s.i < len(s.data) {
+		switch c := s.data[s.i]; {
+		case c == '"':
+			end := s.i
+			s.i++
+			return int32(start), int32(end), escaped, nil
+		case c == '\\':
+			escaped = true
+			s.i += 2
+		case c < 0x20:
+			return 0, 0, false, s.errorf("control character in string")
+		default:
+			s.i++
+		}
+	}
+	return 0, 0, false, s.errorf("unterminated string")
+}
+
+func (s *scanner) literal(lit string) bool {
+	if len(s.data)-s.i >= len(lit) && string(s.data[s.i:s.i+len(lit)]) == lit {
+		s.i += len(lit)
+		return true
+	}
+	return false
+}
+
+func isNumberByte(c byte) bool {
+	return (c >= '0' && c <= '9') || c == '-' || c == '+' || c == '.' || c == 'e' || c == 'E'
+}
+
+// children calls f with the index of each child of an object or array, in
+// document order, until f returns false.
+func (d jsonDoc) children(i int, f func(child int) bool) {
+	end := i + int(d.nodes[i].size)
+	for c := i + 1; c < end; c += int(d.nodes[c].size) {
+		if !f(c) {
+			return
+		}
+	}
+}
+
+// member returns the child of an object with the key, or -1.
+func (d jsonDoc) member(i int, key string) int {
+	found := -1
+	d.children(i, func(c int) bool {
+		n := d.nodes[c]
+		if !n.keyEscaped && string(d.data[n.keyStart:n.keyEnd]) == key {
+			found = c
+		}
+		// The last duplicate wins, like encoding/json.
+		return true
+	})
+	return found
+}
+
+// keyBytes are the raw bytes of the key of a member.
+func (d jsonDoc) keyBytes(i int) []byte {
+	return d.data[d.nodes[i].keyStart:d.nodes[i].keyEnd]
+}
+
+// raw is the JSON of a node, with quotes for strings.
+func (d jsonDoc) raw(i int) []byte {
+	n := d.nodes[i]
+	if n.kind == jsonString {
+		return d.data[n.start-1 : n.end+1]
+	}
+	return d.data[n.start:n.end]
+}
+
+// unquote decodes a string with escapes.
+func unquote(quoted []byte) (string, error) {
+	var s string
+	err := json.Unmarshal(quoted, &s)
+	return s, err
+}
+
+// float parses a number node.
+func (d jsonDoc) float(i int) (float64, error) {
+	n := d.nodes[i]
+	return strconv.ParseFloat(string(d.data[n.start:n.end]), 64)
+}
+
+// decode unmarshals a node the way encoding/json would, for the parts of the
+// segment that are rare enough not to need the fast path.
+func (d jsonDoc) decode(i int) (any, error) {
+	var v any
+	err := json.Unmarshal(d.raw(i), &v)
+	return v, err
+}
+
+// typeName is the Go type encoding/json decodes a node to, so errors read the
+// same as they did when segments were decoded into maps.
+func (d jsonDoc) typeName(i int) string {
+	switch d.nodes[i].kind {
+	case jsonObject:
+		return "map[string]interface {}"
+	case jsonArray:
+		return "[]interface {}"
+	case jsonString:
+		return "string"
+	case jsonNumber:
+		return "float64"
+	case jsonTrue, jsonFalse:
+		return "bool"
+	default:
+		return "<nil>"
+	}
+}
+
+// memberFloat is the number of the member with the key.
+func (d jsonDoc) memberFloat(i int, key string) (float64, bool) {
+	m := d.member(i, key)
+	if m < 0 || d.nodes[m].kind != jsonNumber {
+		return 0, false
+	}
+	v, err := d.float(m)
+	return v, err == nil
+}
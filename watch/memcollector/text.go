@@ -0,0 +1,256 @@
+package memcollector
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Formats of the metrics segment.
+const (
+	// FormatAuto reads segments starting with "{" or "[" as JSON, those
+	// ending with "# EOF" as OpenMetrics and anything else as Prometheus
+	// text.
+	FormatAuto = "auto"
+	// FormatJSON is the nested JSON convention of the watcher.
+	FormatJSON = "json"
+	// FormatPrometheus is the Prometheus text exposition format.
+	FormatPrometheus = "prometheus"
+	// FormatOpenMetrics is the OpenMetrics text exposition format.
+	FormatOpenMetrics = "openmetrics"
+)
+
+// Formats are the valid segment formats.
+var Formats = []string{FormatAuto, FormatJSON, FormatPrometheus, FormatOpenMetrics}
+
+// detectFormat guesses the format of a segment. A top level array is read as
+// JSON, like memory.isJSON does, so it is rejected as not an object rather
+// than parsed as text.
+func detectFormat(data []byte) string {
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(data, []byte("{")), bytes.HasPrefix(data, []byte("[")):
+		return FormatJSON
+	case bytes.HasSuffix(data, []byte("# EOF")):
+		return FormatOpenMetrics
+	default:
+		return FormatPrometheus
+	}
+}
+
+// textMetrics parses a segment in a text exposition format. Text segments
+// have no tick, history or key errors.
+func textMetrics(data []byte, format string) (segment, error) {
+	var units map[string]string
+	if format == FormatOpenMetrics {
+		var err error
+		data, units, err = openMetricsToText(data)
+		if err != nil {
+			return segment{}, fmt.Errorf("openmetrics: %w", err)
+		}
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data[:len(data):len(data)], '\n')
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(data))
+	if err != nil {
+		return segment{}, fmt.Errorf("parse text: %w", err)
+	}
+
+	seg := segment{
+		tick:    -1,
+		metrics: make(map[string][]prometheusMetric, len(families)),
+		meta:    make(map[string]metricMeta),
+	}
+	for name, family := range families {
+		if family.GetHelp() != "" || units[name] != "" {
+			seg.meta[name] = metricMeta{Help: family.GetHelp(), Unit: units[name]}
+		}
+		for _, m := range family.GetMetric() {
+			metric := familyMetric(family.GetType(), m)
+			metric.Path = []string{name}
+			metric.Labels = make(map[string]string, len(m.GetLabel()))
+			for _, l := range m.GetLabel() {
+				metric.Labels[l.GetName()] = l.GetValue()
+			}
+			if m.TimestampMs != nil {
+				metric.Timestamp = time.UnixMilli(m.GetTimestampMs())
+			}
+			seg.metrics[name] = append(seg.metrics[name], metric)
+		}
+	}
+	return seg, nil
+}
+
+// familyMetric is the value of a parsed metric. Untyped metrics are gauges.
+func familyMetric(typ dto.MetricType, m *dto.Metric) prometheusMetric {
+	switch typ {
+	case dto.MetricType_COUNTER:
+		return prometheusMetric{Type: typeCounter, Value: m.GetCounter().GetValue()}
+	case dto.MetricType_GAUGE:
+		return prometheusMetric{Type: typeGauge, Value: m.GetGauge().GetValue()}
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		metric := prometheusMetric{
+			Type:    typeHistogram,
+			Count:   h.GetSampleCount(),
+			Sum:     h.GetSampleSum(),
+			Buckets: make(map[float64]uint64, len(h.GetBucket())),
+		}
+		for _, b := range h.GetBucket() {
+			// The +Inf bucket is the count.
+			if !math.IsInf(b.GetUpperBound(), 1) {
+				metric.Buckets[b.GetUpperBound()] = b.GetCumulativeCount()
+			}
+		}
+		return metric
+	case dto.MetricType_SUMMARY:
+		s := m.GetSummary()
+		metric := prometheusMetric{
+			Type:      typeSummary,
+			Count:     s.GetSampleCount(),
+			Sum:       s.GetSampleSum(),
+			Quantiles: make(map[float64]float64, len(s.GetQuantile())),
+		}
+		for _, q := range s.GetQuantile() {
+			metric.Quantiles[q.GetQuantile()] = q.GetValue()
+		}
+		return metric
+	default:
+		return prometheusMetric{Type: typeGauge, Value: m.GetUntyped().GetValue()}
+	}
+}
+
+// openMetricsToText rewrites OpenMetrics as Prometheus text, returning the
+// units of the metrics by name. Counters and info metrics are named after
+// their samples, unknown metrics become untyped, state sets gauges and gauge
+// histograms histograms. Exemplars and created samples are dropped, and
+// timestamps are converted from seconds to milliseconds.
+func openMetricsToText(data []byte) ([]byte, map[string]string, error) {
+	lines := strings.Split(string(data), "\n")
+
+	// Metadata can come in any order, so the types are found first.
+	types := make(map[string]string)
+	for _, line := range lines {
+		if fields := strings.Fields(line); len(fields) == 4 && fields[0] == "#" && fields[1] == "TYPE" {
+			types[fields[2]] = fields[3]
+		}
+	}
+	rename := func(name string) string {
+		switch types[name] {
+		case "counter":
+			if !strings.HasSuffix(name, "_total") {
+				return name + "_total"
+			}
+		case "info":
+			return name + "_info"
+		}
+		return name
+	}
+
+	var out bytes.Buffer
+	units := make(map[string]string)
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if line == "# EOF" {
+			break
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) < 4 {
+				continue
+			}
+			name := fields[2]
+			switch fields[1] {
+			case "TYPE":
+				typ := fields[3]
+				switch typ {
+				case "unknown":
+					typ = "untyped"
+				case "info", "stateset":
+					typ = "gauge"
+				case "gaugehistogram":
+					typ = "histogram"
+				}
+				fmt.Fprintf(&out, "# TYPE %s %s\n", rename(name), typ)
+			case "HELP":
+				help := strings.ReplaceAll(fields[3], `\"`, `"`)
+				fmt.Fprintf(&out, "# HELP %s %s\n", rename(name), help)
+			case "UNIT":
+				units[rename(name)] = fields[3]
+			}
+			continue
+		}
+
+		sample, err := openMetricsSample(line, types)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		if sample != "" {
+			out.WriteString(sample)
+			out.WriteByte('\n')
+		}
+	}
+	return out.Bytes(), units, nil
+}
+
+// openMetricsSample rewrites a sample line, or returns "" if it is dropped.
+func openMetricsSample(line string, types map[string]string) (string, error) {
+	// The name and labels end at the first space outside of quotes.
+	end, quoted := len(line), false
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == ' ':
+			end = i
+		}
+		if end != len(line) {
+			break
+		}
+	}
+	series, rest := line[:end], line[end:]
+	name, _, _ := strings.Cut(series, "{")
+
+	for _, suffix := range []string{"_created", "_gcount", "_gsum"} {
+		family, ok := strings.CutSuffix(name, suffix)
+		if !ok {
+			continue
+		}
+		switch typ := types[family]; {
+		case suffix == "_created" && (typ == "counter" || typ == "histogram" || typ == "summary"):
+			return "", nil
+		case suffix != "_created" && typ == "gaugehistogram":
+			// "_gcount" and "_gsum" are "_count" and "_sum" of a histogram.
+			series = family + "_" + suffix[2:] + series[len(name):]
+		}
+	}
+
+	// Exemplars follow the value and timestamp.
+	rest, _, _ = strings.Cut(rest, " # ")
+	fields := strings.Fields(rest)
+	switch len(fields) {
+	case 1:
+		return series + " " + fields[0], nil
+	case 2:
+		seconds, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid timestamp %q", fields[1])
+		}
+		return fmt.Sprintf("%s %s %d", series, fields[0], int64(math.Round(seconds*1000))), nil
+	default:
+		return "", fmt.Errorf("expected a value and an optional timestamp, found %q", rest)
+	}
+}
@@ -0,0 +1,72 @@
+package memory
+
+import "fmt"
+
+// base32768Ranges are the characters of qntm's base32768 that hold 15 bits,
+// as inclusive ranges. A character holds its index across the ranges.
+var base32768Ranges = [][2]rune{
+	{0x04a0, 0x04bf}, {0x0500, 0x051f}, {0x0680, 0x06bf}, {0x0760, 0x079f},
+	{0x07c0, 0x07df}, {0x1000, 0x101f}, {0x10a0, 0x10bf}, {0x1100, 0x115f},
+	{0x1180, 0x119f}, {0x11e0, 0x123f}, {0x1260, 0x127f}, {0x12e0, 0x12ff},
+	{0x1320, 0x133f}, {0x13a0, 0x13df}, {0x1420, 0x165f}, {0x16a0, 0x16df},
+	{0x1780, 0x179f}, {0x1820, 0x185f}, {0x18c0, 0x18df}, {0x1980, 0x199f},
+	{0x19e0, 0x19ff}, {0x1a20, 0x1a3f}, {0x1bc0, 0x1bdf}, {0x1c00, 0x1c1f},
+	{0x1d00, 0x1d1f}, {0x21e0, 0x21ff}, {0x22c0, 0x22df}, {0x2340, 0x23df},
+	{0x2400, 0x241f}, {0x2500, 0x275f}, {0x2780, 0x27bf}, {0x2800, 0x297f},
+	{0x29a0, 0x29bf}, {0x2a20, 0x2a5f}, {0x2a80, 0x2abf}, {0x2ae0, 0x2b5f},
+	{0x2c00, 0x2c1f}, {0x2c80, 0x2cdf}, {0x2d00, 0x2d1f}, {0x2d40, 0x2d5f},
+	{0x2ea0, 0x2edf}, {0x31c0, 0x31df}, {0x3400, 0x4d9f}, {0x4dc0, 0x9fbf},
+	{0xa000, 0xa47f}, {0xa4a0, 0xa4bf}, {0xa500, 0xa5ff}, {0xa640, 0xa65f},
+	{0xa6a0, 0xa6df}, {0xa700, 0xa75f}, {0xa780, 0xa79f}, {0xa840, 0xa85f},
+}
+
+// base32768ShortRanges are the characters that hold 7 bits, which only the
+// last character of a segment can be.
+var base32768ShortRanges = [][2]rune{{0x0180, 0x019f}, {0x0240, 0x029f}}
+
+// decodeBase32768 decodes qntm's base32768, where each character holds 15
+// bits, most significant first, and the unused bits at the end are ones.
+func decodeBase32768(segment string, maxSize int) ([]byte, error) {
+	runes := []rune(segment)
+	var out []byte
+	// acc has the n bits read but not written yet.
+	acc, n := 0, 0
+	for i, r := range runes {
+		v, bits := base32768Value(r, base32768Ranges), 15
+		if v < 0 {
+			v, bits = base32768Value(r, base32768ShortRanges), 7
+			if v < 0 {
+				return nil, fmt.Errorf("invalid character %q at %d", r, i)
+			}
+			if i != len(runes)-1 {
+				return nil, fmt.Errorf("7 bit character %q at %d before the end", r, i)
+			}
+		}
+
+		acc, n = acc<<bits|v, n+bits
+		for n >= 8 {
+			n -= 8
+			if len(out) >= maxSize {
+				return nil, fmt.Errorf("%w: more than %d bytes", ErrTooLarge, maxSize)
+			}
+			out = append(out, byte(acc>>n))
+		}
+		acc &= 1<<n - 1
+	}
+	if acc != 1<<n-1 {
+		return nil, fmt.Errorf("invalid padding")
+	}
+	return out, nil
+}
+
+// base32768Value is the index of r across ranges, or -1 if it is in none.
+func base32768Value(r rune, ranges [][2]rune) int {
+	offset := 0
+	for _, rg := range ranges {
+		if r >= rg[0] && r <= rg[1] {
+			return offset + int(r-rg[0])
+		}
+		offset += int(rg[1]-rg[0]) + 1
+	}
+	return -1
+}
@@ -0,0 +1,195 @@
+package memory
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Names of the built in encodings.
+const (
+	// EncodingAuto detects the encoding of each segment, falling back to
+	// EncodingNone.
+	EncodingAuto = "auto"
+	// EncodingNone is a segment as the bot wrote it.
+	EncodingNone = "none"
+	// EncodingGzip is base64 gzip prefixed with "gz:".
+	EncodingGzip = "gz"
+	// EncodingLZString is LZString.compressToUTF16.
+	EncodingLZString = "lz-string"
+	// EncodingLZStringBase64 is LZString.compressToBase64.
+	EncodingLZStringBase64 = "lz-string-base64"
+	// EncodingLZStringURI is LZString.compressToEncodedURIComponent.
+	EncodingLZStringURI = "lz-string-uri"
+	// EncodingBase32768 is qntm's base32768, which packs 15 bits in each
+	// character.
+	EncodingBase32768 = "base32768"
+)
+
+// DefaultMaxSize is the most bytes a segment decodes to unless set otherwise.
+// A segment is at most 100KB, but a compressed one can decode to far more.
+const DefaultMaxSize = 8 << 20
+
+// ErrTooLarge is returned when a segment decodes to more than the max size.
+var ErrTooLarge = errors.New("decoded segment is too large")
+
+// Encoding is a way bots encode segments to fit more in them.
+type Encoding struct {
+	Name string
+	// Detect returns true if the segment looks like it has the encoding. Nil
+	// if the encoding is only used when configured.
+	Detect func(segment string) bool
+	// Decode decodes the segment, failing with ErrTooLarge if it decodes
+	// to more than maxSize bytes.
+	Decode func(segment string, maxSize int) ([]byte, error)
+}
+
+var (
+	encodingsMu sync.RWMutex
+	// encodings are detected in order.
+	encodings = []Encoding{
+		{Name: EncodingGzip, Detect: isGzip, Decode: decodeGzip},
+		{Name: EncodingLZString, Detect: isLZStringUTF16, Decode: decodeLZStringUTF16},
+		{Name: EncodingLZStringBase64, Decode: decodeLZStringBase64},
+		{Name: EncodingLZStringURI, Decode: decodeLZStringURI},
+		{Name: EncodingBase32768, Decode: decodeBase32768},
+		{Name: EncodingNone, Decode: decodeNone},
+	}
+)
+
+// Register adds an encoding, or replaces the one with the same name.
+// Encodings that detect segments are tried after the built in ones. The
+// returned func removes the encoding again, or restores the one it replaced.
+func Register(e Encoding) (unregister func()) {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+	for i := range encodings {
+		if encodings[i].Name == e.Name {
+			replaced := encodings[i]
+			encodings[i] = e
+			return func() { restoreEncoding(replaced) }
+		}
+	}
+	encodings = append(encodings, e)
+	return func() { removeEncoding(e.Name) }
+}
+
+func restoreEncoding(e Encoding) {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+	for i := range encodings {
+		if encodings[i].Name == e.Name {
+			encodings[i] = e
+			return
+		}
+	}
+}
+
+func removeEncoding(name string) {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+	encodings = slices.DeleteFunc(encodings, func(e Encoding) bool {
+		return e.Name == name
+	})
+}
+
+// Encodings are the names of the registered encodings, and EncodingAuto.
+func Encodings() []string {
+	encodingsMu.RLock()
+	defer encodingsMu.RUnlock()
+	names := []string{EncodingAuto}
+	for _, e := range encodings {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+// DecodeOptions choose how segments are decoded.
+type DecodeOptions struct {
+	// Encoding is the name of a registered encoding, EncodingAuto if empty.
+	Encoding string
+	// MaxSize is the most bytes a segment decodes to, DefaultMaxSize if 0.
+	MaxSize int
+}
+
+// encoding finds the encoding of a segment.
+func (o DecodeOptions) encoding(segment string) (Encoding, error) {
+	encodingsMu.RLock()
+	defer encodingsMu.RUnlock()
+	name := o.Encoding
+	if name == "" || name == EncodingAuto {
+		for _, e := range encodings {
+			if e.Detect != nil && e.Detect(segment) {
+				return e, nil
+			}
+		}
+		name = EncodingNone
+	}
+	for _, e := range encodings {
+		if e.Name == name {
+			return e, nil
+		}
+	}
+	return Encoding{}, fmt.Errorf("unknown encoding %q", name)
+}
+
+func isGzip(segment string) bool {
+	return strings.HasPrefix(segment, "gz:")
+}
+
+func decodeGzip(segment string, maxSize int) ([]byte, error) {
+	segment = strings.TrimPrefix(segment, "gz:")
+	decoded := base64.NewDecoder(base64.StdEncoding, strings.NewReader(segment))
+	r, err := gzip.NewReader(decoded)
+	if err != nil {
+		return nil, fmt.Errorf("new gzip reader: %w", err)
+	}
+
+	all, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, fmt.Errorf("read all: %w", err)
+	}
+	if len(all) > maxSize {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrTooLarge, maxSize)
+	}
+	return all, nil
+}
+
+// isLZStringUTF16 detects compressToUTF16, which only writes characters from
+// U+0020 to U+801F, each 15 bits offset by 32, and ends with a space. JSON and
+// text segments end with "}" or a newline, and rarely have characters past
+// ASCII. Text can still pass those checks, so the segment must also decode to
+// something.
+func isLZStringUTF16(segment string) bool {
+	if !strings.HasSuffix(segment, " ") {
+		return false
+	}
+	wide := false
+	for _, r := range segment {
+		if r < 0x20 || r > 0x801f {
+			return false
+		}
+		wide = wide || r > 0x7e
+	}
+	if !wide {
+		return false
+	}
+	decoded, err := decodeLZStringUTF16(segment, DefaultMaxSize)
+	if errors.Is(err, ErrTooLarge) {
+		// It is lz-string, decoding it reports the real limit.
+		return true
+	}
+	return err == nil && len(decoded) > 0
+}
+
+func decodeNone(segment string, maxSize int) ([]byte, error) {
+	if len(segment) > maxSize {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrTooLarge, maxSize)
+	}
+	return []byte(segment), nil
+}
@@ -0,0 +1,152 @@
+package memory_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/Emyrk/screeps-watcher/watch/memory"
+	"github.com/stretchr/testify/require"
+)
+
+// Compressed with lz-string 1.4.4.
+const (
+	lzPlain  = `{"cpu":{"used":12.5,"bucket":10000},"rooms":{"W1N1":{"energy":300},"W2N2":{"energy":300}},"name":"ünïcode ✓"}`
+	lzUTF16  = "\u1be1\u0851\u403c\u0b02\u0305\u142c\u7049\u4046\u3831\u4046\u0108\u0580\u0362C\u1480\u06d6\u202b\u5320\u0d16\u6837\u6460\u2721\u768c\u05d4\u2748\u01f4\u1821\u6452\u78a6\u2027\u3662\u603c\u6033\u6720\u19be\u59a8\u1f4c\u4179\u2245\u25ec\u2e72\u5e40\u10f3\u593c\u0820\u2011\u0117\u308d\u29b02\u0343\u4862\u1920 "
+	lzBase64 = "N4IgxgDgriBcpQM4FMAmcCMAmAdAVgBoQAjKMAa2QBdMAGe2gXyICcB7NgW0TlAHUMAOQy8QyAHbIWAcwCecAMz1mIPlkFZREqXMXKV4gIadkcEAB/xAe7BtUyAASBkchCMgA==="
+	lzURI    = "N4IgxgDgriBcpQM4FMAmcCMAmAdAVgBoQAjKMAa2QBdMAGe2gXyICcB7NgW0TlAHUMAOQy8QyAHbIWAcwCecAMz1mIPlkFZREqXMXKV4gIadkcEAB-xAe7BtUyAASBkchCMgA"
+	// Encoded with github.com/Max-Sum/base32768, which has the characters of
+	// qntm's base32768.
+	base32768 = "\u63f1\u3f1c\u34e4\u49e7\u7f73\u7c2d\u7128\u487a\u3ed9\u29ad\u4bc4\u4c67\u517b\u53f5\u8ea4\u6091\u3e58\u2aac\u35e5\u6887\u39bb\u6415\u8ca4\u60db\u376b\u72b3\u6c84\u49e7\u7f73\u3bf9\u7144\u8dd9\u375d\u2c8c\u1bcf\u7922\u38f9\u6f98\u8aa4\u60db\u3772\u81f9\u54ac\u9df2\u3811\u7320\u875a\ua3cc\u3777\u3e9b\u5304\u49e2\u3c5d\u981b\u241e\u89cf\u5892\u6e98\u79f2\u5887\u028f"
+	// 2000 times "a".
+	lzBomb = "IY18ZXTt/DFOS1b0c17Pd/wYUcSaWeRZVdTbXfQ408y62+x519z73/wMZA=="
+)
+
+func response(t *testing.T, segment string) []byte {
+	data, err := json.Marshal(map[string]any{"ok": 1, "data": segment})
+	require.NoError(t, err)
+	return data
+}
+
+func TestDecodeEncodings(t *testing.T) {
+	for encoding, segment := range map[string]string{
+		memory.EncodingAuto:           lzUTF16,
+		memory.EncodingLZString:       lzUTF16,
+		memory.EncodingLZStringBase64: lzBase64,
+		memory.EncodingLZStringURI:    lzURI,
+		memory.EncodingBase32768:      base32768,
+		memory.EncodingNone:           lzPlain,
+	} {
+		decoded, err := memory.Decode(response(t, segment), memory.DecodeOptions{Encoding: encoding})
+		require.NoError(t, err, encoding)
+		require.Equal(t, lzPlain, string(decoded), encoding)
+	}
+
+	// Plain segments are not mistaken for compressed ones.
+	for _, plain := range []string{"cpu 1 ", "ünïcode ✓ ", "ログ 名前 ", "㐀 "} {
+		decoded, err := memory.Decode(response(t, plain), memory.DecodeOptions{})
+		require.NoError(t, err, plain)
+		require.Equal(t, plain, string(decoded), plain)
+	}
+
+	_, err := memory.Decode(response(t, lzPlain), memory.DecodeOptions{Encoding: "base65536"})
+	require.ErrorContains(t, err, `unknown encoding "base65536"`)
+}
+
+func TestDecodeBase32768(t *testing.T) {
+	opts := memory.DecodeOptions{Encoding: memory.EncodingBase32768}
+	for segment, want := range map[string]string{
+		"\u575f":       "a",
+		"\u5711\u025f": "ab",
+		"\u5711\u3f19\u2c0c\u8cd6\u69ab\u500d\u7f3a\u94cf": "abcdefghijklmno",
+	} {
+		decoded, err := memory.Decode(response(t, segment), opts)
+		require.NoError(t, err, want)
+		require.Equal(t, want, string(decoded), want)
+	}
+
+	for segment, want := range map[string]string{
+		"\u5711a":      `invalid character 'a' at 1`,
+		"\u025f\u5711": `7 bit character 'ɟ' at 0 before the end`,
+		"\u5700":       "invalid padding",
+	} {
+		_, err := memory.Decode(response(t, segment), opts)
+		require.ErrorContains(t, err, want)
+	}
+}
+
+func TestDecodeMaxSize(t *testing.T) {
+	decoded, err := memory.Decode(response(t, lzBomb), memory.DecodeOptions{Encoding: memory.EncodingLZStringBase64})
+	require.NoError(t, err)
+	require.Equal(t, strings.Repeat("a", 2000), string(decoded))
+
+	_, err = memory.Decode(response(t, lzBomb), memory.DecodeOptions{Encoding: memory.EncodingLZStringBase64, MaxSize: 1000})
+	require.ErrorIs(t, err, memory.ErrTooLarge)
+
+	_, err = memory.Decode(response(t, gzipped(t, strings.Repeat("a", 2000))), memory.DecodeOptions{MaxSize: 1000})
+	require.ErrorIs(t, err, memory.ErrTooLarge)
+
+	// The max size is in bytes, not in the characters of lzPlain.
+	for encoding, segment := range map[string]string{
+		memory.EncodingLZString:       lzUTF16,
+		memory.EncodingLZStringBase64: lzBase64,
+		memory.EncodingLZStringURI:    lzURI,
+		memory.EncodingBase32768:      base32768,
+	} {
+		decoded, err := memory.Decode(response(t, segment), memory.DecodeOptions{Encoding: encoding, MaxSize: len(lzPlain)})
+		require.NoError(t, err, encoding)
+		require.Equal(t, lzPlain, string(decoded), encoding)
+
+		_, err = memory.Decode(response(t, segment), memory.DecodeOptions{Encoding: encoding, MaxSize: len(lzPlain) - 1})
+		require.ErrorIs(t, err, memory.ErrTooLarge, encoding)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	unregister := memory.Register(memory.Encoding{
+		Name: "reverse",
+		Detect: func(segment string) bool {
+			return strings.HasPrefix(segment, "rev:")
+		},
+		Decode: func(segment string, maxSize int) ([]byte, error) {
+			out := []byte(strings.TrimPrefix(segment, "rev:"))
+			for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+				out[i], out[j] = out[j], out[i]
+			}
+			return out, nil
+		},
+	})
+	t.Cleanup(unregister)
+	require.Contains(t, memory.Encodings(), "reverse")
+
+	decoded, err := memory.Decode(response(t, "rev:}{"), memory.DecodeOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "{}", string(decoded))
+
+	// Replacing a built in encoding is undone too.
+	restore := memory.Register(memory.Encoding{
+		Name: memory.EncodingNone,
+		Decode: func(segment string, maxSize int) ([]byte, error) {
+			return []byte("replaced"), nil
+		},
+	})
+	decoded, err = memory.Decode(response(t, "cpu 1"), memory.DecodeOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "replaced", string(decoded))
+	restore()
+	decoded, err = memory.Decode(response(t, "cpu 1"), memory.DecodeOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "cpu 1", string(decoded))
+}
+
+func TestUnregister(t *testing.T) {
+	unregister := memory.Register(memory.Encoding{
+		Name: "drop",
+		Decode: func(segment string, maxSize int) ([]byte, error) {
+			return nil, nil
+		},
+	})
+	require.Contains(t, memory.Encodings(), "drop")
+	unregister()
+	require.NotContains(t, memory.Encodings(), "drop")
+}
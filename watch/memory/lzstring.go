@@ -0,0 +1,174 @@
+package memory
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// Alphabets of the lz-string base64 and URI safe variants.
+const (
+	lzBase64Alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/="
+	lzURIAlphabet    = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+-$"
+)
+
+// decodeLZStringUTF16 decodes LZString.compressToUTF16, where each character
+// holds 15 bits offset by 32.
+func decodeLZStringUTF16(segment string, maxSize int) ([]byte, error) {
+	units := utf16.Encode([]rune(segment))
+	return lzDecompress(len(units), 16384, func(i int) int {
+		if i >= len(units) {
+			return 0
+		}
+		return int(units[i]) - 32
+	}, maxSize)
+}
+
+// decodeLZStringBase64 decodes LZString.compressToBase64.
+func decodeLZStringBase64(segment string, maxSize int) ([]byte, error) {
+	return lzDecodeAlphabet(segment, lzBase64Alphabet, maxSize)
+}
+
+// decodeLZStringURI decodes LZString.compressToEncodedURIComponent.
+func decodeLZStringURI(segment string, maxSize int) ([]byte, error) {
+	// Spaces are what a URI decoder makes of "+".
+	return lzDecodeAlphabet(strings.ReplaceAll(segment, " ", "+"), lzURIAlphabet, maxSize)
+}
+
+// lzDecodeAlphabet decodes the variants where each character holds 6 bits.
+func lzDecodeAlphabet(segment, alphabet string, maxSize int) ([]byte, error) {
+	var values [256]int8
+	for i := range values {
+		values[i] = -1
+	}
+	for i := 0; i < len(alphabet); i++ {
+		values[alphabet[i]] = int8(i)
+	}
+	for i := 0; i < len(segment); i++ {
+		if values[segment[i]] < 0 {
+			return nil, fmt.Errorf("invalid character %q at %d", segment[i], i)
+		}
+	}
+	return lzDecompress(len(segment), 32, func(i int) int {
+		if i >= len(segment) {
+			return 0
+		}
+		return int(values[segment[i]])
+	}, maxSize)
+}
+
+// lzDecompress is the decompressor shared by the lz-string variants. Values
+// are read resetValue bits at a time, and the result is UTF-16 like the
+// JavaScript strings it was compressed from.
+func lzDecompress(length, resetValue int, next func(i int) int, maxSize int) ([]byte, error) {
+	if length == 0 {
+		return nil, fmt.Errorf("empty data")
+	}
+
+	val, position, index := next(0), resetValue, 1
+	bits := func(n int) int {
+		out := 0
+		for power := 0; power < n; power++ {
+			if val&position > 0 {
+				out |= 1 << power
+			}
+			position >>= 1
+			if position == 0 {
+				position = resetValue
+				val = next(index)
+				index++
+			}
+		}
+		return out
+	}
+
+	// Entries 0 to 2 are the codes for an 8 bit character, a 16 bit
+	// character and the end of the data.
+	dictionary := make([][]uint16, 3, 1024)
+	enlargeIn, numBits := 4, 3
+	var result []uint16
+	// size is the length of the result in UTF-8, which maxSize is in.
+	size := 0
+
+	var w []uint16
+	switch bits(2) {
+	case 0:
+		w = []uint16{uint16(bits(8))}
+	case 1:
+		w = []uint16{uint16(bits(16))}
+	case 2:
+		return []byte{}, nil
+	default:
+		return nil, fmt.Errorf("invalid first code")
+	}
+	dictionary = append(dictionary, w)
+	result = append(result, w...)
+	size += utf8Len(w)
+
+	for {
+		if index > length {
+			return nil, fmt.Errorf("unexpected end of data")
+		}
+		c := bits(numBits)
+		switch c {
+		case 0, 1:
+			size := 8
+			if c == 1 {
+				size = 16
+			}
+			dictionary = append(dictionary, []uint16{uint16(bits(size))})
+			c = len(dictionary) - 1
+			enlargeIn--
+		case 2:
+			out := []byte(string(utf16.Decode(result)))
+			if len(out) > maxSize {
+				return nil, fmt.Errorf("%w: more than %d bytes", ErrTooLarge, maxSize)
+			}
+			return out, nil
+		}
+		if enlargeIn == 0 {
+			enlargeIn = 1 << numBits
+			numBits++
+		}
+
+		var entry []uint16
+		switch {
+		case c < len(dictionary):
+			entry = dictionary[c]
+		case c == len(dictionary):
+			entry = append(w[:len(w):len(w)], w[0])
+		default:
+			return nil, fmt.Errorf("invalid code %d", c)
+		}
+		result = append(result, entry...)
+		size += utf8Len(entry)
+		if size > maxSize {
+			return nil, fmt.Errorf("%w: more than %d bytes", ErrTooLarge, maxSize)
+		}
+
+		dictionary = append(dictionary, append(w[:len(w):len(w)], entry[0]))
+		enlargeIn--
+		w = entry
+		if enlargeIn == 0 {
+			enlargeIn = 1 << numBits
+			numBits++
+		}
+	}
+}
+
+// utf8Len is the length of UTF-16 code units in UTF-8. Each half of a
+// surrogate pair is 2 of the 4 bytes of the pair.
+func utf8Len(units []uint16) int {
+	n := 0
+	for _, u := range units {
+		switch {
+		case u < 0x80:
+			n++
+		case u < 0x800, utf16.IsSurrogate(rune(u)):
+			n += 2
+		default:
+			n += 3
+		}
+	}
+	return n
+}
@@ -0,0 +1,107 @@
+package memory
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// TickKey is the reserved top level key a bot writes the game tick to. When
+// a document is split across segments, every segment must have the same
+// tick, or the segments were written in different ticks.
+const TickKey = "__tick"
+
+// HistoryKey is the reserved top level key of a ring buffer of samples from
+// earlier ticks. Each entry is a document of its own, with a TickKey and a
+// TimeKey.
+const HistoryKey = "__history"
+
+// TypeKey declares the type of every metric in an object: gauge, counter,
+// histogram or summary. Metrics are gauges unless declared otherwise.
+const TypeKey = "__type"
+
+// MetaKey is the reserved top level key of metric metadata, a help text and
+// a unit for each metric name. It only has to be written now and then, the
+// watcher remembers it.
+const MetaKey = "__meta"
+
+// TimeKey is the unix time in milliseconds a history entry was written at.
+const TimeKey = "__time"
+
+// ErrTornRead is returned when segments were written in different ticks.
+var ErrTornRead = errors.New("segments written in different ticks")
+
+// Merge combines segments into a single json document. Objects are merged
+// recursively, arrays are concatenated, and for anything else the later
+// segment wins. If any object segment has a TickKey, all of them must have the
+// same one. The merged document keeps the TickKey. Segments in a text format,
+// like Prometheus text, are joined line by line instead.
+func Merge(segments [][]byte) ([]byte, error) {
+	if len(segments) > 0 && !isJSON(segments[0]) {
+		return bytes.Join(segments, []byte("\n")), nil
+	}
+
+	var merged any
+	var tick json.Number
+	for i, segment := range segments {
+		dec := json.NewDecoder(bytes.NewReader(segment))
+		// Keep numbers exactly as the bot wrote them.
+		dec.UseNumber()
+		var doc any
+		err := dec.Decode(&doc)
+		if err != nil {
+			return nil, fmt.Errorf("segment %d: %w", i, err)
+		}
+
+		if obj, ok := doc.(map[string]any); ok {
+			t, _ := obj[TickKey].(json.Number)
+			if i > 0 && t != tick {
+				return nil, fmt.Errorf("%w: %q != %q", ErrTornRead, tick, t)
+			}
+			tick = t
+		} else if tick != "" {
+			return nil, fmt.Errorf("%w: segment %d has no tick", ErrTornRead, i)
+		}
+
+		if i == 0 {
+			merged = doc
+			continue
+		}
+		merged = merge(merged, doc)
+	}
+
+	return json.Marshal(merged)
+}
+
+// isJSON is whether a segment holds a JSON document rather than text.
+func isJSON(segment []byte) bool {
+	segment = bytes.TrimSpace(segment)
+	return len(segment) > 0 && (segment[0] == '{' || segment[0] == '[')
+}
+
+func merge(dst, src any) any {
+	switch s := src.(type) {
+	case map[string]any:
+		d, ok := dst.(map[string]any)
+		if !ok {
+			return src
+		}
+		for k, v := range s {
+			if existing, ok := d[k]; ok {
+				d[k] = merge(existing, v)
+				continue
+			}
+			d[k] = v
+		}
+		return d
+	case []any:
+		d, ok := dst.([]any)
+		if !ok {
+			return src
+		}
+		return append(d, s...)
+	default:
+		return src
+	}
+}
@@ -0,0 +1,68 @@
+package memory_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"testing"
+
+	"github.com/Emyrk/screeps-watcher/watch/memory"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMerge(t *testing.T) {
+	merged, err := memory.Merge([][]byte{
+		[]byte(`{"__tick": 100, "room{room=W1N1}": {"energy": 10}, "cpu": {"bucket": 1000}}`),
+		[]byte(`{"__tick": 100, "room{room=W1N1}": {"level": 8}, "gcl": 12345678901234567}`),
+	})
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"__tick": 100,
+		"room{room=W1N1}": {"energy": 10, "level": 8},
+		"cpu": {"bucket": 1000},
+		"gcl": 12345678901234567
+	}`, string(merged))
+
+	merged, err = memory.Merge([][]byte{[]byte(`[{"key": "a"}]`), []byte(`[{"key": "b"}]`)})
+	require.NoError(t, err)
+	require.JSONEq(t, `[{"key": "a"}, {"key": "b"}]`, string(merged))
+
+	merged, err = memory.Merge([][]byte{[]byte("# TYPE cpu gauge\ncpu 1"), []byte("gcl 2\n")})
+	require.NoError(t, err)
+	require.Equal(t, "# TYPE cpu gauge\ncpu 1\ngcl 2\n", string(merged))
+}
+
+func TestMergeTornRead(t *testing.T) {
+	_, err := memory.Merge([][]byte{
+		[]byte(`{"__tick": 100, "a": 1}`),
+		[]byte(`{"__tick": 101, "b": 1}`),
+	})
+	require.ErrorIs(t, err, memory.ErrTornRead)
+
+	_, err = memory.Merge([][]byte{
+		[]byte(`{"__tick": 100, "a": 1}`),
+		[]byte(`{"b": 1}`),
+	})
+	require.ErrorIs(t, err, memory.ErrTornRead)
+}
+
+func TestDecodeSegments(t *testing.T) {
+	compressed := gzipped(t, `{"b": 2}`)
+
+	segments, err := memory.DecodeSegments([]byte(`{"ok":1,"data":["{\"a\": 1}","`+compressed+`"]}`), memory.DecodeOptions{})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte(`{"a": 1}`), []byte(`{"b": 2}`)}, segments)
+
+	_, err = memory.DecodeSegments([]byte(`{"ok":1,"data":["{}",null]}`), memory.DecodeOptions{})
+	require.ErrorContains(t, err, "segment 1")
+}
+
+// gzipped encodes a segment like bots compressing with gzip do.
+func gzipped(t *testing.T, segment string) string {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write([]byte(segment))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	return "gz:" + base64.StdEncoding.EncodeToString(buf.Bytes())
+}
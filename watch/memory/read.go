@@ -1,49 +1,80 @@
 package memory
 
 import (
-	"compress/gzip"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
-	"strings"
 )
 
 type memoryResponse struct {
-	Data string `json:"data"`
+	Data json.RawMessage `json:"data"`
 }
 
-// Decode the base64 gzipped payload from the memory endpoint.
-func Decode(data []byte) ([]byte, error) {
+// Decode the payload from the memory endpoint, which is encoded if the bot
+// compressed it.
+func Decode(data []byte, opts DecodeOptions) ([]byte, error) {
 	var memResp memoryResponse
 	err := json.Unmarshal(data, &memResp)
 	if err != nil {
 		return nil, fmt.Errorf("unmarshal resp: %w", err)
 	}
 
-	if len(memResp.Data) == 0 {
+	var segment *string
+	err = json.Unmarshal(memResp.Data, &segment)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal data: %w", err)
+	}
+	if segment == nil {
 		return nil, fmt.Errorf("empty data")
 	}
+	return decodeSegment(*segment, opts)
+}
 
-	if len(memResp.Data) < 3 {
-		return []byte(memResp.Data), nil
+// DecodeSegments decodes the payload of the memory endpoint when more than
+// one segment is requested. The segments are returned in the order they were
+// requested.
+func DecodeSegments(data []byte, opts DecodeOptions) ([][]byte, error) {
+	var memResp memoryResponse
+	err := json.Unmarshal(data, &memResp)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal resp: %w", err)
 	}
 
-	if memResp.Data[:3] != "gz:" {
-		return []byte(memResp.Data), nil
+	var segments []*string
+	err = json.Unmarshal(memResp.Data, &segments)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal data: %w", err)
 	}
 
-	memResp.Data = strings.Split(memResp.Data, "gz:")[1]
-	decoded := base64.NewDecoder(base64.StdEncoding, strings.NewReader(memResp.Data))
-	r, err := gzip.NewReader(decoded)
-	if err != nil {
-		return nil, fmt.Errorf("new gzip reader: %w", err)
+	decoded := make([][]byte, 0, len(segments))
+	for i, segment := range segments {
+		if segment == nil {
+			return nil, fmt.Errorf("segment %d: empty data", i)
+		}
+		d, err := decodeSegment(*segment, opts)
+		if err != nil {
+			return nil, fmt.Errorf("segment %d: %w", i, err)
+		}
+		decoded = append(decoded, d)
 	}
+	return decoded, nil
+}
 
-	all, err := io.ReadAll(r)
-	if err != nil {
-		return nil, fmt.Errorf("read all: %w", err)
+func decodeSegment(data string, opts DecodeOptions) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty data")
 	}
 
-	return all, nil
+	e, err := opts.encoding(data)
+	if err != nil {
+		return nil, err
+	}
+	maxSize := opts.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	decoded, err := e.Decode(data, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", e.Name, err)
+	}
+	return decoded, nil
 }
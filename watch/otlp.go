@@ -0,0 +1,60 @@
+package watch
+
+import (
+	"github.com/Emyrk/screeps-watcher/watch/otlp"
+	"github.com/Emyrk/screeps-watcher/watch/profiling"
+	"github.com/Emyrk/screeps-watcher/watch/screepssocket"
+	"github.com/rs/zerolog"
+)
+
+// WithOTLP sends the console logs and profiles of the watcher to the
+// exporter. It must be called before Watch.
+func (w *Watcher) WithOTLP(exporter *otlp.Exporter) *Watcher {
+	w.otlp = exporter
+	for _, target := range w.memoryTargets {
+		target.collector.WithPusher(w.profilePusher(target.Shard))
+	}
+	return w
+}
+
+// resource is the OTLP resource of a shard of the watcher.
+func (w *Watcher) resource(shard string) map[string]string {
+	return map[string]string{
+		"server":   w.Name,
+		"username": w.Username,
+		"shard":    shard,
+	}
+}
+
+func (w *Watcher) exportsOTLP(signal string) bool {
+	return w.otlp != nil && w.otlp.Exports(signal)
+}
+
+// profilePusher returns where the profiles of a shard go, or nil if profiles
+// are not exported at all.
+func (w *Watcher) profilePusher(shard string) profiling.Pusher {
+	pushers := make(profiling.Pushers, 0, 2)
+	if w.pusher != nil {
+		pushers = append(pushers, w.pusher)
+	}
+	if w.exportsOTLP(otlp.SignalProfiles) {
+		pushers = append(pushers, w.otlp.ProfilePusher(w.resource(shard)))
+	}
+
+	switch len(pushers) {
+	case 0:
+		// A nil pointer in the interface would look like a pusher.
+		return nil
+	case 1:
+		return pushers[0]
+	default:
+		return pushers
+	}
+}
+
+// forwardConsoleLogs sends the console logs to the OTLP exporter.
+func (w *Watcher) forwardConsoleLogs() screepssocket.ConsoleLogSink {
+	return func(meta screepssocket.ConsoleLogMeta, level zerolog.Level, msg string) {
+		w.otlp.Log(w.resource(meta.Shard), level, msg)
+	}
+}
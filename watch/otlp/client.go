@@ -0,0 +1,174 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	colprofilespb "go.opentelemetry.io/proto/otlp/collector/profiles/v1experimental"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Paths of each signal on an OTLP/HTTP collector.
+const (
+	metricsPath  = "/v1/metrics"
+	logsPath     = "/v1/logs"
+	profilesPath = "/v1experimental/profiles"
+)
+
+// client sends export requests over a single protocol.
+type client interface {
+	exportMetrics(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error
+	exportLogs(ctx context.Context, req *collogspb.ExportLogsServiceRequest) error
+	exportProfiles(ctx context.Context, req *colprofilespb.ExportProfilesServiceRequest) error
+	close() error
+}
+
+// exportError is an export the collector answered with an error.
+type exportError struct {
+	msg       string
+	retryable bool
+}
+
+func (e *exportError) Error() string {
+	return e.msg
+}
+
+type grpcClient struct {
+	conn     *grpc.ClientConn
+	headers  metadata.MD
+	metrics  colmetricspb.MetricsServiceClient
+	logs     collogspb.LogsServiceClient
+	profiles colprofilespb.ProfilesServiceClient
+}
+
+func newGRPCClient(cfg Config) (*grpcClient, error) {
+	creds := credentials.NewTLS(&tls.Config{})
+	if cfg.Insecure {
+		creds = insecure.NewCredentials()
+	}
+	// The connection is made lazily, so a collector that is down does not
+	// stop the watcher from starting.
+	conn, err := grpc.NewClient(cfg.Endpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("new grpc client: %w", err)
+	}
+	return &grpcClient{
+		conn:     conn,
+		headers:  metadata.New(cfg.Headers),
+		metrics:  colmetricspb.NewMetricsServiceClient(conn),
+		logs:     collogspb.NewLogsServiceClient(conn),
+		profiles: colprofilespb.NewProfilesServiceClient(conn),
+	}, nil
+}
+
+func (c *grpcClient) exportMetrics(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error {
+	_, err := c.metrics.Export(metadata.NewOutgoingContext(ctx, c.headers), req)
+	return grpcError(err)
+}
+
+func (c *grpcClient) exportLogs(ctx context.Context, req *collogspb.ExportLogsServiceRequest) error {
+	_, err := c.logs.Export(metadata.NewOutgoingContext(ctx, c.headers), req)
+	return grpcError(err)
+}
+
+func (c *grpcClient) exportProfiles(ctx context.Context, req *colprofilespb.ExportProfilesServiceRequest) error {
+	_, err := c.profiles.Export(metadata.NewOutgoingContext(ctx, c.headers), req)
+	return grpcError(err)
+}
+
+func (c *grpcClient) close() error {
+	return c.conn.Close()
+}
+
+// grpcError marks the status codes the OTLP spec says to retry.
+func grpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch status.Code(err) {
+	case codes.Canceled, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted,
+		codes.OutOfRange, codes.Unavailable, codes.DataLoss:
+		return &exportError{msg: err.Error(), retryable: true}
+	}
+	return &exportError{msg: err.Error(), retryable: false}
+}
+
+type httpClient struct {
+	endpoint string
+	headers  map[string]string
+	cli      *http.Client
+}
+
+func newHTTPClient(cfg Config) *httpClient {
+	return &httpClient{
+		endpoint: strings.TrimSuffix(cfg.Endpoint, "/"),
+		headers:  cfg.Headers,
+		cli:      &http.Client{},
+	}
+}
+
+func (c *httpClient) exportMetrics(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error {
+	return c.post(ctx, metricsPath, req)
+}
+
+func (c *httpClient) exportLogs(ctx context.Context, req *collogspb.ExportLogsServiceRequest) error {
+	return c.post(ctx, logsPath, req)
+}
+
+func (c *httpClient) exportProfiles(ctx context.Context, req *colprofilespb.ExportProfilesServiceRequest) error {
+	return c.post(ctx, profilesPath, req)
+}
+
+func (c *httpClient) close() error {
+	c.cli.CloseIdleConnections()
+	return nil
+}
+
+func (c *httpClient) post(ctx context.Context, path string, msg proto.Message) error {
+	body, err := proto.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "screeps-watcher")
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.cli.Do(req)
+	if err != nil {
+		return fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	msgBody, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return &exportError{
+		msg: fmt.Sprintf("otlp status %d: %s", resp.StatusCode, bytes.TrimSpace(msgBody)),
+		// The status codes the OTLP spec says to retry.
+		retryable: resp.StatusCode == http.StatusTooManyRequests ||
+			resp.StatusCode == http.StatusBadGateway ||
+			resp.StatusCode == http.StatusServiceUnavailable ||
+			resp.StatusCode == http.StatusGatewayTimeout,
+	}
+}
@@ -0,0 +1,406 @@
+package otlp
+
+import (
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/google/uuid"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	colprofilespb "go.opentelemetry.io/proto/otlp/collector/profiles/v1experimental"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	profilespb "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+)
+
+// ResourceLabels are the metric labels that are moved to the resource.
+var ResourceLabels = []string{"server", "username", "shard"}
+
+const serviceName = "screeps-watcher"
+
+var scope = &commonpb.InstrumentationScope{Name: "github.com/Emyrk/screeps-watcher"}
+
+func stringValue(s string) *commonpb.AnyValue {
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: s}}
+}
+
+// attributes turns a map into key values sorted by key.
+func attributes(m map[string]string) []*commonpb.KeyValue {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	kvs := make([]*commonpb.KeyValue, 0, len(keys))
+	for _, k := range keys {
+		kvs = append(kvs, &commonpb.KeyValue{Key: k, Value: stringValue(m[k])})
+	}
+	return kvs
+}
+
+func newResource(attrs map[string]string) *resourcepb.Resource {
+	withService := map[string]string{"service.name": serviceName}
+	for k, v := range attrs {
+		withService[k] = v
+	}
+	return &resourcepb.Resource{Attributes: attributes(withService)}
+}
+
+// resourceKey identifies a resource by its attributes, to group records of
+// the same resource.
+func resourceKey(attrs map[string]string) string {
+	var b strings.Builder
+	for _, kv := range attributes(attrs) {
+		b.WriteString(kv.Key)
+		b.WriteByte('=')
+		b.WriteString(kv.Value.GetStringValue())
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// groupByResource returns the resource keys in order, and the items of each.
+func groupByResource[T any](items []T, resource func(T) map[string]string) ([]string, map[string][]T) {
+	groups := make(map[string][]T)
+	keys := make([]string, 0)
+	for _, item := range items {
+		key := resourceKey(resource(item))
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], item)
+	}
+	return keys, groups
+}
+
+// metricsRequest turns metric families into OTLP metrics. The server, username
+// and shard labels become resource attributes, the other labels data point
+// attributes. It also returns the number of data points.
+func metricsRequest(families []*dto.MetricFamily, start, now time.Time) (*colmetricspb.ExportMetricsServiceRequest, int) {
+	type resourceMetrics struct {
+		attrs   map[string]string
+		metrics []*metricspb.Metric
+		byName  map[string]*metricspb.Metric
+	}
+	resources := make(map[string]*resourceMetrics)
+	keys := make([]string, 0)
+	points := 0
+
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			res := make(map[string]string)
+			pointAttrs := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				if slices.Contains(ResourceLabels, l.GetName()) {
+					res[l.GetName()] = l.GetValue()
+				} else {
+					pointAttrs[l.GetName()] = l.GetValue()
+				}
+			}
+
+			key := resourceKey(res)
+			rm, ok := resources[key]
+			if !ok {
+				rm = &resourceMetrics{attrs: res, byName: make(map[string]*metricspb.Metric)}
+				resources[key] = rm
+				keys = append(keys, key)
+			}
+			metric, ok := rm.byName[f.GetName()]
+			if !ok {
+				metric = &metricspb.Metric{Name: f.GetName(), Description: f.GetHelp()}
+				rm.byName[f.GetName()] = metric
+				rm.metrics = append(rm.metrics, metric)
+			}
+
+			if addPoint(metric, f.GetType(), m, attributes(pointAttrs), start, now) {
+				points++
+			}
+		}
+	}
+
+	req := &colmetricspb.ExportMetricsServiceRequest{}
+	for _, key := range keys {
+		rm := resources[key]
+		req.ResourceMetrics = append(req.ResourceMetrics, &metricspb.ResourceMetrics{
+			Resource: newResource(rm.attrs),
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Scope:   scope,
+				Metrics: rm.metrics,
+			}},
+		})
+	}
+	return req, points
+}
+
+// addPoint adds the data point of m to the metric, returning false if the
+// type is not supported.
+func addPoint(metric *metricspb.Metric, typ dto.MetricType, m *dto.Metric, attrs []*commonpb.KeyValue, start, now time.Time) bool {
+	at := now
+	if m.TimestampMs != nil {
+		at = time.UnixMilli(m.GetTimestampMs())
+	}
+	number := func(v float64) *metricspb.NumberDataPoint {
+		return &metricspb.NumberDataPoint{
+			Attributes:        attrs,
+			StartTimeUnixNano: uint64(start.UnixNano()),
+			TimeUnixNano:      uint64(at.UnixNano()),
+			Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: v},
+		}
+	}
+
+	switch typ {
+	case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+		v := m.GetGauge().GetValue()
+		if typ == dto.MetricType_UNTYPED {
+			v = m.GetUntyped().GetValue()
+		}
+		if metric.Data == nil {
+			metric.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{}}
+		}
+		g := metric.GetGauge()
+		// Gauges have no start time.
+		p := number(v)
+		p.StartTimeUnixNano = 0
+		g.DataPoints = append(g.DataPoints, p)
+	case dto.MetricType_COUNTER:
+		if metric.Data == nil {
+			metric.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				IsMonotonic:            true,
+			}}
+		}
+		s := metric.GetSum()
+		s.DataPoints = append(s.DataPoints, number(m.GetCounter().GetValue()))
+	case dto.MetricType_HISTOGRAM:
+		if metric.Data == nil {
+			metric.Data = &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			}}
+		}
+		h := m.GetHistogram()
+		sum := h.GetSampleSum()
+		p := &metricspb.HistogramDataPoint{
+			Attributes:        attrs,
+			StartTimeUnixNano: uint64(start.UnixNano()),
+			TimeUnixNano:      uint64(at.UnixNano()),
+			Count:             h.GetSampleCount(),
+			Sum:               &sum,
+		}
+		// Prometheus buckets are cumulative, OTLP buckets are not, and OTLP
+		// has an implicit +Inf bucket.
+		var previous uint64
+		for _, b := range h.GetBucket() {
+			if math.IsInf(b.GetUpperBound(), 1) {
+				continue
+			}
+			p.ExplicitBounds = append(p.ExplicitBounds, b.GetUpperBound())
+			p.BucketCounts = append(p.BucketCounts, b.GetCumulativeCount()-previous)
+			previous = b.GetCumulativeCount()
+		}
+		p.BucketCounts = append(p.BucketCounts, h.GetSampleCount()-previous)
+		metric.GetHistogram().DataPoints = append(metric.GetHistogram().DataPoints, p)
+	case dto.MetricType_SUMMARY:
+		if metric.Data == nil {
+			metric.Data = &metricspb.Metric_Summary{Summary: &metricspb.Summary{}}
+		}
+		s := m.GetSummary()
+		p := &metricspb.SummaryDataPoint{
+			Attributes:        attrs,
+			StartTimeUnixNano: uint64(start.UnixNano()),
+			TimeUnixNano:      uint64(at.UnixNano()),
+			Count:             s.GetSampleCount(),
+			Sum:               s.GetSampleSum(),
+		}
+		for _, q := range s.GetQuantile() {
+			p.QuantileValues = append(p.QuantileValues, &metricspb.SummaryDataPoint_ValueAtQuantile{
+				Quantile: q.GetQuantile(),
+				Value:    q.GetValue(),
+			})
+		}
+		metric.GetSummary().DataPoints = append(metric.GetSummary().DataPoints, p)
+	default:
+		return false
+	}
+	return true
+}
+
+// severity maps the level of a console line to an OTLP severity.
+func severity(level zerolog.Level) logspb.SeverityNumber {
+	switch level {
+	case zerolog.FatalLevel, zerolog.PanicLevel:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_FATAL
+	case zerolog.ErrorLevel:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_ERROR
+	case zerolog.WarnLevel:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_WARN
+	case zerolog.DebugLevel:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_DEBUG
+	case zerolog.TraceLevel:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_TRACE
+	default:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_INFO
+	}
+}
+
+func logRecord(at time.Time, level zerolog.Level, line string) *logspb.LogRecord {
+	sev := severity(level)
+	return &logspb.LogRecord{
+		TimeUnixNano:         uint64(at.UnixNano()),
+		ObservedTimeUnixNano: uint64(at.UnixNano()),
+		SeverityNumber:       sev,
+		// SEVERITY_NUMBER_ERROR is ERROR
+		SeverityText: strings.TrimPrefix(sev.String(), "SEVERITY_NUMBER_"),
+		Body:         stringValue(line),
+	}
+}
+
+func logsRequest(logs []queuedLog) *collogspb.ExportLogsServiceRequest {
+	keys, groups := groupByResource(logs, func(l queuedLog) map[string]string { return l.resource })
+	req := &collogspb.ExportLogsServiceRequest{}
+	for _, key := range keys {
+		group := groups[key]
+		records := make([]*logspb.LogRecord, 0, len(group))
+		for _, l := range group {
+			records = append(records, l.record)
+		}
+		req.ResourceLogs = append(req.ResourceLogs, &logspb.ResourceLogs{
+			Resource: newResource(group[0].resource),
+			ScopeLogs: []*logspb.ScopeLogs{{
+				Scope:      scope,
+				LogRecords: records,
+			}},
+		})
+	}
+	return req
+}
+
+func profilesRequest(profiles []queuedProfile) *colprofilespb.ExportProfilesServiceRequest {
+	keys, groups := groupByResource(profiles, func(p queuedProfile) map[string]string { return p.resource })
+	req := &colprofilespb.ExportProfilesServiceRequest{}
+	for _, key := range keys {
+		group := groups[key]
+		containers := make([]*profilespb.ProfileContainer, 0, len(group))
+		for _, p := range group {
+			containers = append(containers, p.profile)
+		}
+		req.ResourceProfiles = append(req.ResourceProfiles, &profilespb.ResourceProfiles{
+			Resource: newResource(group[0].resource),
+			ScopeProfiles: []*profilespb.ScopeProfiles{{
+				Scope:    scope,
+				Profiles: containers,
+			}},
+		})
+	}
+	return req
+}
+
+// convertProfile turns a pprof profile into an OTLP profile. OTLP profiles
+// refer to locations and functions by their index instead of their id, and
+// keep every string in a string table.
+func convertProfile(p *profile.Profile) *profilespb.ProfileContainer {
+	strs := newStringTable()
+	out := &profilespb.Profile{
+		TimeNanos:     p.TimeNanos,
+		DurationNanos: p.DurationNanos,
+		Period:        p.Period,
+	}
+	for i, st := range p.SampleType {
+		out.SampleType = append(out.SampleType, &profilespb.ValueType{
+			Type: strs.index(st.Type),
+			Unit: strs.index(st.Unit),
+		})
+		if st.Type == p.DefaultSampleType {
+			out.DefaultSampleType = int64(i)
+		}
+	}
+	if p.PeriodType != nil {
+		out.PeriodType = &profilespb.ValueType{
+			Type: strs.index(p.PeriodType.Type),
+			Unit: strs.index(p.PeriodType.Unit),
+		}
+	}
+	for _, c := range p.Comments {
+		out.Comment = append(out.Comment, strs.index(c))
+	}
+
+	functions := make(map[uint64]uint64, len(p.Function))
+	for i, f := range p.Function {
+		functions[f.ID] = uint64(i)
+		out.Function = append(out.Function, &profilespb.Function{
+			Id:         f.ID,
+			Name:       strs.index(f.Name),
+			SystemName: strs.index(f.SystemName),
+			Filename:   strs.index(f.Filename),
+			StartLine:  f.StartLine,
+		})
+	}
+
+	locations := make(map[uint64]uint64, len(p.Location))
+	for i, l := range p.Location {
+		locations[l.ID] = uint64(i)
+		loc := &profilespb.Location{Id: l.ID, Address: l.Address}
+		for _, line := range l.Line {
+			if line.Function == nil {
+				continue
+			}
+			loc.Line = append(loc.Line, &profilespb.Line{
+				FunctionIndex: functions[line.Function.ID],
+				Line:          line.Line,
+			})
+		}
+		out.Location = append(out.Location, loc)
+	}
+
+	for _, s := range p.Sample {
+		sample := &profilespb.Sample{
+			LocationsStartIndex: uint64(len(out.LocationIndices)),
+			LocationsLength:     uint64(len(s.Location)),
+			Value:               s.Value,
+		}
+		for _, l := range s.Location {
+			out.LocationIndices = append(out.LocationIndices, int64(locations[l.ID]))
+		}
+		out.Sample = append(out.Sample, sample)
+	}
+	out.StringTable = strs.strings
+
+	id := uuid.New()
+	return &profilespb.ProfileContainer{
+		ProfileId:         id[:],
+		StartTimeUnixNano: uint64(p.TimeNanos),
+		EndTimeUnixNano:   uint64(p.TimeNanos + p.DurationNanos),
+		Profile:           out,
+	}
+}
+
+type stringTable struct {
+	strings []string
+	indexes map[string]int64
+}
+
+// newStringTable starts with the empty string, which has to be at index 0.
+func newStringTable() *stringTable {
+	return &stringTable{
+		strings: []string{""},
+		indexes: map[string]int64{"": 0},
+	}
+}
+
+func (t *stringTable) index(s string) int64 {
+	if i, ok := t.indexes[s]; ok {
+		return i
+	}
+	i := int64(len(t.strings))
+	t.strings = append(t.strings, s)
+	t.indexes[s] = i
+	return i
+}
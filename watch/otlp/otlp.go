@@ -0,0 +1,389 @@
+// Package otlp exports metrics, console logs and profiles to an OpenTelemetry
+// collector over OTLP/gRPC or OTLP/HTTP.
+package otlp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Emyrk/screeps-watcher/watch/profiling"
+	"github.com/google/pprof/profile"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	profilespb "go.opentelemetry.io/proto/otlp/profiles/v1experimental"
+)
+
+const (
+	ProtocolGRPC = "grpc"
+	ProtocolHTTP = "http/protobuf"
+)
+
+// Signals that can be exported.
+const (
+	SignalMetrics  = "metrics"
+	SignalLogs     = "logs"
+	SignalProfiles = "profiles"
+)
+
+var Signals = []string{SignalMetrics, SignalLogs, SignalProfiles}
+
+// maxQueuedProfiles is how many profiles are kept while the collector is
+// down. Profiles are much larger than log records.
+const maxQueuedProfiles = 10
+
+type Config struct {
+	// Endpoint is the host:port of the collector for grpc, or its base url
+	// for http, like http://localhost:4318. OTLP export is disabled if
+	// empty.
+	Endpoint string `yaml:"endpoint"`
+	// Protocol is "grpc" or "http/protobuf". Defaults to grpc.
+	Protocol string `yaml:"protocol"`
+	// Insecure connects to a grpc endpoint without TLS.
+	Insecure bool              `yaml:"insecure"`
+	Headers  map[string]string `yaml:"headers"`
+	// Signals are the signals to export. Defaults to all of them.
+	Signals []string `yaml:"signals"`
+	// Interval is how often the metrics are gathered and pushed.
+	Interval time.Duration `yaml:"interval"`
+	// BatchInterval is how often queued logs and profiles are sent.
+	BatchInterval time.Duration `yaml:"batch_interval"`
+	// Timeout of a single export.
+	Timeout time.Duration `yaml:"timeout"`
+	// QueueSize is how many log records are kept while the collector is
+	// down. The oldest records are dropped when the queue is full.
+	QueueSize int `yaml:"queue_size"`
+}
+
+func (c Config) withDefaults() Config {
+	if c.Protocol == "" {
+		c.Protocol = ProtocolGRPC
+	}
+	if len(c.Signals) == 0 {
+		c.Signals = Signals
+	}
+	if c.Interval == 0 {
+		c.Interval = time.Minute
+	}
+	if c.BatchInterval == 0 {
+		c.BatchInterval = time.Second * 5
+	}
+	if c.Timeout == 0 {
+		c.Timeout = time.Second * 10
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = 10000
+	}
+	return c
+}
+
+// ValidateEndpoint returns an error if the endpoint does not fit the protocol.
+func ValidateEndpoint(protocol, endpoint string) error {
+	switch protocol {
+	case "", ProtocolGRPC:
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			return fmt.Errorf("grpc endpoint %q must be host:port", endpoint)
+		}
+	case ProtocolHTTP:
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("http endpoint %q must be an http:// or https:// url", endpoint)
+		}
+	default:
+		return fmt.Errorf("unknown protocol %q, must be %q or %q", protocol, ProtocolGRPC, ProtocolHTTP)
+	}
+	return nil
+}
+
+// queuedLog is a log record waiting to be sent, with the attributes of the
+// resource it came from.
+type queuedLog struct {
+	resource map[string]string
+	record   *logspb.LogRecord
+}
+
+type queuedProfile struct {
+	resource map[string]string
+	profile  *profilespb.ProfileContainer
+}
+
+var _ prometheus.Collector = (*Exporter)(nil)
+
+// Exporter periodically pushes the gathered metrics, and sends the console
+// logs and profiles given to it in batches. Metrics that fail to push are not
+// retried, the next push has newer values. Logs and profiles that fail with a
+// retryable error are kept for the next batch.
+type Exporter struct {
+	cfg      Config
+	gatherer prometheus.Gatherer
+	client   client
+	logger   zerolog.Logger
+	now      func() time.Time
+	// start is the start time of every cumulative metric.
+	start time.Time
+
+	logs     queue[queuedLog]
+	profiles queue[queuedProfile]
+
+	sent     *prometheus.CounterVec
+	failures *prometheus.CounterVec
+	dropped  *prometheus.CounterVec
+}
+
+func New(cfg Config, gatherer prometheus.Gatherer, logger zerolog.Logger) (*Exporter, error) {
+	cfg = cfg.withDefaults()
+	if err := ValidateEndpoint(cfg.Protocol, cfg.Endpoint); err != nil {
+		return nil, err
+	}
+	for _, signal := range cfg.Signals {
+		if !slices.Contains(Signals, signal) {
+			return nil, fmt.Errorf("unknown otlp signal %q", signal)
+		}
+	}
+
+	var cli client
+	var err error
+	switch cfg.Protocol {
+	case ProtocolGRPC:
+		cli, err = newGRPCClient(cfg)
+	case ProtocolHTTP:
+		cli = newHTTPClient(cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Exporter{
+		cfg:      cfg,
+		gatherer: gatherer,
+		client:   cli,
+		logger:   logger.With().Str("endpoint", cfg.Endpoint).Logger(),
+		now:      time.Now,
+		sent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "screeps",
+			Subsystem: "otlp",
+			Name:      "sent_total",
+			Help:      "Data points, log records and profiles sent to the OTLP collector.",
+		}, []string{"signal"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "screeps",
+			Subsystem: "otlp",
+			Name:      "failures_total",
+			Help:      "Failed exports to the OTLP collector.",
+		}, []string{"signal"}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "screeps",
+			Subsystem: "otlp",
+			Name:      "dropped_total",
+			Help:      "Log records and profiles dropped because the queue was full or the collector rejected them.",
+		}, []string{"signal"}),
+	}
+	e.start = e.now()
+	e.logs = queue[queuedLog]{size: cfg.QueueSize, dropped: e.dropped.WithLabelValues(SignalLogs)}
+	e.profiles = queue[queuedProfile]{size: maxQueuedProfiles, dropped: e.dropped.WithLabelValues(SignalProfiles)}
+	return e, nil
+}
+
+func (e *Exporter) SetNow(f func() time.Time) {
+	e.now = f
+	e.start = f()
+}
+
+// Exports is true if the signal is exported.
+func (e *Exporter) Exports(signal string) bool {
+	return slices.Contains(e.cfg.Signals, signal)
+}
+
+// Run pushes metrics and sends batches until ctx is canceled. Before
+// returning, it sends everything still queued.
+func (e *Exporter) Run(ctx context.Context) {
+	metrics := time.NewTicker(e.cfg.Interval)
+	defer metrics.Stop()
+	batches := time.NewTicker(e.cfg.BatchInterval)
+	defer batches.Stop()
+
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), e.cfg.Timeout)
+			err = errors.Join(e.PushMetrics(flushCtx), e.Flush(flushCtx))
+			cancel()
+			if err != nil {
+				e.logger.Warn().Err(err).Msg("final otlp export failed")
+			}
+			_ = e.client.close()
+			return
+		case <-metrics.C:
+			err = e.PushMetrics(ctx)
+		case <-batches.C:
+			err = e.Flush(ctx)
+		}
+		if err != nil && ctx.Err() == nil {
+			e.logger.Warn().Err(err).Msg("otlp export failed")
+		}
+	}
+}
+
+// PushMetrics gathers the metrics and pushes them.
+func (e *Exporter) PushMetrics(ctx context.Context) error {
+	if !e.Exports(SignalMetrics) {
+		return nil
+	}
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		// Gather returns what it could alongside the error.
+		e.logger.Warn().Err(err).Msg("gather metrics")
+	}
+	req, points := metricsRequest(families, e.start, e.now())
+	if points == 0 {
+		return nil
+	}
+	_, err = e.export(ctx, SignalMetrics, points, func(ctx context.Context) error {
+		return e.client.exportMetrics(ctx, req)
+	})
+	return err
+}
+
+// Log queues a console log line of the resource.
+func (e *Exporter) Log(resource map[string]string, level zerolog.Level, line string) {
+	if !e.Exports(SignalLogs) {
+		return
+	}
+	e.logs.add(queuedLog{
+		resource: resource,
+		record:   logRecord(e.now(), level, line),
+	})
+}
+
+// Profile queues a profile of the resource. The profile is converted right
+// away, so it may be changed after.
+func (e *Exporter) Profile(resource map[string]string, p *profile.Profile) {
+	if !e.Exports(SignalProfiles) {
+		return
+	}
+	e.profiles.add(queuedProfile{
+		resource: resource,
+		profile:  convertProfile(p),
+	})
+}
+
+// ProfilePusher sends the profiles pushed to it as profiles of the resource.
+func (e *Exporter) ProfilePusher(resource map[string]string) profiling.Pusher {
+	return profilePusher{exporter: e, resource: resource}
+}
+
+type profilePusher struct {
+	exporter *Exporter
+	resource map[string]string
+}
+
+// Push ignores the name, the resource identifies the profile.
+func (p profilePusher) Push(_ string, pb *profile.Profile) error {
+	p.exporter.Profile(p.resource, pb)
+	return nil
+}
+
+// Flush sends the queued logs and profiles.
+func (e *Exporter) Flush(ctx context.Context) error {
+	var errs []error
+	if logs := e.logs.take(); len(logs) > 0 {
+		retry, err := e.export(ctx, SignalLogs, len(logs), func(ctx context.Context) error {
+			return e.client.exportLogs(ctx, logsRequest(logs))
+		})
+		if retry {
+			e.logs.requeue(logs)
+		}
+		errs = append(errs, err)
+	}
+	if profiles := e.profiles.take(); len(profiles) > 0 {
+		retry, err := e.export(ctx, SignalProfiles, len(profiles), func(ctx context.Context) error {
+			return e.client.exportProfiles(ctx, profilesRequest(profiles))
+		})
+		if retry {
+			e.profiles.requeue(profiles)
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// export runs a single export and counts its outcome. It returns true if the
+// export failed and can be retried.
+func (e *Exporter) export(ctx context.Context, signal string, count int, do func(ctx context.Context) error) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.cfg.Timeout)
+	defer cancel()
+
+	err := do(ctx)
+	if err == nil {
+		e.sent.WithLabelValues(signal).Add(float64(count))
+		return false, nil
+	}
+	e.failures.WithLabelValues(signal).Inc()
+
+	var eerr *exportError
+	if errors.As(err, &eerr) && !eerr.retryable {
+		if signal != SignalMetrics {
+			e.dropped.WithLabelValues(signal).Add(float64(count))
+		}
+		return false, fmt.Errorf("export %s: %w", signal, err)
+	}
+	return true, fmt.Errorf("export %s: %w", signal, err)
+}
+
+// queue holds records until they are sent. The oldest records are dropped
+// once it is full.
+type queue[T any] struct {
+	mu      sync.Mutex
+	items   []T
+	size    int
+	dropped prometheus.Counter
+}
+
+func (q *queue[T]) add(item T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append(q.items, item)
+	q.trim()
+}
+
+func (q *queue[T]) take() []T {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := q.items
+	q.items = nil
+	return items
+}
+
+// requeue puts items that failed to send back in front of the queue.
+func (q *queue[T]) requeue(items []T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append(items, q.items...)
+	q.trim()
+}
+
+func (q *queue[T]) trim() {
+	if over := len(q.items) - q.size; over > 0 {
+		q.dropped.Add(float64(over))
+		q.items = q.items[over:]
+	}
+}
+
+func (e *Exporter) Describe(descs chan<- *prometheus.Desc) {
+	e.sent.Describe(descs)
+	e.failures.Describe(descs)
+	e.dropped.Describe(descs)
+}
+
+func (e *Exporter) Collect(metrics chan<- prometheus.Metric) {
+	e.sent.Collect(metrics)
+	e.failures.Collect(metrics)
+	e.dropped.Collect(metrics)
+}
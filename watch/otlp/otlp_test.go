@@ -0,0 +1,244 @@
+package otlp_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Emyrk/screeps-watcher/watch/otlp"
+	"github.com/google/pprof/profile"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	colprofilespb "go.opentelemetry.io/proto/otlp/collector/profiles/v1experimental"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector is a stand-in for an OpenTelemetry collector that keeps every
+// request it receives.
+type collector struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+
+	mu       sync.Mutex
+	metrics  []*colmetricspb.ExportMetricsServiceRequest
+	logs     []*collogspb.ExportLogsServiceRequest
+	profiles []*colprofilespb.ExportProfilesServiceRequest
+	// unavailable fails this many requests with a retryable error.
+	unavailable int
+}
+
+func (c *collector) Export(_ context.Context, req *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics = append(c.metrics, req)
+	return &colmetricspb.ExportMetricsServiceResponse{}, nil
+}
+
+// logsServer and profilesServer exist because every service has a method
+// called Export.
+type logsServer struct {
+	collogspb.UnimplementedLogsServiceServer
+	*collector
+}
+
+func (s logsServer) Export(_ context.Context, req *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logs = append(s.logs, req)
+	return &collogspb.ExportLogsServiceResponse{}, nil
+}
+
+type profilesServer struct {
+	colprofilespb.UnimplementedProfilesServiceServer
+	*collector
+}
+
+func (s profilesServer) Export(_ context.Context, req *colprofilespb.ExportProfilesServiceRequest) (*colprofilespb.ExportProfilesServiceResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.profiles = append(s.profiles, req)
+	return &colprofilespb.ExportProfilesServiceResponse{}, nil
+}
+
+func (c *collector) serveGRPC(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := grpc.NewServer()
+	colmetricspb.RegisterMetricsServiceServer(srv, c)
+	collogspb.RegisterLogsServiceServer(srv, logsServer{collector: c})
+	colprofilespb.RegisterProfilesServiceServer(srv, profilesServer{collector: c})
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+func (c *collector) serveHTTP(t *testing.T) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.unavailable > 0 {
+			c.unavailable--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/metrics":
+			req := &colmetricspb.ExportMetricsServiceRequest{}
+			require.NoError(t, proto.Unmarshal(body, req))
+			c.metrics = append(c.metrics, req)
+		case "/v1/logs":
+			req := &collogspb.ExportLogsServiceRequest{}
+			require.NoError(t, proto.Unmarshal(body, req))
+			c.logs = append(c.logs, req)
+		case "/v1experimental/profiles":
+			req := &colprofilespb.ExportProfilesServiceRequest{}
+			require.NoError(t, proto.Unmarshal(body, req))
+			c.profiles = append(c.profiles, req)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func attrs(kvs []*commonpb.KeyValue) map[string]string {
+	m := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		m[kv.GetKey()] = kv.GetValue().GetStringValue()
+	}
+	return m
+}
+
+func TestExport(t *testing.T) {
+	resource := map[string]string{"server": "main", "username": "me", "shard": "shard3"}
+	withService := map[string]string{"server": "main", "username": "me", "shard": "shard3", "service.name": "screeps-watcher"}
+
+	for _, protocol := range []string{otlp.ProtocolGRPC, otlp.ProtocolHTTP} {
+		t.Run(protocol, func(t *testing.T) {
+			c := &collector{}
+			endpoint := c.serveGRPC(t)
+			if protocol == otlp.ProtocolHTTP {
+				endpoint = c.serveHTTP(t)
+			}
+
+			reg := prometheus.NewRegistry()
+			cpu := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Name:        "screeps_memory_cpu_used",
+				Help:        "Metric from screeps memory segment.",
+				ConstLabels: prometheus.Labels{"server": "main", "username": "me", "shard": "shard3"},
+			}, []string{"room"})
+			cpu.WithLabelValues("E11S53").Set(12.5)
+			reg.MustRegister(cpu)
+
+			exporter, err := otlp.New(otlp.Config{
+				Endpoint: endpoint,
+				Protocol: protocol,
+				Insecure: true,
+			}, reg, zerolog.Nop())
+			require.NoError(t, err)
+			now := time.Unix(1700000000, 0)
+			exporter.SetNow(func() time.Time { return now })
+
+			exporter.Log(resource, zerolog.ErrorLevel, "ERR creep stuck")
+			err = exporter.ProfilePusher(resource).Push("screeps_main_shard3", testProfile())
+			require.NoError(t, err)
+
+			ctx := context.Background()
+			require.NoError(t, exporter.PushMetrics(ctx))
+			require.NoError(t, exporter.Flush(ctx))
+
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			require.Len(t, c.metrics, 1)
+			rm := c.metrics[0].GetResourceMetrics()
+			require.Len(t, rm, 1)
+			require.Equal(t, withService, attrs(rm[0].GetResource().GetAttributes()))
+			metric := rm[0].GetScopeMetrics()[0].GetMetrics()[0]
+			require.Equal(t, "screeps_memory_cpu_used", metric.GetName())
+			point := metric.GetGauge().GetDataPoints()[0]
+			require.Equal(t, 12.5, point.GetAsDouble())
+			require.Equal(t, map[string]string{"room": "E11S53"}, attrs(point.GetAttributes()))
+			require.Equal(t, uint64(now.UnixNano()), point.GetTimeUnixNano())
+
+			require.Len(t, c.logs, 1)
+			rl := c.logs[0].GetResourceLogs()[0]
+			require.Equal(t, withService, attrs(rl.GetResource().GetAttributes()))
+			record := rl.GetScopeLogs()[0].GetLogRecords()[0]
+			require.Equal(t, logspb.SeverityNumber_SEVERITY_NUMBER_ERROR, record.GetSeverityNumber())
+			require.Equal(t, "ERROR", record.GetSeverityText())
+			require.Equal(t, "ERR creep stuck", record.GetBody().GetStringValue())
+
+			require.Len(t, c.profiles, 1)
+			rp := c.profiles[0].GetResourceProfiles()[0]
+			require.Equal(t, withService, attrs(rp.GetResource().GetAttributes()))
+			p := rp.GetScopeProfiles()[0].GetProfiles()[0].GetProfile()
+			require.Len(t, p.GetSample(), 1)
+			sample := p.GetSample()[0]
+			require.Equal(t, []int64{1500, 1}, sample.GetValue())
+			// The leaf is the first location of the sample.
+			leaf := p.GetLocation()[p.GetLocationIndices()[sample.GetLocationsStartIndex()]]
+			fn := p.GetFunction()[leaf.GetLine()[0].GetFunctionIndex()]
+			require.Equal(t, "Creep.move", p.GetStringTable()[fn.GetName()])
+			require.Equal(t, "cpu", p.GetStringTable()[p.GetSampleType()[0].GetType()])
+		})
+	}
+}
+
+func TestFlushRetries(t *testing.T) {
+	c := &collector{unavailable: 1}
+	exporter, err := otlp.New(otlp.Config{
+		Endpoint: c.serveHTTP(t),
+		Protocol: otlp.ProtocolHTTP,
+	}, prometheus.NewRegistry(), zerolog.Nop())
+	require.NoError(t, err)
+
+	exporter.Log(map[string]string{"shard": "shard3"}, zerolog.WarnLevel, "WRN low bucket")
+	require.Error(t, exporter.Flush(context.Background()))
+	require.NoError(t, exporter.Flush(context.Background()))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	require.Len(t, c.logs, 1)
+	record := c.logs[0].GetResourceLogs()[0].GetScopeLogs()[0].GetLogRecords()[0]
+	require.Equal(t, logspb.SeverityNumber_SEVERITY_NUMBER_WARN, record.GetSeverityNumber())
+}
+
+// testProfile is main calling Creep.move, like the converter makes them.
+func testProfile() *profile.Profile {
+	main := &profile.Function{ID: 1, Name: "main"}
+	move := &profile.Function{ID: 2, Name: "Creep.move"}
+	mainLoc := &profile.Location{ID: 1, Line: []profile.Line{{Function: main}}}
+	moveLoc := &profile.Location{ID: 2, Line: []profile.Line{{Function: move}}}
+	return &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "cpu", Unit: "nanoseconds"},
+			{Type: "samples", Unit: "count"},
+		},
+		DefaultSampleType: "cpu",
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{moveLoc, mainLoc}, Value: []int64{1500, 1}},
+		},
+		Location:      []*profile.Location{mainLoc, moveLoc},
+		Function:      []*profile.Function{main, move},
+		TimeNanos:     time.Unix(1700000000, 0).UnixNano(),
+		DurationNanos: int64(time.Second),
+	}
+}
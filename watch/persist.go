@@ -0,0 +1,149 @@
+package watch
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/Emyrk/screeps-watcher/watch/market"
+	"github.com/Emyrk/screeps-watcher/watch/ratelimit"
+)
+
+// Keys of the state persisted in the data dir.
+const (
+	rateLimitsKey = "ratelimits"
+	marketsKey    = "markets"
+	websocketKey  = "websocket"
+)
+
+func metricsKey(shard string) string {
+	return "metrics-" + shard
+}
+
+// savedSegment is the last metrics payload that parsed successfully.
+type savedSegment struct {
+	// Segments the payload was read from. A payload is only restored if the
+	// target still reads the same segments.
+	Segments []int           `json:"segments"`
+	Data     json.RawMessage `json:"data,omitempty"`
+	// Text is the payload of segments in a text format instead of JSON.
+	Text string    `json:"text,omitempty"`
+	At   time.Time `json:"at"`
+	// Meta is the metric metadata the collector remembered, which the
+	// payload itself might not have.
+	Meta json.RawMessage `json:"meta,omitempty"`
+}
+
+type savedWebsocket struct {
+	UserID string `json:"user_id"`
+}
+
+// loadState loads a key from the data dir, if there is one. Failures are
+// only logged, persisted state is never required to run.
+func (w *Watcher) loadState(key string, v any) bool {
+	ok, err := w.state.Load(key, v)
+	if err != nil {
+		w.logger.Warn().Err(err).Str("key", key).Msg("failed to load state")
+		return false
+	}
+	return ok
+}
+
+func (w *Watcher) saveState(key string, v any) {
+	err := w.state.Save(key, v)
+	if err != nil {
+		w.logger.Warn().Err(err).Str("key", key).Msg("failed to save state")
+	}
+}
+
+func (w *Watcher) restoreRateLimits() {
+	var budgets map[string]ratelimit.Budget
+	if w.loadState(rateLimitsKey, &budgets) {
+		w.RateLimits.Restore(budgets)
+	}
+}
+
+// saveRateLimits saves the budgets if the reset window of any of them
+// changed since the last save, or always if force is set. The remaining
+// count changes with every request, so it is only kept up to date by the
+// forced save at shutdown.
+func (w *Watcher) saveRateLimits(force bool) {
+	if w.state == nil {
+		return
+	}
+	budgets := w.RateLimits.Budgets()
+
+	w.rateLimitsMu.Lock()
+	defer w.rateLimitsMu.Unlock()
+	changed := len(budgets) != len(w.savedResets)
+	for endpoint, b := range budgets {
+		saved, ok := w.savedResets[endpoint]
+		changed = changed || !ok || !saved.Equal(b.Reset)
+	}
+	if !changed && !force {
+		return
+	}
+
+	w.saveState(rateLimitsKey, budgets)
+	w.savedResets = make(map[string]time.Time, len(budgets))
+	for endpoint, b := range budgets {
+		w.savedResets[endpoint] = b.Reset
+	}
+}
+
+// restoreMetrics serves the last known metrics of the target until it is
+// scraped again.
+func (w *Watcher) restoreMetrics(target *MemoryTargets) {
+	var saved savedSegment
+	if !w.loadState(metricsKey(target.Shard), &saved) {
+		return
+	}
+	if !slices.Equal(saved.Segments, target.MetricSegmentIDs()) {
+		return
+	}
+	data := []byte(saved.Data)
+	if saved.Text != "" {
+		data = []byte(saved.Text)
+	}
+	_, err := target.collector.SetMetricMemoryAt(data, saved.At)
+	if err != nil {
+		w.logger.Warn().Err(err).Str("shard", target.Shard).Msg("failed to restore metrics")
+		return
+	}
+	// The history was pushed before the restart, only newer ticks are.
+	target.collector.DiscardHistory()
+	if len(saved.Meta) > 0 {
+		err = target.collector.SetMeta(saved.Meta)
+		if err != nil {
+			w.logger.Warn().Err(err).Str("shard", target.Shard).Msg("failed to restore metric metadata")
+		}
+	}
+}
+
+func (w *Watcher) saveMetrics(target *MemoryTargets, data json.RawMessage) {
+	if w.state == nil {
+		return
+	}
+	saved := savedSegment{
+		Segments: target.MetricSegmentIDs(),
+		At:       time.Now(),
+		Meta:     target.collector.Meta(),
+	}
+	if json.Valid(data) {
+		saved.Data = data
+	} else {
+		saved.Text = string(data)
+	}
+	w.saveState(metricsKey(target.Shard), saved)
+}
+
+// marketKey identifies a market target in the saved market stats.
+func marketKey(target MarketTargets) string {
+	return target.Shard + "/" + target.ResourceType
+}
+
+func (w *Watcher) loadMarkets() map[string]market.Stats {
+	saved := make(map[string]market.Stats)
+	w.loadState(marketsKey, &saved)
+	return saved
+}
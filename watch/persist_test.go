@@ -0,0 +1,120 @@
+package watch_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Emyrk/screeps-watcher/watch"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPersistMetrics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/user/memory-segment" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = rw.Write([]byte(`{"ok":1,"data":"{\"creeps\":12}"}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	segment := 77
+	global := watch.WatchConfig{DataDir: t.TempDir()}
+	opts := watch.WatcherOptions{
+		Name:           "test",
+		URL:            srv.URL,
+		Token:          "token",
+		MemorySegments: []watch.MemoryTargets{{Shard: "shard3", Metrics: &segment}},
+	}
+
+	creeps := func(w *watch.Watcher) float64 {
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(w)
+		families, err := reg.Gather()
+		require.NoError(t, err)
+		for _, f := range families {
+			if f.GetName() == "screeps_memory_creeps" {
+				return f.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		return -1
+	}
+
+	w, err := watch.New(global, opts, zerolog.Nop())
+	require.NoError(t, err)
+	require.Equal(t, float64(-1), creeps(w))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go w.WatchMetrics(ctx)
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(global.DataDir, "test", "metrics-shard3.json"))
+		return creeps(w) == 12 && err == nil
+	}, time.Second*5, time.Millisecond*10)
+	cancel()
+
+	// A restarted watcher serves the last scraped metrics before it has
+	// scraped anything.
+	srv.Close()
+	w, err = watch.New(global, opts, zerolog.Nop())
+	require.NoError(t, err)
+	require.Equal(t, float64(12), creeps(w))
+}
+
+func TestPersistRateLimits(t *testing.T) {
+	reset := time.Now().Add(time.Hour).Unix()
+	remaining := 100
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		remaining--
+		rw.Header().Set("X-RateLimit-Limit", "100")
+		rw.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		rw.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
+		_, _ = rw.Write([]byte(`{"ok":1}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	global := watch.WatchConfig{DataDir: t.TempDir()}
+	opts := watch.WatcherOptions{
+		Name:              "test",
+		URL:               srv.URL,
+		Token:             "token",
+		WebsocketChannels: []string{"cpu"},
+	}
+	path := filepath.Join(global.DataDir, "test", "ratelimits.json")
+	saved := func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	w, err := watch.New(global, opts, zerolog.Nop())
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// The first budget is saved.
+	require.NoError(t, w.Authenticate(ctx))
+	require.True(t, saved())
+
+	// Requests in the same reset window are not.
+	require.NoError(t, os.Remove(path))
+	require.NoError(t, w.Authenticate(ctx))
+	require.False(t, saved())
+
+	// A new reset window is.
+	reset += 60
+	require.NoError(t, w.Authenticate(ctx))
+	require.True(t, saved())
+
+	// Stopping the watcher saves the last remaining count.
+	require.NoError(t, os.Remove(path))
+	stopped, cancel := context.WithCancel(ctx)
+	cancel()
+	w.Watch(stopped)
+	require.True(t, saved())
+}
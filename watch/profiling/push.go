@@ -2,6 +2,7 @@ package profiling
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"time"
 
@@ -21,6 +22,24 @@ func (z zerologWrapper) Infof(f string, args ...interface{})  { z.logger.Info().
 func (z zerologWrapper) Debugf(f string, args ...interface{}) { z.logger.Debug().Msgf(f, args...) }
 func (z zerologWrapper) Errorf(f string, args ...interface{}) { z.logger.Error().Msgf(f, args...) }
 
+// Pusher sends converted profiles somewhere.
+type Pusher interface {
+	Push(name string, pb *profile.Profile) error
+}
+
+// Pushers sends every profile to each of its pushers.
+type Pushers []Pusher
+
+func (p Pushers) Push(name string, pb *profile.Profile) error {
+	var errs []error
+	for _, pusher := range p {
+		errs = append(errs, pusher.Push(name, pb))
+	}
+	return errors.Join(errs...)
+}
+
+var _ Pusher = (*PyroscopePusher)(nil)
+
 type PyroscopePusher struct {
 	Address string
 	Remote  *remote.Remote
@@ -51,7 +70,9 @@ func NewPusher(address string, logger zerolog.Logger) (*PyroscopePusher, error)
 	}, nil
 }
 
+// Stop waits for queued uploads to finish, then stops the uploader.
 func (p *PyroscopePusher) Stop() {
+	p.Remote.Flush()
 	p.Remote.Stop()
 }
 
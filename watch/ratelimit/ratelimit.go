@@ -0,0 +1,343 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Global is the endpoint key for the budget shared by every request.
+const Global = "global"
+
+type Limit struct {
+	Requests int
+	Window   time.Duration
+}
+
+// Documented are the per endpoint limits of the official server.
+// https://docs.screeps.com/auth-tokens.html#Rate-Limiting
+var Documented = map[string]Limit{
+	Global:                                    {Requests: 120, Window: time.Minute},
+	"GET /api/game/room-terrain":              {Requests: 360, Window: time.Hour},
+	"POST /api/game/create-invader":           {Requests: 1200, Window: time.Hour * 24},
+	"POST /api/game/intent":                   {Requests: 120, Window: time.Minute},
+	"POST /api/game/set-notify-when-attacked": {Requests: 60, Window: time.Hour},
+	"GET /api/game/market/orders-index":       {Requests: 60, Window: time.Hour},
+	"GET /api/game/market/orders":             {Requests: 60, Window: time.Hour},
+	"GET /api/game/market/my-orders":          {Requests: 60, Window: time.Hour},
+	"GET /api/game/market/stats":              {Requests: 60, Window: time.Hour},
+	"GET /api/game/user/money-history":        {Requests: 60, Window: time.Hour},
+	"GET /api/user/memory":                    {Requests: 1440, Window: time.Hour * 24},
+	"POST /api/user/memory":                   {Requests: 240, Window: time.Hour * 24},
+	"GET /api/user/memory-segment":            {Requests: 360, Window: time.Hour},
+	"POST /api/user/memory-segment":           {Requests: 60, Window: time.Hour},
+	"POST /api/user/console":                  {Requests: 360, Window: time.Hour},
+	"GET /api/user/code":                      {Requests: 60, Window: time.Hour},
+	"POST /api/user/code":                     {Requests: 240, Window: time.Hour * 24},
+	"POST /api/user/set-active-branch":        {Requests: 240, Window: time.Hour * 24},
+}
+
+// Endpoint returns the key used to track the budget of a request.
+func Endpoint(method, path string) string {
+	return method + " " + path
+}
+
+// Error is returned when a request would exceed the budget of an endpoint
+// for longer than the caller is willing to wait.
+type Error struct {
+	Endpoint string
+	Until    time.Time
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rate limited on %q until %s", e.Endpoint, e.Until.Format(time.RFC3339))
+}
+
+type budget struct {
+	// limit <= 0 means the limit is unknown, and the budget never blocks.
+	limit     int
+	remaining int
+	reset     time.Time
+	// window is only known for documented limits. Budgets learned from
+	// response headers rely on the reset header instead.
+	window time.Duration
+}
+
+func (b *budget) refill(now time.Time) {
+	if b.limit <= 0 || now.Before(b.reset) {
+		return
+	}
+	b.remaining = b.limit
+	if b.window > 0 {
+		b.reset = now.Add(b.window)
+	}
+}
+
+// wait is how long until the budget has a request available.
+func (b *budget) wait(now time.Time) time.Duration {
+	b.refill(now)
+	if b.limit <= 0 || b.remaining > 0 {
+		return 0
+	}
+	return b.reset.Sub(now)
+}
+
+var _ prometheus.Collector = (*Limiter)(nil)
+
+// Limiter tracks the request budget of every endpoint of a single server.
+// Callers Take from the budget before each request and Observe every
+// response, so the budget follows the X-RateLimit headers of the server.
+type Limiter struct {
+	mu      sync.Mutex
+	budgets map[string]*budget
+	now     func() time.Time
+
+	remaining *prometheus.GaugeVec
+	limit     *prometheus.GaugeVec
+	reset     *prometheus.GaugeVec
+	limited   *prometheus.CounterVec
+}
+
+// New creates a limiter that starts from the given documented limits.
+// Pass nil for servers without known limits, only the response headers
+// are used then.
+func New(limits map[string]Limit, labels prometheus.Labels) *Limiter {
+	l := &Limiter{
+		budgets: make(map[string]*budget),
+		now:     time.Now,
+		remaining: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "screeps",
+			Subsystem:   "ratelimit",
+			Name:        "remaining",
+			Help:        "Requests remaining in the current rate limit window.",
+			ConstLabels: labels,
+		}, []string{"endpoint"}),
+		limit: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "screeps",
+			Subsystem:   "ratelimit",
+			Name:        "limit",
+			Help:        "Requests allowed per rate limit window.",
+			ConstLabels: labels,
+		}, []string{"endpoint"}),
+		reset: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "screeps",
+			Subsystem:   "ratelimit",
+			Name:        "reset_unix_s",
+			Help:        "Timestamp in unix seconds when the rate limit window resets.",
+			ConstLabels: labels,
+		}, []string{"endpoint"}),
+		limited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "screeps",
+			Subsystem:   "ratelimit",
+			Name:        "limited_total",
+			Help:        "Requests that were delayed or skipped to stay within the rate limit.",
+			ConstLabels: labels,
+		}, []string{"endpoint", "action"}),
+	}
+
+	for endpoint, limit := range limits {
+		l.budgets[endpoint] = &budget{
+			limit:     limit.Requests,
+			remaining: limit.Requests,
+			window:    limit.Window,
+		}
+	}
+	return l
+}
+
+func (l *Limiter) SetNow(f func() time.Time) {
+	l.now = f
+}
+
+// Take consumes one request from the budget of the endpoint and the global
+// budget. If the budget is exhausted, Take waits for the window to reset as
+// long as that is within maxWait. Otherwise, an *Error is returned and
+// nothing is consumed.
+func (l *Limiter) Take(ctx context.Context, endpoint string, maxWait time.Duration) error {
+	waited := false
+	for {
+		l.mu.Lock()
+		now := l.now()
+		wait := l.budget(Global).wait(now)
+		if b, ok := l.budgets[endpoint]; ok && endpoint != Global {
+			wait = max(wait, b.wait(now))
+		}
+
+		if wait <= 0 {
+			l.consume(Global)
+			if endpoint != Global {
+				l.consume(endpoint)
+			}
+			l.mu.Unlock()
+			return nil
+		}
+		l.mu.Unlock()
+
+		if wait > maxWait {
+			l.limited.WithLabelValues(endpoint, "skipped").Inc()
+			return &Error{Endpoint: endpoint, Until: now.Add(wait)}
+		}
+
+		if !waited {
+			waited = true
+			l.limited.WithLabelValues(endpoint, "delayed").Inc()
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Observe updates the budget from the rate limit headers of a response.
+// Endpoints without their own limit are covered by the global limit, so the
+// headers of their responses describe the global budget.
+func (l *Limiter) Observe(endpoint string, resp *http.Response) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.budgets[endpoint]; !ok {
+		endpoint = Global
+	}
+	b := l.budget(endpoint)
+
+	if limit, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Limit")); err == nil {
+		b.limit = limit
+	}
+	if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+		b.remaining = remaining
+	}
+	resetAt, resetErr := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if resetErr == nil {
+		b.reset = time.Unix(resetAt, 0)
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		b.remaining = 0
+		if b.limit <= 0 {
+			// Something is limited even if we do not know the limit.
+			b.limit = 1
+		}
+		if resetErr != nil {
+			b.reset = l.now().Add(time.Minute * 10)
+		} else {
+			// A little slack for clock skew.
+			b.reset = b.reset.Add(time.Second * 5)
+		}
+	}
+	l.updateMetrics(endpoint)
+}
+
+// Until returns when the endpoint will next have budget, or the zero time if
+// it has budget now.
+func (l *Limiter) Until(endpoint string) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	wait := l.budget(Global).wait(now)
+	if b, ok := l.budgets[endpoint]; ok {
+		wait = max(wait, b.wait(now))
+	}
+	if wait <= 0 {
+		return time.Time{}
+	}
+	return now.Add(wait)
+}
+
+// Budget is the state of the budget of an endpoint, for persisting it
+// across restarts.
+type Budget struct {
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+}
+
+// Budgets returns the budgets with a known limit and reset.
+func (l *Limiter) Budgets() map[string]Budget {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	budgets := make(map[string]Budget)
+	for endpoint, b := range l.budgets {
+		if b.limit <= 0 || b.reset.IsZero() {
+			continue
+		}
+		budgets[endpoint] = Budget{
+			Limit:     b.limit,
+			Remaining: b.remaining,
+			Reset:     b.reset,
+		}
+	}
+	return budgets
+}
+
+// Restore sets the budgets saved by Budgets. Budgets whose window has
+// already reset are ignored.
+func (l *Limiter) Restore(budgets map[string]Budget) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	for endpoint, saved := range budgets {
+		if !saved.Reset.After(now) {
+			continue
+		}
+		b := l.budget(endpoint)
+		b.limit = saved.Limit
+		b.remaining = saved.Remaining
+		b.reset = saved.Reset
+		l.updateMetrics(endpoint)
+	}
+}
+
+func (l *Limiter) budget(endpoint string) *budget {
+	b, ok := l.budgets[endpoint]
+	if !ok {
+		b = &budget{}
+		l.budgets[endpoint] = b
+	}
+	return b
+}
+
+func (l *Limiter) consume(endpoint string) {
+	b := l.budget(endpoint)
+	if b.limit > 0 {
+		b.remaining--
+	}
+	l.updateMetrics(endpoint)
+}
+
+func (l *Limiter) updateMetrics(endpoint string) {
+	b := l.budget(endpoint)
+	if b.limit <= 0 {
+		return
+	}
+	l.remaining.WithLabelValues(endpoint).Set(float64(b.remaining))
+	l.limit.WithLabelValues(endpoint).Set(float64(b.limit))
+	if !b.reset.IsZero() {
+		l.reset.WithLabelValues(endpoint).Set(float64(b.reset.Unix()))
+	}
+}
+
+func (l *Limiter) Describe(descs chan<- *prometheus.Desc) {
+	l.remaining.Describe(descs)
+	l.limit.Describe(descs)
+	l.reset.Describe(descs)
+	l.limited.Describe(descs)
+}
+
+func (l *Limiter) Collect(metrics chan<- prometheus.Metric) {
+	l.remaining.Collect(metrics)
+	l.limit.Collect(metrics)
+	l.reset.Collect(metrics)
+	l.limited.Collect(metrics)
+}
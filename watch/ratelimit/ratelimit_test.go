@@ -0,0 +1,92 @@
+package ratelimit_test
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Emyrk/screeps-watcher/watch/ratelimit"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	segment := ratelimit.Endpoint(http.MethodGet, "/api/user/memory-segment")
+
+	l := ratelimit.New(map[string]ratelimit.Limit{
+		ratelimit.Global: {Requests: 100, Window: time.Minute},
+		segment:          {Requests: 2, Window: time.Hour},
+	}, nil)
+	l.SetNow(func() time.Time { return now })
+
+	require.NoError(t, l.Take(ctx, segment, 0))
+	require.NoError(t, l.Take(ctx, segment, 0))
+
+	// The documented budget is spent for the hour.
+	err := l.Take(ctx, segment, time.Minute)
+	var limited *ratelimit.Error
+	require.ErrorAs(t, err, &limited)
+	require.Equal(t, segment, limited.Endpoint)
+	require.Equal(t, now.Add(time.Hour), limited.Until)
+
+	// Other endpoints only use the global budget.
+	require.NoError(t, l.Take(ctx, ratelimit.Endpoint(http.MethodGet, "/api/game/room-objects"), 0))
+
+	// The window resets.
+	now = now.Add(time.Hour)
+	require.NoError(t, l.Take(ctx, segment, 0))
+
+	// Headers from the server override what we think we know.
+	reset := now.Add(time.Minute * 30)
+	l.Observe(segment, &http.Response{
+		StatusCode: http.StatusTooManyRequests,
+		Header: http.Header{
+			"X-Ratelimit-Limit":     []string{"360"},
+			"X-Ratelimit-Remaining": []string{"0"},
+			"X-Ratelimit-Reset":     []string{strconv.FormatInt(reset.Unix(), 10)},
+		},
+	})
+	require.Equal(t, reset.Add(time.Second*5), l.Until(segment))
+	require.ErrorAs(t, l.Take(ctx, segment, time.Minute), &limited)
+}
+
+func TestLimiterUnknownLimits(t *testing.T) {
+	ctx := context.Background()
+	l := ratelimit.New(nil, nil)
+	endpoint := ratelimit.Endpoint(http.MethodGet, "/api/user/memory-segment")
+
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, l.Take(ctx, endpoint, 0))
+	}
+
+	// A 429 without headers backs off anyway.
+	l.Observe(endpoint, &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}})
+	require.Error(t, l.Take(ctx, endpoint, time.Minute))
+}
+
+func TestLimiterRestore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	segment := ratelimit.Endpoint(http.MethodGet, "/api/user/memory-segment")
+	limits := map[string]ratelimit.Limit{segment: {Requests: 1, Window: time.Hour}}
+
+	l := ratelimit.New(limits, nil)
+	l.SetNow(func() time.Time { return now })
+	require.NoError(t, l.Take(ctx, segment, 0))
+	saved := l.Budgets()
+
+	// A restarted limiter remembers the spent budget.
+	restarted := ratelimit.New(limits, nil)
+	restarted.SetNow(func() time.Time { return now.Add(time.Minute) })
+	restarted.Restore(saved)
+	require.Equal(t, now.Add(time.Hour), restarted.Until(segment))
+
+	// Unless the window has reset since.
+	restarted = ratelimit.New(limits, nil)
+	restarted.SetNow(func() time.Time { return now.Add(time.Hour * 2) })
+	restarted.Restore(saved)
+	require.True(t, restarted.Until(segment).IsZero())
+}
@@ -0,0 +1,158 @@
+package remotewrite
+
+import (
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The remote write protocol is a small protobuf schema. It is encoded by hand
+// to avoid depending on all of prometheus for the generated types.
+// https://github.com/prometheus/prometheus/blob/main/prompb/remote.proto
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+type Sample struct {
+	Value float64
+	// TimestampMs is in unix milliseconds.
+	TimestampMs int64
+}
+
+type TimeSeries struct {
+	// Labels include __name__, sorted by name.
+	Labels  []Label
+	Samples []Sample
+}
+
+func encodeWriteRequest(series []TimeSeries) []byte {
+	var b []byte
+	for _, ts := range series {
+		var tsb []byte
+		for _, l := range ts.Labels {
+			var lb []byte
+			lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.Name)
+			lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.Value)
+			tsb = protowire.AppendTag(tsb, 1, protowire.BytesType)
+			tsb = protowire.AppendBytes(tsb, lb)
+		}
+		for _, s := range ts.Samples {
+			var sb []byte
+			sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+			sb = protowire.AppendFixed64(sb, math.Float64bits(s.Value))
+			sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+			sb = protowire.AppendVarint(sb, uint64(s.TimestampMs))
+			tsb = protowire.AppendTag(tsb, 2, protowire.BytesType)
+			tsb = protowire.AppendBytes(tsb, sb)
+		}
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, tsb)
+	}
+	return b
+}
+
+// DecodeWriteRequest decodes the time series of an uncompressed write
+// request. Unknown fields are skipped.
+func DecodeWriteRequest(data []byte) ([]TimeSeries, error) {
+	var series []TimeSeries
+	err := decodeFields(data, func(num protowire.Number, typ protowire.Type, value []byte, _ uint64) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		ts, err := decodeTimeSeries(value)
+		if err != nil {
+			return err
+		}
+		series = append(series, ts)
+		return nil
+	})
+	return series, err
+}
+
+func decodeTimeSeries(data []byte) (TimeSeries, error) {
+	var ts TimeSeries
+	err := decodeFields(data, func(num protowire.Number, typ protowire.Type, value []byte, _ uint64) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1:
+			var l Label
+			err := decodeFields(value, func(num protowire.Number, typ protowire.Type, value []byte, _ uint64) error {
+				switch {
+				case num == 1 && typ == protowire.BytesType:
+					l.Name = string(value)
+				case num == 2 && typ == protowire.BytesType:
+					l.Value = string(value)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ts.Labels = append(ts.Labels, l)
+		case 2:
+			var s Sample
+			err := decodeFields(value, func(num protowire.Number, typ protowire.Type, _ []byte, scalar uint64) error {
+				switch {
+				case num == 1 && typ == protowire.Fixed64Type:
+					s.Value = math.Float64frombits(scalar)
+				case num == 2 && typ == protowire.VarintType:
+					s.TimestampMs = int64(scalar)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ts.Samples = append(ts.Samples, s)
+		}
+		return nil
+	})
+	return ts, err
+}
+
+// decodeFields calls f for every field of a message. Length delimited fields
+// are passed as value, numeric fields as scalar.
+func decodeFields(data []byte, f func(num protowire.Number, typ protowire.Type, value []byte, scalar uint64) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return fmt.Errorf("decode tag: %w", protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		var value []byte
+		var scalar uint64
+		switch typ {
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(data)
+		case protowire.VarintType:
+			scalar, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed64Type:
+			scalar, n = protowire.ConsumeFixed64(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return fmt.Errorf("decode field %d: %w", num, protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		err := f(num, typ, value, scalar)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
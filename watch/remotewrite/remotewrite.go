@@ -0,0 +1,384 @@
+// Package remotewrite pushes the watcher metrics to a Prometheus remote write
+// endpoint, for when Prometheus cannot scrape the watcher.
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog"
+)
+
+type Config struct {
+	// Name identifies the endpoint in logs and metrics. Defaults to the url
+	// host.
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// Interval is how often the metrics are gathered and pushed.
+	Interval time.Duration `yaml:"interval"`
+	// Timeout of a single push.
+	Timeout     time.Duration     `yaml:"timeout"`
+	Username    string            `yaml:"username"`
+	Password    string            `yaml:"password"`
+	BearerToken string            `yaml:"bearer_token"`
+	Headers     map[string]string `yaml:"headers"`
+	// QueueSize is how many pushes are kept while the endpoint is down. The
+	// oldest push is dropped when the queue is full.
+	QueueSize int `yaml:"queue_size"`
+}
+
+func (c Config) withDefaults() Config {
+	if c.Interval == 0 {
+		c.Interval = time.Minute
+	}
+	if c.Timeout == 0 {
+		c.Timeout = time.Second * 30
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = 60
+	}
+	if c.Name == "" {
+		if u, err := url.Parse(c.URL); err == nil {
+			c.Name = u.Host
+		}
+	}
+	return c
+}
+
+// HistorySource returns the samples of earlier ticks the endpoint has not been
+// sent yet. The consumer is the name of the endpoint.
+type HistorySource func(consumer string) []TimeSeries
+
+// batch is the series of a single gather.
+type batch struct {
+	series  []TimeSeries
+	samples int
+}
+
+var _ prometheus.Collector = (*Exporter)(nil)
+
+// Exporter periodically gathers metrics and pushes them to a remote write
+// endpoint. Pushes that fail are queued and retried in order.
+type Exporter struct {
+	cfg      Config
+	gatherer prometheus.Gatherer
+	history  HistorySource
+	cli      *http.Client
+	logger   zerolog.Logger
+	now      func() time.Time
+
+	mu    sync.Mutex
+	queue []batch
+
+	samples  prometheus.Counter
+	failures *prometheus.CounterVec
+	dropped  prometheus.Counter
+	pending  prometheus.GaugeFunc
+}
+
+func New(cfg Config, gatherer prometheus.Gatherer, logger zerolog.Logger) (*Exporter, error) {
+	cfg = cfg.withDefaults()
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid remote write url %q", cfg.URL)
+	}
+
+	labels := prometheus.Labels{"remote": cfg.Name}
+	e := &Exporter{
+		cfg:      cfg,
+		gatherer: gatherer,
+		cli:      &http.Client{Timeout: cfg.Timeout},
+		logger:   logger.With().Str("remote", cfg.Name).Logger(),
+		now:      time.Now,
+		samples: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   "screeps",
+			Subsystem:   "remote_write",
+			Name:        "samples_total",
+			Help:        "Samples successfully pushed to the remote write endpoint.",
+			ConstLabels: labels,
+		}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "screeps",
+			Subsystem:   "remote_write",
+			Name:        "failures_total",
+			Help:        "Failed pushes to the remote write endpoint. Retryable failures are queued and retried.",
+			ConstLabels: labels,
+		}, []string{"retryable"}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   "screeps",
+			Subsystem:   "remote_write",
+			Name:        "dropped_samples_total",
+			Help:        "Samples dropped because the queue was full or the endpoint rejected them.",
+			ConstLabels: labels,
+		}),
+	}
+	e.pending = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   "screeps",
+		Subsystem:   "remote_write",
+		Name:        "queue_length",
+		Help:        "Pushes waiting to be sent to the remote write endpoint.",
+		ConstLabels: labels,
+	}, func() float64 {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return float64(len(e.queue))
+	})
+	return e, nil
+}
+
+// WithHistory also pushes the samples of earlier ticks, with the time they
+// were written at.
+func (e *Exporter) WithHistory(source HistorySource) *Exporter {
+	e.history = source
+	return e
+}
+
+// Name identifies the endpoint. The history is read as this consumer.
+func (e *Exporter) Name() string {
+	return e.cfg.Name
+}
+
+func (e *Exporter) SetNow(f func() time.Time) {
+	e.now = f
+}
+
+// Run pushes every interval until ctx is canceled. Before returning, it makes
+// one last attempt to push everything queued.
+func (e *Exporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.cfg.Interval)
+	defer ticker.Stop()
+
+	// A nil channel blocks forever, which means no retry is scheduled.
+	var retry <-chan time.Time
+	backoff := time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			e.Gather()
+			flushCtx, cancel := context.WithTimeout(context.Background(), e.cfg.Timeout)
+			err := e.Flush(flushCtx)
+			cancel()
+			if err != nil {
+				e.logger.Warn().Err(err).Msg("final remote write push failed")
+			}
+			return
+		case <-ticker.C:
+			e.Gather()
+		case <-retry:
+		}
+
+		err := e.Flush(ctx)
+		if err == nil {
+			retry = nil
+			backoff = time.Second
+			continue
+		}
+		if ctx.Err() != nil {
+			continue
+		}
+		e.logger.Warn().Err(err).Dur("retry_in", backoff).Msg("remote write push failed")
+		retry = time.After(backoff)
+		backoff = min(backoff*2, e.cfg.Interval)
+	}
+}
+
+// Gather queues the current metrics to be pushed.
+func (e *Exporter) Gather() {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		// Gather returns what it could alongside the error.
+		e.logger.Warn().Err(err).Msg("gather metrics")
+	}
+	b := toBatch(families, e.now())
+	if e.history != nil {
+		// History goes first. The newest history sample is also scraped, and
+		// samples of a series have to be pushed in order.
+		history := e.history(e.cfg.Name)
+		for _, ts := range history {
+			b.samples += len(ts.Samples)
+		}
+		b.series = append(history, b.series...)
+	}
+	if b.samples == 0 {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.queue = append(e.queue, b)
+	for len(e.queue) > e.cfg.QueueSize {
+		e.dropped.Add(float64(e.queue[0].samples))
+		e.queue = e.queue[1:]
+	}
+}
+
+// Flush pushes the queued metrics in order. It stops at the first push that
+// can be retried, which is left in the queue.
+func (e *Exporter) Flush(ctx context.Context) error {
+	for {
+		e.mu.Lock()
+		if len(e.queue) == 0 {
+			e.mu.Unlock()
+			return nil
+		}
+		next := e.queue[0]
+		e.mu.Unlock()
+
+		err := e.push(ctx, next.series)
+		var perr *pushError
+		if err != nil && errors.As(err, &perr) && !perr.retryable {
+			e.failures.WithLabelValues("false").Inc()
+			e.dropped.Add(float64(next.samples))
+			e.logger.Error().Err(err).Msg("remote write endpoint rejected push, dropping it")
+		} else if err != nil {
+			e.failures.WithLabelValues("true").Inc()
+			return err
+		} else {
+			e.samples.Add(float64(next.samples))
+		}
+
+		e.mu.Lock()
+		e.queue = e.queue[1:]
+		e.mu.Unlock()
+	}
+}
+
+type pushError struct {
+	status    int
+	body      string
+	retryable bool
+}
+
+func (e *pushError) Error() string {
+	return fmt.Sprintf("remote write status %d: %s", e.status, e.body)
+}
+
+func (e *Exporter) push(ctx context.Context, series []TimeSeries) error {
+	body := s2.EncodeSnappy(nil, encodeWriteRequest(series))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "screeps-watcher")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for k, v := range e.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	if e.cfg.Username != "" {
+		req.SetBasicAuth(e.cfg.Username, e.cfg.Password)
+	}
+	if e.cfg.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+e.cfg.BearerToken)
+	}
+
+	resp, err := e.cli.Do(req)
+	if err != nil {
+		return fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return &pushError{
+		status: resp.StatusCode,
+		body:   string(bytes.TrimSpace(msg)),
+		// Client errors other than rate limits will fail the same way
+		// every time.
+		retryable: resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests,
+	}
+}
+
+// toBatch flattens metric families into series the way the prometheus text
+// format does, with _bucket, _sum and _count series for histograms and
+// summaries.
+func toBatch(families []*dto.MetricFamily, now time.Time) batch {
+	var b batch
+	add := func(name string, m *dto.Metric, value float64, extra ...Label) {
+		ts := now.UnixMilli()
+		if m.TimestampMs != nil {
+			ts = m.GetTimestampMs()
+		}
+		labels := make([]Label, 0, len(m.GetLabel())+len(extra)+1)
+		labels = append(labels, Label{Name: "__name__", Value: name})
+		for _, l := range m.GetLabel() {
+			labels = append(labels, Label{Name: l.GetName(), Value: l.GetValue()})
+		}
+		labels = append(labels, extra...)
+		sort.Slice(labels, func(i, j int) bool {
+			return labels[i].Name < labels[j].Name
+		})
+		b.series = append(b.series, TimeSeries{
+			Labels:  labels,
+			Samples: []Sample{{Value: value, TimestampMs: ts}},
+		})
+		b.samples++
+	}
+
+	for _, f := range families {
+		name := f.GetName()
+		for _, m := range f.GetMetric() {
+			switch f.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m, m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, bucket := range h.GetBucket() {
+					add(name+"_bucket", m, float64(bucket.GetCumulativeCount()), Label{Name: "le", Value: formatFloat(bucket.GetUpperBound())})
+				}
+				add(name+"_bucket", m, float64(h.GetSampleCount()), Label{Name: "le", Value: "+Inf"})
+				add(name+"_sum", m, h.GetSampleSum())
+				add(name+"_count", m, float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add(name, m, q.GetValue(), Label{Name: "quantile", Value: formatFloat(q.GetQuantile())})
+				}
+				add(name+"_sum", m, s.GetSampleSum())
+				add(name+"_count", m, float64(s.GetSampleCount()))
+			}
+		}
+	}
+	return b
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprint(f)
+}
+
+func (e *Exporter) Describe(descs chan<- *prometheus.Desc) {
+	e.samples.Describe(descs)
+	e.failures.Describe(descs)
+	e.dropped.Describe(descs)
+	e.pending.Describe(descs)
+}
+
+func (e *Exporter) Collect(metrics chan<- prometheus.Metric) {
+	e.samples.Collect(metrics)
+	e.failures.Collect(metrics)
+	e.dropped.Collect(metrics)
+	e.pending.Collect(metrics)
+}
@@ -0,0 +1,140 @@
+package remotewrite_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Emyrk/screeps-watcher/watch/remotewrite"
+	"github.com/klauspost/compress/s2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// receiver is a stand-in remote write endpoint.
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	series   [][]remotewrite.TimeSeries
+	headers  http.Header
+}
+
+func (r *receiver) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.statuses) > 0 {
+		status := r.statuses[0]
+		r.statuses = r.statuses[1:]
+		if status != http.StatusNoContent {
+			rw.WriteHeader(status)
+			return
+		}
+	}
+
+	compressed, _ := io.ReadAll(req.Body)
+	data, err := s2.Decode(nil, compressed)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	series, err := remotewrite.DecodeWriteRequest(data)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.series = append(r.series, series)
+	r.headers = req.Header
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func TestExporter(t *testing.T) {
+	recv := &receiver{
+		// The endpoint is down for the first push, and rejects the third.
+		statuses: []int{http.StatusServiceUnavailable, http.StatusNoContent, http.StatusNoContent, http.StatusBadRequest},
+	}
+	srv := httptest.NewServer(recv)
+	t.Cleanup(srv.Close)
+
+	reg := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name:        "screeps_memory_creeps",
+		ConstLabels: prometheus.Labels{"shard": "shard3"},
+	}, []string{"role"})
+	reg.MustRegister(gauge)
+	gauge.WithLabelValues("harvester").Set(12)
+
+	e, err := remotewrite.New(remotewrite.Config{
+		URL:         srv.URL,
+		BearerToken: "secret",
+		Headers:     map[string]string{"X-Scope-OrgID": "screeps"},
+	}, reg, zerolog.Nop())
+	require.NoError(t, err)
+	now := time.UnixMilli(1700000000000)
+	e.SetNow(func() time.Time { return now })
+
+	ctx := context.Background()
+	e.Gather()
+	require.Error(t, e.Flush(ctx))
+
+	// Both the failed push and the new one are sent, in order.
+	gauge.WithLabelValues("harvester").Set(13)
+	now = now.Add(time.Minute)
+	e.Gather()
+	require.NoError(t, e.Flush(ctx))
+
+	recv.mu.Lock()
+	require.Len(t, recv.series, 2)
+	require.Equal(t, []remotewrite.TimeSeries{{
+		Labels: []remotewrite.Label{
+			{Name: "__name__", Value: "screeps_memory_creeps"},
+			{Name: "role", Value: "harvester"},
+			{Name: "shard", Value: "shard3"},
+		},
+		Samples: []remotewrite.Sample{{Value: 12, TimestampMs: 1700000000000}},
+	}}, recv.series[0])
+	require.Equal(t, float64(13), recv.series[1][0].Samples[0].Value)
+	require.Equal(t, "Bearer secret", recv.headers.Get("Authorization"))
+	require.Equal(t, "screeps", recv.headers.Get("X-Scope-OrgID"))
+	require.Equal(t, "snappy", recv.headers.Get("Content-Encoding"))
+	recv.mu.Unlock()
+
+	// A rejected push is dropped instead of retried forever.
+	e.Gather()
+	require.NoError(t, e.Flush(ctx))
+	recv.mu.Lock()
+	require.Len(t, recv.series, 2)
+	recv.mu.Unlock()
+}
+
+func TestExporterHistory(t *testing.T) {
+	recv := &receiver{}
+	srv := httptest.NewServer(recv)
+	t.Cleanup(srv.Close)
+
+	cpu := []remotewrite.Label{{Name: "__name__", Value: "screeps_memory_cpu"}}
+	consumers := make([]string, 0)
+	e, err := remotewrite.New(remotewrite.Config{Name: "mimir", URL: srv.URL}, prometheus.NewRegistry(), zerolog.Nop())
+	require.NoError(t, err)
+	e.WithHistory(func(consumer string) []remotewrite.TimeSeries {
+		consumers = append(consumers, consumer)
+		return []remotewrite.TimeSeries{{
+			Labels:  cpu,
+			Samples: []remotewrite.Sample{{Value: 10, TimestampMs: 1700000000000}, {Value: 20, TimestampMs: 1700000003000}},
+		}}
+	})
+
+	e.Gather()
+	require.NoError(t, e.Flush(context.Background()))
+
+	recv.mu.Lock()
+	defer recv.mu.Unlock()
+	require.Equal(t, []string{"mimir"}, consumers)
+	require.Len(t, recv.series, 1)
+	require.Equal(t, []remotewrite.Sample{{Value: 10, TimestampMs: 1700000000000}, {Value: 20, TimestampMs: 1700000003000}}, recv.series[0][0].Samples)
+}
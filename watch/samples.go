@@ -0,0 +1,122 @@
+package watch
+
+import (
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/Emyrk/screeps-watcher/watch/graphite"
+	"github.com/Emyrk/screeps-watcher/watch/memcollector"
+	"github.com/Emyrk/screeps-watcher/watch/remotewrite"
+)
+
+// treeSubsystems are the metrics besides the memory segments that are
+// exported to tree based backends like graphite.
+var treeSubsystems = []string{"market", "websocket", "game"}
+
+// GraphiteSamples returns the metrics of every memory segment with their
+// segment path, along with the market, websocket and game tick metrics.
+func (w *Watcher) GraphiteSamples() []graphite.Sample {
+	samples := make([]graphite.Sample, 0)
+	for _, target := range w.Segments() {
+		for _, s := range target.collector.Samples() {
+			samples = append(samples, graphite.Sample(s))
+		}
+	}
+
+	families, err := w.reg.Gather()
+	if err != nil {
+		w.logger.Warn().Err(err).Msg("gather metrics for graphite")
+	}
+	for _, f := range families {
+		// screeps_market_resource_daily_volume is market.resource_daily_volume
+		name, ok := strings.CutPrefix(f.GetName(), "screeps_")
+		if !ok {
+			continue
+		}
+		subsystem, rest, ok := strings.Cut(name, "_")
+		if !ok || !slices.Contains(treeSubsystems, subsystem) {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			if m.GetGauge() == nil {
+				continue
+			}
+			labels := make(map[string]string, len(m.GetLabel()))
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			samples = append(samples, graphite.Sample{
+				Path:   []string{subsystem, rest},
+				Labels: labels,
+				Value:  m.GetGauge().GetValue(),
+			})
+		}
+	}
+	return samples
+}
+
+// GraphiteSamples returns the samples of every running watcher.
+func (m *Manager) GraphiteSamples() []graphite.Sample {
+	samples := make([]graphite.Sample, 0)
+	for _, w := range m.Watchers() {
+		samples = append(samples, w.GraphiteSamples()...)
+	}
+	return samples
+}
+
+// WithHistoryConsumer keeps the history samples of every memory segment until
+// the consumer reads them with History.
+func (w *Watcher) WithHistoryConsumer(consumer string) *Watcher {
+	w.historyConsumers = append(w.historyConsumers, consumer)
+	for _, target := range w.memoryTargets {
+		target.collector.WithHistoryConsumer(consumer)
+	}
+	return w
+}
+
+// History returns the history samples of every memory segment the consumer
+// has not read yet.
+func (w *Watcher) History(consumer string) []memcollector.HistorySample {
+	samples := make([]memcollector.HistorySample, 0)
+	for _, target := range w.Segments() {
+		samples = append(samples, target.collector.History(consumer)...)
+	}
+	return samples
+}
+
+// RemoteWriteHistory returns the history samples of every running watcher
+// that the remote write endpoint has not been sent, as one series per metric.
+func (m *Manager) RemoteWriteHistory(consumer string) []remotewrite.TimeSeries {
+	series := make([]remotewrite.TimeSeries, 0)
+	index := make(map[string]int)
+	for _, w := range m.Watchers() {
+		for _, s := range w.History(consumer) {
+			labels := make([]remotewrite.Label, 0, len(s.Labels)+1)
+			labels = append(labels, remotewrite.Label{Name: "__name__", Value: s.Name})
+			for k, v := range s.Labels {
+				labels = append(labels, remotewrite.Label{Name: k, Value: v})
+			}
+			sort.Slice(labels, func(i, j int) bool {
+				return labels[i].Name < labels[j].Name
+			})
+
+			var key strings.Builder
+			for _, l := range labels {
+				key.WriteString(l.Name + "=" + l.Value + "\x00")
+			}
+			i, ok := index[key.String()]
+			if !ok {
+				i = len(series)
+				index[key.String()] = i
+				series = append(series, remotewrite.TimeSeries{Labels: labels})
+			}
+			// Samples come oldest first.
+			series[i].Samples = append(series[i].Samples, remotewrite.Sample{
+				Value:       s.Value,
+				TimestampMs: s.Time.UnixMilli(),
+			})
+		}
+	}
+	return series
+}
@@ -0,0 +1,303 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Emyrk/screeps-watcher/watch/memory"
+	"github.com/Emyrk/screeps-watcher/watch/ratelimit"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Failure reasons for scrapes.
+const (
+	ReasonRateLimit  = "rate_limit"
+	ReasonHTTPStatus = "http_status"
+	ReasonDecode     = "decode"
+	ReasonParse      = "parse"
+	ReasonTornRead   = "torn_read"
+	ReasonRequest    = "request"
+	ReasonCanceled   = "canceled"
+)
+
+// FailureReason classifies an error returned by a request to the api.
+func FailureReason(err error) string {
+	var limited *ratelimit.Error
+	var status *StatusError
+	switch {
+	case errors.As(err, &limited):
+		return ReasonRateLimit
+	case errors.As(err, &status):
+		return ReasonHTTPStatus
+	case errors.Is(err, memory.ErrTornRead):
+		return ReasonTornRead
+	case errors.Is(err, ErrDecode):
+		return ReasonDecode
+	case errors.Is(err, context.Canceled):
+		return ReasonCanceled
+	default:
+		return ReasonRequest
+	}
+}
+
+// TargetStatus is the result of the last scrape of a target.
+type TargetStatus struct {
+	Server string `json:"server"`
+	Shard  string `json:"shard"`
+	// Target is the type of scrape and what was scraped, eg "metrics:77".
+	Target     string        `json:"target"`
+	Endpoint   string        `json:"endpoint"`
+	Health     string        `json:"health"`
+	LastScrape time.Time     `json:"last_scrape"`
+	Duration   time.Duration `json:"duration"`
+	LastError  string        `json:"last_error,omitempty"`
+	Series     int           `json:"series"`
+}
+
+const (
+	HealthUnknown = "unknown"
+	HealthUp      = "up"
+	HealthDown    = "down"
+)
+
+var _ prometheus.Collector = (*scrapeStats)(nil)
+
+// scrapeStats are the watcher's metrics about its own scrapes. Without them,
+// a failed scrape looks the same as a bot that stopped writing its segment.
+type scrapeStats struct {
+	attempts *prometheus.CounterVec
+	failures *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	size     *prometheus.HistogramVec
+	up       *prometheus.GaugeVec
+	lastOK   *prometheus.GaugeVec
+	// segmentSize is per segment, where a target can span segments.
+	segmentSize *prometheus.GaugeVec
+
+	server  string
+	mu      sync.Mutex
+	targets map[string]*TargetStatus
+}
+
+func newScrapeStats(server string, labels prometheus.Labels) *scrapeStats {
+	return &scrapeStats{
+		server:  server,
+		targets: make(map[string]*TargetStatus),
+		attempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "screeps",
+			Subsystem:   "watcher",
+			Name:        "scrapes_total",
+			Help:        "Scrapes attempted by the watcher.",
+			ConstLabels: labels,
+		}, []string{"shard", "target", "endpoint"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "screeps",
+			Subsystem:   "watcher",
+			Name:        "scrape_failures_total",
+			Help:        "Scrapes that failed, by reason.",
+			ConstLabels: labels,
+		}, []string{"shard", "target", "endpoint", "reason"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   "screeps",
+			Subsystem:   "watcher",
+			Name:        "request_duration_seconds",
+			Help:        "Latency of requests to the screeps api.",
+			ConstLabels: labels,
+			Buckets:     prometheus.DefBuckets,
+		}, []string{"shard", "target", "endpoint"}),
+		size: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   "screeps",
+			Subsystem:   "watcher",
+			Name:        "response_size_bytes",
+			Help:        "Size of responses from the screeps api.",
+			ConstLabels: labels,
+			// 256B to 4MB
+			Buckets: prometheus.ExponentialBuckets(256, 4, 8),
+		}, []string{"shard", "target", "endpoint"}),
+		up: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "screeps",
+			Subsystem:   "watcher",
+			Name:        "target_up",
+			Help:        "1 if the last scrape of the target succeeded, 0 otherwise.",
+			ConstLabels: labels,
+		}, []string{"shard", "target"}),
+		lastOK: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "screeps",
+			Subsystem:   "watcher",
+			Name:        "target_last_success_unix_s",
+			Help:        "Timestamp in unix seconds of the last successful scrape of the target.",
+			ConstLabels: labels,
+		}, []string{"shard", "target"}),
+		segmentSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "screeps",
+			Subsystem:   "watcher",
+			Name:        "segment_size_bytes",
+			Help:        "Decoded size of the last scrape of each memory segment.",
+			ConstLabels: labels,
+		}, []string{"shard", "segment"}),
+	}
+}
+
+// register adds a target before its first scrape, so it shows up as
+// unknown until then.
+func (s *scrapeStats) register(shard, endpoint, target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status(shard, endpoint, target)
+}
+
+// unregister removes a target that is no longer scraped.
+func (s *scrapeStats) unregister(shard, target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.targets, shard+"/"+target)
+	s.up.DeleteLabelValues(shard, target)
+	s.lastOK.DeleteLabelValues(shard, target)
+	labels := prometheus.Labels{"shard": shard, "target": target}
+	s.attempts.DeletePartialMatch(labels)
+	s.failures.DeletePartialMatch(labels)
+	s.duration.DeletePartialMatch(labels)
+	s.size.DeletePartialMatch(labels)
+	s.segmentSize.DeletePartialMatch(prometheus.Labels{"shard": shard})
+}
+
+// status must be called with the lock held.
+func (s *scrapeStats) status(shard, endpoint, target string) *TargetStatus {
+	key := shard + "/" + target
+	st, ok := s.targets[key]
+	if !ok {
+		st = &TargetStatus{
+			Server:   s.server,
+			Shard:    shard,
+			Target:   target,
+			Endpoint: endpoint,
+			Health:   HealthUnknown,
+		}
+		s.targets[key] = st
+	}
+	return st
+}
+
+// Targets returns the status of every target sorted by shard and target.
+func (s *scrapeStats) Targets() []TargetStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	targets := make([]TargetStatus, 0, len(s.targets))
+	for _, st := range s.targets {
+		targets = append(targets, *st)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Shard != targets[j].Shard {
+			return targets[i].Shard < targets[j].Shard
+		}
+		return targets[i].Target < targets[j].Target
+	})
+	return targets
+}
+
+// scraped is true once every target has completed at least one scrape.
+func (s *scrapeStats) scraped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, st := range s.targets {
+		if st.LastScrape.IsZero() {
+			return false
+		}
+	}
+	return true
+}
+
+// scrape is a single scrape of a target in progress.
+type scrape struct {
+	stats    *scrapeStats
+	shard    string
+	endpoint string
+	target   string
+	start    time.Time
+}
+
+// start begins a scrape. Requests made with the returned context are
+// observed as requests of the target.
+func (s *scrapeStats) start(ctx context.Context, shard, endpoint, target string) (*scrape, context.Context) {
+	s.attempts.WithLabelValues(shard, target, endpoint).Inc()
+	return &scrape{
+		stats:    s,
+		shard:    shard,
+		endpoint: endpoint,
+		target:   target,
+		start:    time.Now(),
+	}, context.WithValue(ctx, scrapeTargetKey{}, target)
+}
+
+type scrapeTargetKey struct{}
+
+// scrapeTarget is the target a request is made for, "none" if the request
+// is not part of a scrape.
+func scrapeTarget(ctx context.Context) string {
+	target, ok := ctx.Value(scrapeTargetKey{}).(string)
+	if !ok {
+		return "none"
+	}
+	return target
+}
+
+func (sc *scrape) failed(reason string, err error) {
+	sc.stats.failures.WithLabelValues(sc.shard, sc.target, sc.endpoint, reason).Inc()
+	sc.stats.up.WithLabelValues(sc.shard, sc.target).Set(0)
+	sc.done(HealthDown, err, 0)
+}
+
+func (sc *scrape) succeeded(series int) {
+	sc.stats.up.WithLabelValues(sc.shard, sc.target).Set(1)
+	sc.stats.lastOK.WithLabelValues(sc.shard, sc.target).SetToCurrentTime()
+	sc.done(HealthUp, nil, series)
+}
+
+func (sc *scrape) done(health string, err error, series int) {
+	sc.stats.mu.Lock()
+	defer sc.stats.mu.Unlock()
+
+	st := sc.stats.status(sc.shard, sc.endpoint, sc.target)
+	st.Health = health
+	st.LastScrape = sc.start
+	st.Duration = time.Since(sc.start)
+	st.LastError = ""
+	if err != nil {
+		st.LastError = err.Error()
+	}
+	st.Series = series
+}
+
+func (s *scrapeStats) observeRequest(shard, target, endpoint string, took time.Duration, size int) {
+	s.duration.WithLabelValues(shard, target, endpoint).Observe(took.Seconds())
+	if size >= 0 {
+		s.size.WithLabelValues(shard, target, endpoint).Observe(float64(size))
+	}
+}
+
+func (s *scrapeStats) Describe(descs chan<- *prometheus.Desc) {
+	s.attempts.Describe(descs)
+	s.failures.Describe(descs)
+	s.duration.Describe(descs)
+	s.size.Describe(descs)
+	s.up.Describe(descs)
+	s.lastOK.Describe(descs)
+	s.segmentSize.Describe(descs)
+}
+
+func (s *scrapeStats) Collect(metrics chan<- prometheus.Metric) {
+	s.attempts.Collect(metrics)
+	s.failures.Collect(metrics)
+	s.duration.Collect(metrics)
+	s.size.Collect(metrics)
+	s.up.Collect(metrics)
+	s.lastOK.Collect(metrics)
+	s.segmentSize.Collect(metrics)
+}
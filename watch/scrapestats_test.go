@@ -0,0 +1,140 @@
+package watch_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Emyrk/screeps-watcher/watch"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrapeStats(t *testing.T) {
+	var status atomic.Int64
+	var body atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/user/memory-segment" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.WriteHeader(int(status.Load()))
+		_, _ = rw.Write([]byte(body.Load().(string)))
+	}))
+	t.Cleanup(srv.Close)
+
+	segment := 77
+	w, err := watch.New(watch.WatchConfig{}, watch.WatcherOptions{
+		Name:            "test",
+		URL:             srv.URL,
+		Token:           "token",
+		MetricsInterval: time.Hour,
+		MemorySegments:  []watch.MemoryTargets{{Shard: "shard3", Metrics: &segment}},
+	}, zerolog.Nop())
+	require.NoError(t, err)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(w)
+
+	require.Equal(t, []watch.TargetStatus{{
+		Server:   "test",
+		Shard:    "shard3",
+		Target:   "metrics:77",
+		Endpoint: "/api/user/memory-segment",
+		Health:   watch.HealthUnknown,
+	}}, w.Targets())
+
+	// scrape runs a single scrape of the target.
+	scrape := func(code int, data string) watch.TargetStatus {
+		status.Store(int64(code))
+		body.Store(data)
+		before := w.Targets()[0].LastScrape
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			w.WatchMetrics(ctx)
+		}()
+		require.Eventually(t, func() bool {
+			return w.Targets()[0].LastScrape != before
+		}, time.Second*5, time.Millisecond*10)
+		cancel()
+		<-done
+		return w.Targets()[0]
+	}
+
+	st := scrape(http.StatusOK, `{"ok":1,"data":"{\"creeps\":12,\"cpu\":3}"}`)
+	require.Equal(t, watch.HealthUp, st.Health)
+	require.Equal(t, 2, st.Series)
+	require.Empty(t, st.LastError)
+	require.Equal(t, float64(1), gaugeValue(t, reg, "screeps_watcher_target_up"))
+	lastOK := gaugeValue(t, reg, "screeps_watcher_target_last_success_unix_s")
+	require.InDelta(t, float64(time.Now().Unix()), lastOK, 5)
+	require.Equal(t, float64(len(`{"creeps":12,"cpu":3}`)), gaugeValue(t, reg, "screeps_watcher_segment_size_bytes"))
+	require.Equal(t, uint64(1), histogramCount(t, reg, "screeps_watcher_response_size_bytes"))
+
+	for _, c := range []struct {
+		code   int
+		body   string
+		reason string
+	}{
+		{code: http.StatusInternalServerError, reason: watch.ReasonHTTPStatus},
+		{code: http.StatusOK, body: `{"ok":1,"data":`, reason: watch.ReasonDecode},
+		{code: http.StatusOK, body: `{"ok":1,"data":"{\"creeps\":"}`, reason: watch.ReasonParse},
+		{code: http.StatusTooManyRequests, reason: watch.ReasonRateLimit},
+	} {
+		st := scrape(c.code, c.body)
+		require.Equal(t, watch.HealthDown, st.Health, c.reason)
+		require.NotEmpty(t, st.LastError, c.reason)
+		require.Equal(t, 0, st.Series, c.reason)
+		require.Equal(t, float64(1), counterValue(t, reg, "screeps_watcher_scrape_failures_total", "reason", c.reason), c.reason)
+		require.Equal(t, float64(0), gaugeValue(t, reg, "screeps_watcher_target_up"), c.reason)
+		// The last success is kept while the target is down.
+		require.Equal(t, lastOK, gaugeValue(t, reg, "screeps_watcher_target_last_success_unix_s"), c.reason)
+	}
+	require.Equal(t, float64(5), counterValue(t, reg, "screeps_watcher_scrapes_total", "target", "metrics:77"))
+	// Only responses that were read have a size.
+	require.Equal(t, uint64(3), histogramCount(t, reg, "screeps_watcher_response_size_bytes"))
+	require.Equal(t, uint64(5), metric(t, reg, "screeps_watcher_request_duration_seconds", "target", "metrics:77").GetHistogram().GetSampleCount())
+
+	// Requests that are not part of a scrape have no target.
+	require.Error(t, w.Authenticate(context.Background()))
+	require.Equal(t, uint64(1), metric(t, reg, "screeps_watcher_request_duration_seconds", "target", "none").GetHistogram().GetSampleCount())
+}
+
+// metric finds the only series of a family, or the one with the label value.
+func metric(t *testing.T, reg *prometheus.Registry, name, label, value string) *dto.Metric {
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if label == "" || (l.GetName() == label && l.GetValue() == value) {
+					return m
+				}
+			}
+		}
+	}
+	t.Fatalf("no series of %s with %s=%q", name, label, value)
+	return nil
+}
+
+func gaugeValue(t *testing.T, reg *prometheus.Registry, name string) float64 {
+	return metric(t, reg, name, "", "").GetGauge().GetValue()
+}
+
+func counterValue(t *testing.T, reg *prometheus.Registry, name, label, value string) float64 {
+	return metric(t, reg, name, label, value).GetCounter().GetValue()
+}
+
+func histogramCount(t *testing.T, reg *prometheus.Registry, name string) uint64 {
+	return metric(t, reg, name, "", "").GetHistogram().GetSampleCount()
+}
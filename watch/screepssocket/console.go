@@ -7,7 +7,10 @@ import (
 	"github.com/rs/zerolog"
 )
 
-func LogConsolePayload(logger zerolog.Logger, msg any, intercept HandleConsoleLog) {
+// LogConsolePayload logs every line of a console message. Lines are passed to
+// intercept first, and lines that are not intercepted are passed to sink after
+// they are logged. Both may be nil.
+func LogConsolePayload(logger zerolog.Logger, msg any, intercept HandleConsoleLog, sink ConsoleLogSink) {
 	payload, ok := msg.(map[string]any)
 	if !ok {
 		logger.Error().Any("msg", msg).Msg("handle console payload failed")
@@ -36,25 +39,13 @@ func LogConsolePayload(logger zerolog.Logger, msg any, intercept HandleConsoleLo
 						}
 
 						lineStr = strings.TrimSpace(RemoveHTMLTags(lineStr))
-						lvl := zerolog.InfoLevel
-						if len(lineStr) > 3 {
-							level := lineStr[:3]
-							switch level {
-							case "FTL":
-								lvl = zerolog.FatalLevel
-							case "ERR":
-								lvl = zerolog.ErrorLevel
-							case "WRN":
-								lvl = zerolog.WarnLevel
-							case "INF":
-								lvl = zerolog.InfoLevel
-							case "DBG":
-								lvl = zerolog.DebugLevel
-							}
-						}
+						lvl := ConsoleLevel(lineStr)
 
 						// Log formats use HTML for colors. Let's make this better.
 						logger.WithLevel(lvl).Msg(lineStr)
+						if sink != nil {
+							sink(ConsoleLogMeta{Shard: shard}, lvl, lineStr)
+						}
 					}
 				} else {
 					logger.Error().Any("log", logs).Msg("Failed to parse log messages")
@@ -64,6 +55,26 @@ func LogConsolePayload(logger zerolog.Logger, msg any, intercept HandleConsoleLo
 	}
 }
 
+// ConsoleLevel is the level of a console line from its FTL, ERR, WRN, INF or
+// DBG prefix. Lines without a prefix are info.
+func ConsoleLevel(line string) zerolog.Level {
+	if len(line) <= 3 {
+		return zerolog.InfoLevel
+	}
+	switch line[:3] {
+	case "FTL":
+		return zerolog.FatalLevel
+	case "ERR":
+		return zerolog.ErrorLevel
+	case "WRN":
+		return zerolog.WarnLevel
+	case "DBG":
+		return zerolog.DebugLevel
+	default:
+		return zerolog.InfoLevel
+	}
+}
+
 var fontRegex = regexp.MustCompile(`<font color='(?P<color>[^']+)'>(?P<text>[^<]+)<\/font>`)
 
 func RemoveHTMLTags(s string) string {
@@ -0,0 +1,44 @@
+package screepssocket
+
+import (
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogConsolePayloadSink(t *testing.T) {
+	payload := map[string]any{
+		"shard": "shard3",
+		"messages": map[string]any{
+			"log": []any{
+				"<font color='red'>ERR creep stuck</font>",
+				"WRN low bucket",
+				"FTL out of cpu",
+				"DBG pathing",
+				"spawned harvester",
+				`<span id="profile-report" data="[]">Profiling Report</span>`,
+			},
+		},
+	}
+
+	type line struct {
+		Level zerolog.Level
+		Msg   string
+	}
+	var got []line
+	LogConsolePayload(zerolog.Nop(), payload, func(_ zerolog.Logger, _ ConsoleLogMeta, msg string) bool {
+		return msg == `<span id="profile-report" data="[]">Profiling Report</span>`
+	}, func(meta ConsoleLogMeta, level zerolog.Level, msg string) {
+		require.Equal(t, "shard3", meta.Shard)
+		got = append(got, line{Level: level, Msg: msg})
+	})
+
+	require.Equal(t, []line{
+		{Level: zerolog.ErrorLevel, Msg: "ERR creep stuck"},
+		{Level: zerolog.WarnLevel, Msg: "WRN low bucket"},
+		{Level: zerolog.FatalLevel, Msg: "FTL out of cpu"},
+		{Level: zerolog.DebugLevel, Msg: "DBG pathing"},
+		{Level: zerolog.InfoLevel, Msg: "spawned harvester"},
+	}, got)
+}
@@ -28,6 +28,10 @@ type ConsoleLogMeta struct {
 // and not passed on to default handling.
 type HandleConsoleLog func(logger zerolog.Logger, meta ConsoleLogMeta, msg string) bool
 
+// ConsoleLogSink takes every console log line that was not intercepted, without
+// its html, along with the level from its prefix.
+type ConsoleLogSink func(meta ConsoleLogMeta, level zerolog.Level, msg string)
+
 type ScreepsWebsocket struct {
 	URL        *url.URL
 	logger     zerolog.Logger
@@ -45,9 +49,12 @@ type ScreepsWebsocket struct {
 
 	// intercepts
 	consoleIntercept HandleConsoleLog
+	consoleSink      ConsoleLogSink
 }
 
-func New(ctx context.Context, URL *url.URL, logger zerolog.Logger, cli *http.Client, authMethod auth.Method, channels []string, labels prometheus.Labels) (*ScreepsWebsocket, error) {
+// New creates a websocket for the channels of the user. If userID is empty,
+// it is looked up from the server.
+func New(ctx context.Context, URL *url.URL, logger zerolog.Logger, cli *http.Client, authMethod auth.Method, channels []string, userID string, labels prometheus.Labels) (*ScreepsWebsocket, error) {
 	wbs := &ScreepsWebsocket{
 		URL:        URL,
 		logger:     logger,
@@ -79,19 +86,31 @@ func New(ctx context.Context, URL *url.URL, logger zerolog.Logger, cli *http.Cli
 		wbs.logger.Error().Err(err).Msg("Failed to create websocket URL")
 		return nil, err
 	}
-	userID, err := wbs.MyUserID(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("get user ID: %w", err)
+	if userID == "" {
+		userID, err = wbs.MyUserID(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("get user ID: %w", err)
+		}
 	}
 	wbs.userID = userID
 
 	return wbs, nil
 }
 
+// UserID is the id of the user whose channels are subscribed to.
+func (s *ScreepsWebsocket) UserID() string {
+	return s.userID
+}
+
 func (s *ScreepsWebsocket) InterceptConsoleLog(handle HandleConsoleLog) {
 	s.consoleIntercept = handle
 }
 
+// ForwardConsoleLog sends console log lines to sink as well as the logger.
+func (s *ScreepsWebsocket) ForwardConsoleLog(sink ConsoleLogSink) {
+	s.consoleSink = sink
+}
+
 func (s *ScreepsWebsocket) Collect(ch chan<- prometheus.Metric) {
 	s.reg.Collect(ch)
 }
@@ -151,7 +170,18 @@ func (s *ScreepsWebsocket) newURL() (*url.URL, error) {
 	return wsURL, nil
 }
 
+// Run keeps a websocket session open until ctx is canceled, and then closes
+// it normally before returning.
 func (s *ScreepsWebsocket) Run(ctx context.Context) {
+	retry := func() bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(time.Second * 10):
+			return true
+		}
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -162,17 +192,28 @@ func (s *ScreepsWebsocket) Run(ctx context.Context) {
 
 		session, err := s.dial(ctx)
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
 			s.logger.Error().Err(err).Msg("Failed to dial websocket, will retry...")
-			time.Sleep(time.Second * 10)
+			if !retry() {
+				return
+			}
 			continue
 		}
 
 		s.logger.Info().Msg("Websocket session started")
 		s.session = session
 		err = session.Watch(ctx)
+		if ctx.Err() != nil {
+			s.logger.Info().Msg("Websocket session closed")
+			return
+		}
 		if err != nil {
 			s.logger.Error().Err(err).Msg("Websocket session failed")
-			time.Sleep(time.Second * 10)
+			if !retry() {
+				return
+			}
 			continue
 		}
 	}
@@ -209,6 +250,9 @@ type Session struct {
 	subscribeTo map[string]bool
 }
 
+// Channels are the websocket channels that can be subscribed to.
+var Channels = []string{"console", "cpu"}
+
 func (s *ScreepsWebsocket) channelsMap() map[string]bool {
 	m := make(map[string]bool)
 	for _, c := range s.channels {
@@ -250,9 +294,19 @@ func (s *ScreepsWebsocket) dial(ctx context.Context) (*Session, error) {
 	}, nil
 }
 
+// Watch reads from the session until it fails or ctx is canceled. On cancel,
+// the session is closed with a normal closure.
 func (s *Session) Watch(ctx context.Context) error {
+	// Canceling a read closes the connection with a policy violation, so
+	// reads are not canceled. Closing the session ends the read instead.
+	stop := context.AfterFunc(ctx, func() {
+		_ = s.Close()
+	})
+	defer stop()
+
+	readCtx := context.WithoutCancel(ctx)
 	for {
-		_, data, err := s.conn.Read(ctx)
+		_, data, err := s.conn.Read(readCtx)
 		if websocket.CloseStatus(err) != -1 {
 			return fmt.Errorf("websocket closed: %w", err)
 		}
@@ -379,7 +433,7 @@ func (s *Session) handleSliceMessage(ctx context.Context, msg []any) {
 				Str("channel_type", channelType).
 				Str("channel_name", channelName).
 				Str("user_id", userID).
-				Logger(), msg[1], s.websocket.consoleIntercept)
+				Logger(), msg[1], s.websocket.consoleIntercept, s.websocket.consoleSink)
 			return
 		}
 
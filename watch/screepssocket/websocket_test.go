@@ -0,0 +1,63 @@
+package screepssocket_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Emyrk/screeps-watcher/watch/auth"
+	"github.com/Emyrk/screeps-watcher/watch/screepssocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"nhooyr.io/websocket"
+)
+
+func TestRunClosesNormally(t *testing.T) {
+	accepted := make(chan struct{})
+	closed := make(chan websocket.StatusCode, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(rw, r, nil)
+		if err != nil {
+			return
+		}
+		// Wait for the client to authenticate, so the session is running.
+		_ = conn.Write(context.Background(), websocket.MessageText, []byte("o"))
+		_, _, _ = conn.Read(context.Background())
+		close(accepted)
+		for {
+			_, _, err := conn.Read(context.Background())
+			if err != nil {
+				closed <- websocket.CloseStatus(err)
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	sock, err := screepssocket.New(ctx, u, zerolog.Nop(), srv.Client(), &auth.Token{AuthToken: "token"},
+		[]string{"console"}, "user", prometheus.Labels{})
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		sock.Run(ctx)
+		close(done)
+	}()
+
+	<-accepted
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("run did not return")
+	}
+	require.Equal(t, websocket.StatusNormalClosure, <-closed)
+}
@@ -0,0 +1,106 @@
+package watch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/Emyrk/screeps-watcher/watch/auth"
+)
+
+// secretCommandTimeout bounds how long a token_command may run.
+const secretCommandTimeout = time.Second * 30
+
+// newAuthMethod builds the auth method of a server, resolving any secret that is
+// stored outside the config.
+func newAuthMethod(opts WatcherOptions) (auth.Method, error) {
+	password, err := resolveSecret(opts.Password, opts.PasswordFile, "")
+	if err != nil {
+		return nil, fmt.Errorf("resolve password for %q: %w", opts.Name, err)
+	}
+
+	token, err := resolveSecret(opts.Token, opts.TokenFile, opts.TokenCommand)
+	if err != nil {
+		return nil, fmt.Errorf("resolve token for %q: %w", opts.Name, err)
+	}
+
+	if password != "" && token != "" {
+		return nil, fmt.Errorf("cannot provide both toke and password fields for %q", opts.Name)
+	}
+
+	if password != "" {
+		return &auth.Password{
+			Username: opts.Username,
+			Password: password,
+		}, nil
+	}
+	return &auth.Token{
+		Username:  opts.Username,
+		AuthToken: token,
+	}, nil
+}
+
+// resolveSecret returns whichever of the literal value, the file content or
+// the command output is set. Setting more than one is an error.
+func resolveSecret(value, file, command string) (string, error) {
+	set := 0
+	for _, s := range []string{value, file, command} {
+		if s != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return "", fmt.Errorf("only one of the literal value, file or command can be set")
+	}
+
+	switch {
+	case file != "":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("read file: %w", err)
+		}
+		secret := strings.TrimSpace(string(data))
+		if secret == "" {
+			return "", fmt.Errorf("file %q is empty", file)
+		}
+		return secret, nil
+	case command != "":
+		ctx, cancel := context.WithTimeout(context.Background(), secretCommandTimeout)
+		defer cancel()
+
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("run command: %w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		secret := strings.TrimSpace(string(out))
+		if secret == "" {
+			return "", fmt.Errorf("command printed nothing")
+		}
+		return secret, nil
+	default:
+		return value, nil
+	}
+}
+
+// secretsHash is the sha256 of the resolved password and token of a server,
+// so a rotated secret file or token command output can be told apart from
+// unchanged options.
+func secretsHash(opts WatcherOptions) ([32]byte, error) {
+	password, err := resolveSecret(opts.Password, opts.PasswordFile, "")
+	if err != nil {
+		return [32]byte{}, fmt.Errorf("resolve password for %q: %w", opts.Name, err)
+	}
+	token, err := resolveSecret(opts.Token, opts.TokenFile, opts.TokenCommand)
+	if err != nil {
+		return [32]byte{}, fmt.Errorf("resolve token for %q: %w", opts.Name, err)
+	}
+	return sha256.Sum256([]byte(password + "\x00" + token)), nil
+}
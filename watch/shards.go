@@ -0,0 +1,181 @@
+package watch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+const shardsInfoPath = "/api/game/shards/info"
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// matchShard reports if the shard matches any of the target's shard names
+// or globs.
+func (m MemoryTargets) matchShard(shard string) bool {
+	patterns := m.Shards
+	if m.Shard != "" {
+		patterns = append([]string{m.Shard}, patterns...)
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, shard); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type shardsInfoResponse struct {
+	Shards []struct {
+		Name string `json:"name"`
+	} `json:"shards"`
+}
+
+type meResponse struct {
+	// CPUShard is the cpu allocated to each shard. Private servers do not
+	// have it.
+	CPUShard map[string]float64 `json:"cpuShard"`
+}
+
+// ActiveShards returns the shards of the server the account has cpu on.
+// Servers without shards return the single "none" shard, which is what
+// targets without a shard use.
+func (w *Watcher) ActiveShards(ctx context.Context) ([]string, error) {
+	data, err := w.get(ctx, shardsInfoPath, nil)
+	var status *StatusError
+	if errors.As(err, &status) && status.StatusCode == http.StatusNotFound {
+		return []string{"none"}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get shards: %w", err)
+	}
+
+	var info shardsInfoResponse
+	err = json.Unmarshal(data, &info)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal shards: %w", err)
+	}
+	if len(info.Shards) == 0 {
+		return []string{"none"}, nil
+	}
+
+	data, err = w.get(ctx, authMePath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("get account: %w", err)
+	}
+
+	var me meResponse
+	err = json.Unmarshal(data, &me)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal account: %w", err)
+	}
+
+	shards := make([]string, 0, len(info.Shards))
+	for _, s := range info.Shards {
+		// Without cpu allocations, every shard is active.
+		if me.CPUShard != nil && me.CPUShard[s.Name] <= 0 {
+			continue
+		}
+		shards = append(shards, s.Name)
+	}
+	slices.Sort(shards)
+	return shards, nil
+}
+
+// WatchShards periodically discovers the active shards, and creates or
+// retires the targets of targets with shard globs.
+func (w *Watcher) WatchShards(ctx context.Context) {
+	if len(w.discoverTargets) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(w.shardDiscoveryInterval)
+	defer ticker.Stop()
+	logger := w.logger.With().Str("data", "shards").Logger()
+	for {
+		shards, err := w.ActiveShards(ctx)
+		if err != nil {
+			logEvent(logger, err).Msg("failed to discover shards")
+		} else {
+			w.syncShards(shards)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// syncShards makes sure there is a target for every active shard matched by
+// a discovering target. Shards with a target configured by name are left
+// alone, and the first discovering target to match a shard wins.
+func (w *Watcher) syncShards(shards []string) {
+	w.targetsMu.Lock()
+	defer w.targetsMu.Unlock()
+
+	current := make(map[string]*MemoryTargets)
+	for _, t := range w.memoryTargets {
+		current[t.Shard] = t
+	}
+
+	wanted := make(map[string]bool)
+	targets := make([]*MemoryTargets, 0, len(w.memoryTargets))
+	for _, t := range w.memoryTargets {
+		if !t.discovered {
+			targets = append(targets, t)
+			wanted[t.Shard] = true
+		}
+	}
+
+	for _, shard := range shards {
+		if wanted[shard] {
+			continue
+		}
+		for _, dt := range w.discoverTargets {
+			if !dt.matchShard(shard) {
+				continue
+			}
+			wanted[shard] = true
+			if existing, ok := current[shard]; ok {
+				targets = append(targets, existing)
+				break
+			}
+
+			tgt := w.newMemoryTarget(dt, shard)
+			tgt.discovered = true
+			targets = append(targets, tgt)
+			w.logger.Info().Str("shard", shard).Msg("discovered shard")
+			break
+		}
+	}
+
+	for shard, t := range current {
+		if wanted[shard] {
+			continue
+		}
+		if t.MetricSegment() >= 0 {
+			w.stats.unregister(shard, t.metricsName())
+		}
+		if t.ProfileSegment() >= 0 {
+			w.stats.unregister(shard, t.profileName())
+		}
+		w.stats.unregister(shard, tickTarget)
+		w.ticks.forget(shard)
+		w.logger.Info().Str("shard", shard).Msg("retired shard")
+	}
+
+	slices.SortFunc(targets, func(a, b *MemoryTargets) int {
+		return strings.Compare(a.Shard, b.Shard)
+	})
+	w.memoryTargets = targets
+}
@@ -0,0 +1,88 @@
+package watch_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Emyrk/screeps-watcher/watch"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardDiscovery(t *testing.T) {
+	var cpuShard atomic.Value
+	cpuShard.Store(map[string]float64{"shard0": 0, "shard1": 10, "shard3": 20})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/game/shards/info":
+			_, _ = rw.Write([]byte(`{"ok":1,"shards":[{"name":"shard0"},{"name":"shard1"},{"name":"shard2"},{"name":"shard3"}]}`))
+		case "/api/auth/me":
+			_ = json.NewEncoder(rw).Encode(map[string]any{"_id": "abc", "cpuShard": cpuShard.Load()})
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	segment := 77
+	w, err := watch.New(watch.WatchConfig{}, watch.WatcherOptions{
+		Name:                   "test",
+		URL:                    srv.URL,
+		Token:                  "token",
+		ShardDiscoveryInterval: time.Millisecond * 10,
+		MemorySegments: []watch.MemoryTargets{
+			{Shard: "*", Metrics: &segment},
+			// Configured by name, so never retired.
+			{Shard: "shard0", Metrics: &segment},
+		},
+	}, zerolog.Nop())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go w.WatchShards(ctx)
+
+	shards := func() []string {
+		names := make([]string, 0)
+		for _, s := range w.Segments() {
+			names = append(names, s.Shard)
+		}
+		return names
+	}
+
+	require.Eventually(t, func() bool {
+		return len(shards()) == 3
+	}, time.Second*5, time.Millisecond*10)
+	require.Equal(t, []string{"shard0", "shard1", "shard3"}, shards())
+
+	// The account moves its cpu to another shard.
+	cpuShard.Store(map[string]float64{"shard2": 20})
+	require.Eventually(t, func() bool {
+		s := shards()
+		return len(s) == 2 && s[0] == "shard0" && s[1] == "shard2"
+	}, time.Second*5, time.Millisecond*10)
+}
+
+func TestShardDiscoveryPrivateServer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(srv.Close)
+
+	w, err := watch.New(watch.WatchConfig{}, watch.WatcherOptions{
+		Name:              "test",
+		URL:               srv.URL,
+		WebsocketChannels: []string{"console"},
+	}, zerolog.Nop())
+	require.NoError(t, err)
+
+	shards, err := w.ActiveShards(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{"none"}, shards)
+}
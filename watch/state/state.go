@@ -0,0 +1,111 @@
+// Package state persists small pieces of watcher state across restarts.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Store keeps each key as a json file in a directory. A nil *Store is valid
+// and stores nothing, so callers do not need to check if persistence is
+// enabled.
+type Store struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// Open creates the directory if needed and returns a store backed by it.
+func Open(dir string) (*Store, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("create state dir: %w", err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+func (s *Store) path(key string) string {
+	return filepath.Join(s.dir, url.PathEscape(key)+".json")
+}
+
+// Load decodes the value of the key into v. It returns false if the key was
+// never saved.
+func (s *Store) Load(key string, v any) (bool, error) {
+	if s == nil {
+		return false, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("read %q: %w", key, err)
+	}
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return false, fmt.Errorf("decode %q: %w", key, err)
+	}
+	return true, nil
+}
+
+// Save replaces the value of the key. The file is replaced atomically, so a
+// crash never leaves a partially written value behind.
+func (s *Store) Save(key string, v any) error {
+	if s == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encode %q: %w", key, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		_ = tmp.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("write %q: %w", key, err)
+	}
+
+	err = os.Rename(tmp.Name(), s.path(key))
+	if err != nil {
+		return fmt.Errorf("replace %q: %w", key, err)
+	}
+	err = syncDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("sync %q: %w", key, err)
+	}
+	return nil
+}
+
+// syncDir flushes a rename in the dir to disk.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
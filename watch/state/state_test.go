@@ -0,0 +1,41 @@
+package state_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Emyrk/screeps-watcher/watch/state"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := state.Open(dir)
+	require.NoError(t, err)
+
+	type value struct {
+		Name string
+		At   time.Time
+	}
+	var got value
+	ok, err := s.Load("metrics/shard3", &got)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	want := value{Name: "test", At: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	require.NoError(t, s.Save("metrics/shard3", want))
+
+	// A new store over the same dir sees the saved value.
+	s, err = state.Open(dir)
+	require.NoError(t, err)
+	ok, err = s.Load("metrics/shard3", &got)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, want, got)
+
+	var disabled *state.Store
+	require.NoError(t, disabled.Save("key", want))
+	ok, err = disabled.Load("key", &got)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
@@ -0,0 +1,165 @@
+package watch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	gameTimePath = "/api/game/time"
+	// tickTarget is the target name of the tick poll on the targets page.
+	tickTarget = "tick"
+)
+
+type gameTimeResponse struct {
+	Time int64 `json:"time"`
+}
+
+// GameTime returns the current game tick of the shard.
+func (w *Watcher) GameTime(ctx context.Context, shard string) (int64, error) {
+	vals := url.Values{}
+	if shard != "" && shard != "none" {
+		vals.Set("shard", shard)
+	}
+	data, err := w.get(ctx, gameTimePath, vals)
+	if err != nil {
+		return 0, err
+	}
+
+	var resp gameTimeResponse
+	err = json.Unmarshal(data, &resp)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrDecode, err)
+	}
+	return resp.Time, nil
+}
+
+// WatchTicks periodically polls the game tick of every shard with a memory
+// target. The tick is passed on to the target collectors, so they can tell
+// how old their segment is.
+func (w *Watcher) WatchTicks(ctx context.Context) {
+	if len(w.Segments()) == 0 && len(w.discoverTargets) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(w.tickInterval)
+	defer ticker.Stop()
+	logger := w.logger.With().Str("data", "ticks").Logger()
+	for {
+		targets := w.Segments()
+		shards := make([]string, 0, len(targets))
+		for _, target := range targets {
+			if !slices.Contains(shards, target.Shard) {
+				shards = append(shards, target.Shard)
+			}
+		}
+
+		for _, shard := range shards {
+			scrape, scrapeCtx := w.stats.start(ctx, shard, gameTimePath, tickTarget)
+			tick, err := w.GameTime(scrapeCtx, shard)
+			if err != nil {
+				scrape.failed(FailureReason(err), err)
+				logEvent(logger.With().Str("shard", shard).Logger(), err).Msg("failed to get game time")
+				continue
+			}
+			scrape.succeeded(1)
+			w.ticks.observe(shard, tick, time.Now())
+			for _, target := range targets {
+				if target.Shard == shard {
+					target.collector.SetGameTick(tick)
+				}
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type tickSample struct {
+	tick int64
+	at   time.Time
+}
+
+var _ prometheus.Collector = (*tickPoller)(nil)
+
+// tickPoller keeps the last polled tick of each shard, and exports the tick
+// and how long ticks take.
+type tickPoller struct {
+	mu   sync.Mutex
+	last map[string]tickSample
+
+	gameTick     *prometheus.GaugeVec
+	tickDuration *prometheus.GaugeVec
+}
+
+func newTickPoller(labels prometheus.Labels) *tickPoller {
+	return &tickPoller{
+		last: make(map[string]tickSample),
+		gameTick: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "screeps",
+			Subsystem:   "game",
+			Name:        "tick",
+			Help:        "Current game tick of the shard.",
+			ConstLabels: labels,
+		}, []string{"shard"}),
+		tickDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "screeps",
+			Subsystem:   "game",
+			Name:        "tick_duration_seconds",
+			Help:        "Average duration of a tick of the shard between the last two polls.",
+			ConstLabels: labels,
+		}, []string{"shard"}),
+	}
+}
+
+func (p *tickPoller) observe(shard string, tick int64, at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.gameTick.WithLabelValues(shard).Set(float64(tick))
+	if last, ok := p.last[shard]; ok && tick > last.tick {
+		elapsed := at.Sub(last.at).Seconds()
+		p.tickDuration.WithLabelValues(shard).Set(elapsed / float64(tick-last.tick))
+	}
+	p.last[shard] = tickSample{tick: tick, at: at}
+}
+
+// forget drops a shard that is no longer scraped.
+func (p *tickPoller) forget(shard string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.last, shard)
+	p.gameTick.DeleteLabelValues(shard)
+	p.tickDuration.DeleteLabelValues(shard)
+}
+
+// tick returns the last polled tick of the shard.
+func (p *tickPoller) tick(shard string) (int64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	last, ok := p.last[shard]
+	return last.tick, ok
+}
+
+func (p *tickPoller) Describe(descs chan<- *prometheus.Desc) {
+	p.gameTick.Describe(descs)
+	p.tickDuration.Describe(descs)
+}
+
+func (p *tickPoller) Collect(metrics chan<- prometheus.Metric) {
+	p.gameTick.Collect(metrics)
+	p.tickDuration.Collect(metrics)
+}
@@ -0,0 +1,71 @@
+package watch_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Emyrk/screeps-watcher/watch"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchTicks(t *testing.T) {
+	var tick atomic.Int64
+	tick.Store(1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/game/time":
+			if r.URL.Query().Get("shard") != "shard3" {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_, _ = fmt.Fprintf(rw, `{"ok":1,"time":%d}`, tick.Add(1))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	segment := 77
+	w, err := watch.New(watch.WatchConfig{}, watch.WatcherOptions{
+		Name:           "test",
+		URL:            srv.URL,
+		Token:          "token",
+		TickInterval:   time.Millisecond * 10,
+		MemorySegments: []watch.MemoryTargets{{Shard: "shard3", Metrics: &segment}},
+	}, zerolog.Nop())
+	require.NoError(t, err)
+
+	got, err := w.GameTime(context.Background(), "shard3")
+	require.NoError(t, err)
+	require.Equal(t, int64(1001), got)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go w.WatchTicks(ctx)
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(w)
+	require.Eventually(t, func() bool {
+		families, err := reg.Gather()
+		require.NoError(t, err)
+		found := 0
+		for _, f := range families {
+			switch f.GetName() {
+			case "screeps_game_tick":
+				if f.GetMetric()[0].GetGauge().GetValue() > 1001 {
+					found++
+				}
+			case "screeps_game_tick_duration_seconds":
+				found++
+			}
+		}
+		return found == 2
+	}, time.Second*5, time.Millisecond*10)
+}
@@ -2,18 +2,31 @@ package watch
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Emyrk/screeps-watcher/watch/auth"
+	"github.com/Emyrk/screeps-watcher/watch/graphite"
 	"github.com/Emyrk/screeps-watcher/watch/market"
 	"github.com/Emyrk/screeps-watcher/watch/memcollector"
+	"github.com/Emyrk/screeps-watcher/watch/memory"
+	"github.com/Emyrk/screeps-watcher/watch/otlp"
 	"github.com/Emyrk/screeps-watcher/watch/profiling"
 	"github.com/Emyrk/screeps-watcher/watch/profiling/eluded"
+	"github.com/Emyrk/screeps-watcher/watch/ratelimit"
+	"github.com/Emyrk/screeps-watcher/watch/remotewrite"
 	"github.com/Emyrk/screeps-watcher/watch/screepssocket"
+	"github.com/Emyrk/screeps-watcher/watch/state"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 )
@@ -22,7 +35,19 @@ var _ prometheus.Collector = (*Watcher)(nil)
 
 type WatchConfig struct {
 	Pyroscope PyroscopeSettings `yaml:"pyroscope"`
-	Servers   []WatcherOptions  `yaml:"servers"`
+	// DataDir is where each server keeps state across restarts, like rate
+	// limits and the last scraped metrics. Nothing is kept if empty.
+	DataDir string `yaml:"data_dir"`
+	// RemoteWrite pushes all metrics to remote write endpoints. It is only
+	// read at startup.
+	RemoteWrite []remotewrite.Config `yaml:"remote_write"`
+	// Graphite writes the memory segments as graphite paths. It is only
+	// read at startup.
+	Graphite graphite.Config `yaml:"graphite"`
+	// OTLP sends metrics, console logs and profiles to an OpenTelemetry
+	// collector. It is only read at startup.
+	OTLP    otlp.Config      `yaml:"otlp"`
+	Servers []WatcherOptions `yaml:"servers"`
 }
 
 type PyroscopeSettings struct {
@@ -35,6 +60,12 @@ type WatcherOptions struct {
 	Username string `yaml:"username"`
 	Password string `yaml:"password"`
 	Token    string `yaml:"token"`
+	// Secrets can be kept out of the config. Only one way of providing
+	// each secret may be used.
+	PasswordFile string `yaml:"password_file"`
+	TokenFile    string `yaml:"token_file"`
+	// TokenCommand is run with 'sh -c' and its output is the token.
+	TokenCommand string `yaml:"token_command"`
 
 	// Each target is a single scrape endpoint
 	MemorySegments    []MemoryTargets `yaml:"targets"`
@@ -42,6 +73,18 @@ type WatcherOptions struct {
 	MetricsInterval   time.Duration   `yaml:"metrics_scrape_interval"`
 	MarketInterval    time.Duration   `yaml:"market_scrape_interval"`
 	WebsocketChannels []string        `yaml:"websocket_channels"`
+	// RateLimitMaxWait is how long a request waits for the rate limit budget
+	// before it is skipped instead.
+	RateLimitMaxWait time.Duration `yaml:"rate_limit_max_wait"`
+	// ShardDiscoveryInterval is how often targets with shard globs look for
+	// new or removed shards.
+	ShardDiscoveryInterval time.Duration `yaml:"shard_discovery_interval"`
+	// TickInterval is how often the game tick of each scraped shard is
+	// polled.
+	TickInterval time.Duration `yaml:"tick_interval"`
+	// MetricRelabelConfigs apply to every target of the server, before the
+	// rules of the target.
+	MetricRelabelConfigs []memcollector.RelabelConfig `yaml:"metric_relabel_configs"`
 }
 
 type ProfileTarget struct {
@@ -50,27 +93,98 @@ type ProfileTarget struct {
 }
 
 type MemoryTargets struct {
-	Shard       string            `yaml:"shard"`
-	Metrics     *int              `yaml:"metrics_segment"`
-	Profile     *int              `yaml:"profile_segment"`
-	ConstLabels prometheus.Labels `yaml:"constant_labels"`
+	// Shard is either a shard name or a glob like "*" to scrape every active
+	// shard of the account that matches.
+	Shard string `yaml:"shard"`
+	// Shards are more shard names or globs, for targets spanning shards.
+	Shards  []string `yaml:"shards"`
+	Metrics *int     `yaml:"metrics_segment"`
+	Profile *int     `yaml:"profile_segment"`
+	// MetricsSegments and ProfileSegments split a document that does not fit
+	// in one segment. The segments are merged in order before being parsed.
+	MetricsSegments []int             `yaml:"metrics_segments"`
+	ProfileSegments []int             `yaml:"profile_segments"`
+	ConstLabels     prometheus.Labels `yaml:"constant_labels"`
+	// StaleAfterTicks stops exposing the metrics of a segment that has not
+	// been written for this many ticks. It needs the bot to write the tick
+	// to the "__tick" key of the metrics segment. 0 never hides them.
+	StaleAfterTicks int64 `yaml:"stale_after_ticks"`
+	// Limits cap the series of the metrics segment.
+	Limits memcollector.Limits `yaml:"limits"`
+	// MetricRelabelConfigs rewrite or drop the series of the metrics segment
+	// before they are stored.
+	MetricRelabelConfigs []memcollector.RelabelConfig `yaml:"metric_relabel_configs"`
+	// Values chooses how arrays, booleans and strings in the segment are
+	// read.
+	Values memcollector.ValueOptions `yaml:"values"`
+	// Format is the format of the metrics segment, one of
+	// memcollector.Formats. It is detected from the segment if empty.
+	Format string `yaml:"format"`
+	// Encoding is how the bot compresses its segments, one of
+	// memory.Encodings. It is detected from each segment if empty.
+	Encoding string `yaml:"encoding"`
 
 	serverName string
 	collector  *memcollector.Collector
+	// discovered targets were created by shard discovery.
+	discovered bool
 }
 
+// MetricSegment returns the first metrics segment, or -1 if there is none.
 func (m MemoryTargets) MetricSegment() int {
-	if m.Metrics == nil {
-		return -1
+	if ids := m.MetricSegmentIDs(); len(ids) > 0 {
+		return ids[0]
 	}
-	return *m.Metrics
+	return -1
 }
 
+// ProfileSegment returns the first profile segment, or -1 if there is none.
 func (m MemoryTargets) ProfileSegment() int {
-	if m.Profile == nil {
-		return -1
+	if ids := m.ProfileSegmentIDs(); len(ids) > 0 {
+		return ids[0]
 	}
-	return *m.Profile
+	return -1
+}
+
+func (m MemoryTargets) MetricSegmentIDs() []int {
+	return segmentIDs(m.Metrics, m.MetricsSegments)
+}
+
+func (m MemoryTargets) ProfileSegmentIDs() []int {
+	return segmentIDs(m.Profile, m.ProfileSegments)
+}
+
+func segmentIDs(single *int, multiple []int) []int {
+	if single != nil {
+		return append([]int{*single}, multiple...)
+	}
+	return multiple
+}
+
+// discovers is true if the target's shards are found by shard discovery.
+func (m MemoryTargets) discovers() bool {
+	return len(m.Shards) > 0 || isGlob(m.Shard)
+}
+
+// decodeOptions are how the segments of the target are decoded.
+func (m MemoryTargets) decodeOptions() memory.DecodeOptions {
+	return memory.DecodeOptions{Encoding: m.Encoding}
+}
+
+func (m MemoryTargets) metricsName() string {
+	return "metrics:" + joinIDs(m.MetricSegmentIDs())
+}
+
+func (m MemoryTargets) profileName() string {
+	return "profile:" + joinIDs(m.ProfileSegmentIDs())
+}
+
+func joinIDs(ids []int) string {
+	strs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		strs = append(strs, strconv.Itoa(id))
+	}
+	return strings.Join(strs, ",")
 }
 
 type MarketTargets struct {
@@ -81,11 +195,20 @@ type MarketTargets struct {
 // Watcher will watch a screeps server and it's configured shards for
 // memory stats and logs.
 type Watcher struct {
-	Name           string
-	Username       string
-	URL            *url.URL
-	MemorySegments []*MemoryTargets
-	Markets        []MarketTargets
+	Name     string
+	Username string
+	URL      *url.URL
+	Markets  []MarketTargets
+
+	// targetsMu guards memoryTargets, which changes as shards are discovered.
+	targetsMu     sync.RWMutex
+	memoryTargets []*MemoryTargets
+	// discoverTargets are the targets with shard globs. They are scraped
+	// through the targets created for each matching shard.
+	discoverTargets        []MemoryTargets
+	shardDiscoveryInterval time.Duration
+	tickInterval           time.Duration
+	ticks                  *tickPoller
 
 	// TODO:
 	AuthMethod auth.Method
@@ -98,10 +221,21 @@ type Watcher struct {
 	reg               *prometheus.Registry
 	websocketChannels []string
 
-	// For backing off rate limits
-	memorySegmentRateLimitUntil time.Time
-	marketApiRateLimitUntil     time.Time
-	pusher                      *profiling.PyroscopePusher
+	// RateLimits is the request budget shared by all api calls to the server.
+	RateLimits       *ratelimit.Limiter
+	rateLimitMaxWait time.Duration
+	stats            *scrapeStats
+	state            *state.Store
+	// rateLimitsMu guards savedResets, the budget resets last saved.
+	rateLimitsMu  sync.Mutex
+	savedResets   map[string]time.Time
+	authenticated atomic.Bool
+	pusher        *profiling.PyroscopePusher
+	otlp          *otlp.Exporter
+	// historyConsumers read the history samples of every memory segment.
+	historyConsumers []string
+	// relabelConfigs are the metric relabel rules of the server.
+	relabelConfigs []memcollector.RelabelConfig
 }
 
 func New(global WatchConfig, opts WatcherOptions, logger zerolog.Logger) (*Watcher, error) {
@@ -109,8 +243,8 @@ func New(global WatchConfig, opts WatcherOptions, logger zerolog.Logger) (*Watch
 		return nil, fmt.Errorf("missing url field for server")
 	}
 
-	if len(opts.MemorySegments) == 0 {
-		return nil, fmt.Errorf("no targets configured for %q", opts.Name)
+	if len(opts.MemorySegments) == 0 && len(opts.Markets) == 0 && len(opts.WebsocketChannels) == 0 {
+		return nil, fmt.Errorf("no targets, markets or websocket channels configured for %q", opts.Name)
 	}
 
 	u, err := url.Parse(opts.URL)
@@ -118,21 +252,9 @@ func New(global WatchConfig, opts WatcherOptions, logger zerolog.Logger) (*Watch
 		return nil, err
 	}
 
-	if opts.Password != "" && opts.Token != "" {
-		return nil, fmt.Errorf("cannot provide both toke and password fields for %q", opts.Name)
-	}
-
-	var authMethod auth.Method
-	if opts.Password != "" {
-		authMethod = &auth.Password{
-			Username: opts.Username,
-			Password: opts.Password,
-		}
-	} else {
-		authMethod = &auth.Token{
-			Username:  opts.Username,
-			AuthToken: opts.Token,
-		}
+	authMethod, err := newAuthMethod(opts)
+	if err != nil {
+		return nil, err
 	}
 
 	if opts.MetricsInterval == 0 {
@@ -143,7 +265,42 @@ func New(global WatchConfig, opts WatcherOptions, logger zerolog.Logger) (*Watch
 		opts.MarketInterval = time.Hour * 4
 	}
 
+	if opts.RateLimitMaxWait == 0 {
+		opts.RateLimitMaxWait = time.Minute
+	}
+
+	if opts.ShardDiscoveryInterval == 0 {
+		opts.ShardDiscoveryInterval = time.Minute * 10
+	}
+
+	if opts.TickInterval == 0 {
+		opts.TickInterval = time.Minute
+	}
+
+	// Private servers only rate limit if they say so in the response headers.
+	var limits map[string]ratelimit.Limit
+	if u.Hostname() == "screeps.com" || strings.HasSuffix(u.Hostname(), ".screeps.com") {
+		limits = ratelimit.Documented
+	}
+	watcherLabels := prometheus.Labels{
+		"username": opts.Username,
+		"server":   opts.Name,
+	}
+	limiter := ratelimit.New(limits, watcherLabels)
+	stats := newScrapeStats(opts.Name, watcherLabels)
+	for _, m := range opts.Markets {
+		shard := m.Shard
+		if shard == "" {
+			shard = "none"
+		}
+		stats.register(shard, marketStatsPath, "market:"+m.ResourceType)
+	}
+
 	reg := prometheus.NewRegistry()
+	reg.MustRegister(limiter)
+	reg.MustRegister(stats)
+	ticks := newTickPoller(watcherLabels)
+	reg.MustRegister(ticks)
 	var pusher *profiling.PyroscopePusher
 	if global.Pyroscope.Address != "" {
 		pusher, err = profiling.NewPusher(global.Pyroscope.Address, logger.With().Str("server", "pyroscope_pusher").Logger())
@@ -152,58 +309,122 @@ func New(global WatchConfig, opts WatcherOptions, logger zerolog.Logger) (*Watch
 		}
 	}
 
-	tgts := make([]*MemoryTargets, 0, len(opts.MemorySegments))
-	for _, t := range opts.MemorySegments {
-		if t.Shard == "" {
-			t.Shard = "none"
-		}
-		constantLabels := prometheus.Labels{
-			// Watcher labels
-			"username": opts.Username,
-			"server":   opts.Name,
-			// Target label
-			"shard": t.Shard,
-		}
-		for k, v := range t.ConstLabels {
-			constantLabels[k] = v
-		}
-
-		tgt := &MemoryTargets{
-			Shard:      t.Shard,
-			Metrics:    t.Metrics,
-			Profile:    t.Profile,
-			serverName: opts.Name,
-			collector: memcollector.New(logger.
-				With().
-				Str("username", t.Shard).
-				Str("shard", t.Shard).
-				Logger(), "screeps_memory", constantLabels).WithPusher(pusher),
-		}
-		tgts = append(tgts, tgt)
-		err := reg.Register(tgt.collector)
+	var store *state.Store
+	if global.DataDir != "" {
+		store, err = state.Open(filepath.Join(global.DataDir, url.PathEscape(opts.Name)))
 		if err != nil {
-			return nil, fmt.Errorf("register tgt shard=%q", tgt.Shard)
+			return nil, fmt.Errorf("open state for %q: %w", opts.Name, err)
 		}
 	}
 
-	return &Watcher{
-		Name:              opts.Name,
-		Username:          opts.Username,
-		URL:               u,
-		MemorySegments:    tgts,
-		Markets:           opts.Markets,
-		AuthMethod:        authMethod,
-		cli:               http.DefaultClient,
-		memoryInterval:    opts.MetricsInterval,
-		marketInterval:    opts.MarketInterval,
-		reg:               reg,
-		websocketChannels: opts.WebsocketChannels,
-		pusher:            pusher,
+	w := &Watcher{
+		Name:                   opts.Name,
+		Username:               opts.Username,
+		URL:                    u,
+		Markets:                opts.Markets,
+		AuthMethod:             authMethod,
+		cli:                    http.DefaultClient,
+		memoryInterval:         opts.MetricsInterval,
+		marketInterval:         opts.MarketInterval,
+		shardDiscoveryInterval: opts.ShardDiscoveryInterval,
+		tickInterval:           opts.TickInterval,
+		ticks:                  ticks,
+		reg:                    reg,
+		websocketChannels:      opts.WebsocketChannels,
+		RateLimits:             limiter,
+		rateLimitMaxWait:       opts.RateLimitMaxWait,
+		stats:                  stats,
+		state:                  store,
+		pusher:                 pusher,
+		relabelConfigs:         opts.MetricRelabelConfigs,
 		logger: logger.With().
 			Str("username", opts.Username).
 			Str("server", opts.Name).
 			Logger(),
-	}, nil
+	}
+
+	w.restoreRateLimits()
+
+	shards := make(map[string]bool)
+	for _, t := range opts.MemorySegments {
+		if t.discovers() {
+			w.discoverTargets = append(w.discoverTargets, t)
+			continue
+		}
+
+		if t.Shard == "" {
+			t.Shard = "none"
+		}
+		if shards[t.Shard] {
+			return nil, fmt.Errorf("more than one target for shard %q of %q", t.Shard, opts.Name)
+		}
+		shards[t.Shard] = true
+		w.memoryTargets = append(w.memoryTargets, w.newMemoryTarget(t, t.Shard))
+	}
+
+	return w, nil
+}
+
+// newMemoryTarget creates the collector of a target for a single shard.
+func (w *Watcher) newMemoryTarget(t MemoryTargets, shard string) *MemoryTargets {
+	constantLabels := prometheus.Labels{
+		// Watcher labels
+		"username": w.Username,
+		"server":   w.Name,
+		// Target label
+		"shard": shard,
+	}
+	for k, v := range t.ConstLabels {
+		constantLabels[k] = v
+	}
+
+	tgt := &MemoryTargets{
+		Shard:                shard,
+		Metrics:              t.Metrics,
+		Profile:              t.Profile,
+		MetricsSegments:      t.MetricsSegments,
+		ProfileSegments:      t.ProfileSegments,
+		StaleAfterTicks:      t.StaleAfterTicks,
+		Limits:               t.Limits,
+		MetricRelabelConfigs: t.MetricRelabelConfigs,
+		Values:               t.Values,
+		Format:               t.Format,
+		Encoding:             t.Encoding,
+		serverName:           w.Name,
+		collector: memcollector.New(w.logger.
+			With().
+			Str("shard", shard).
+			Logger(), "screeps_memory", constantLabels).
+			WithPusher(w.profilePusher(shard)).
+			WithStaleAfter(t.StaleAfterTicks).
+			WithLimits(t.Limits).
+			WithRelabelConfigs(slices.Concat(w.relabelConfigs, t.MetricRelabelConfigs)).
+			WithValueOptions(t.Values).
+			WithFormat(t.Format),
+	}
+	for _, consumer := range w.historyConsumers {
+		tgt.collector.WithHistoryConsumer(consumer)
+	}
+	if tick, ok := w.ticks.tick(shard); ok {
+		tgt.collector.SetGameTick(tick)
+	}
+	if tgt.MetricSegment() >= 0 {
+		w.stats.register(tgt.Shard, memorySegmentPath, tgt.metricsName())
+		w.restoreMetrics(tgt)
+	}
+	if tgt.ProfileSegment() >= 0 {
+		w.stats.register(tgt.Shard, memorySegmentPath, tgt.profileName())
+	}
+	return tgt
+}
+
+// Segments returns the memory targets currently being scraped, one per
+// shard.
+func (w *Watcher) Segments() []*MemoryTargets {
+	w.targetsMu.RLock()
+	defer w.targetsMu.RUnlock()
+
+	return slices.Clone(w.memoryTargets)
 }
 
 func (w *Watcher) Describe(descs chan<- *prometheus.Desc) {
@@ -212,12 +433,75 @@ func (w *Watcher) Describe(descs chan<- *prometheus.Desc) {
 
 func (w *Watcher) Collect(metrics chan<- prometheus.Metric) {
 	w.reg.Collect(metrics)
+	// Memory target collectors come and go with shard discovery, so they
+	// are collected directly instead of through the registry.
+	for _, target := range w.Segments() {
+		target.collector.Collect(metrics)
+	}
 }
 
+// Watch runs until ctx is canceled. It returns once every scrape has stopped
+// and the queued profile uploads are flushed.
 func (w *Watcher) Watch(ctx context.Context) {
-	go w.WatchMetrics(ctx)
-	go w.WatchMarket(ctx)
-	go w.WatchWebsocket(ctx)
+	var wg sync.WaitGroup
+	for _, run := range []func(context.Context){
+		w.authenticate,
+		w.WatchShards,
+		w.WatchTicks,
+		w.WatchMetrics,
+		w.WatchMarket,
+		w.WatchWebsocket,
+	} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run(ctx)
+		}()
+	}
+	wg.Wait()
+
+	w.saveRateLimits(true)
+	if w.pusher != nil {
+		w.pusher.Stop()
+	}
+	w.logger.Info().Msg("watcher stopped")
+}
+
+// authenticate checks the credentials work until they do. It does not block
+// any scrapes, it only reports readiness.
+func (w *Watcher) authenticate(ctx context.Context) {
+	for {
+		err := w.Authenticate(ctx)
+		if err == nil {
+			w.authenticated.Store(true)
+			w.logger.Info().Msg("authenticated")
+			return
+		}
+		logEvent(w.logger, err).Msg("failed to authenticate, will retry...")
+
+		select {
+		case <-time.After(time.Second * 30):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Authenticate makes a single request to check the credentials work.
+func (w *Watcher) Authenticate(ctx context.Context) error {
+	_, err := w.get(ctx, authMePath, nil)
+	return err
+}
+
+// Ready is true once the watcher has authenticated and every target has
+// completed its first scrape, successful or not.
+func (w *Watcher) Ready() bool {
+	return w.authenticated.Load() && w.stats.scraped()
+}
+
+// Targets returns the status of the last scrape of every target.
+func (w *Watcher) Targets() []TargetStatus {
+	return w.stats.Targets()
 }
 
 func (w *Watcher) WatchWebsocket(ctx context.Context) {
@@ -226,7 +510,9 @@ func (w *Watcher) WatchWebsocket(ctx context.Context) {
 		return
 	}
 
-	sock, err := screepssocket.New(ctx, w.URL, w.logger, w.cli, w.AuthMethod, w.websocketChannels, prometheus.Labels{
+	var saved savedWebsocket
+	w.loadState(websocketKey, &saved)
+	sock, err := screepssocket.New(ctx, w.URL, w.logger, w.cli, w.AuthMethod, w.websocketChannels, saved.UserID, prometheus.Labels{
 		"server":   w.Name,
 		"username": w.AuthMethod.GetUsername(),
 	})
@@ -234,13 +520,19 @@ func (w *Watcher) WatchWebsocket(ctx context.Context) {
 		w.logger.Error().Err(err).Msg("failed to create websocket")
 		return
 	}
+	if sock.UserID() != saved.UserID {
+		w.saveState(websocketKey, savedWebsocket{UserID: sock.UserID()})
+	}
 
-	if w.pusher != nil {
+	if w.pusher != nil || w.exportsOTLP(otlp.SignalProfiles) {
 		sock.InterceptConsoleLog(w.interceptProfileLogs(w.Name))
 	}
+	if w.exportsOTLP(otlp.SignalLogs) {
+		sock.ForwardConsoleLog(w.forwardConsoleLogs())
+	}
 
-	go sock.Run(ctx)
 	w.reg.MustRegister(sock)
+	sock.Run(ctx)
 }
 
 func (w *Watcher) interceptProfileLogs(server string) screepssocket.HandleConsoleLog {
@@ -257,7 +549,7 @@ func (w *Watcher) interceptProfileLogs(server string) screepssocket.HandleConsol
 			}
 
 			proto := profiling.New().Convert(profile)
-			err = w.pusher.Push(memcollector.ProfileName(server, meta.Shard), proto)
+			err = w.profilePusher(meta.Shard).Push(memcollector.ProfileName(server, meta.Shard), proto)
 			if err != nil {
 				logger.Error().Msg("failed to push profile data")
 				return true
@@ -271,16 +563,15 @@ func (w *Watcher) interceptProfileLogs(server string) screepssocket.HandleConsol
 }
 
 func (w *Watcher) WatchMetrics(ctx context.Context) {
+	if len(w.Segments()) == 0 && len(w.discoverTargets) == 0 {
+		w.logger.Info().Msg("no memory targets configured, skipping memory scrape")
+		return
+	}
+
 	ticker := time.NewTicker(w.memoryInterval)
 	logger := w.logger.With().Str("data", "metrics-memory-segment").Logger()
 	for {
-		if w.memorySegmentRateLimitUntil.After(time.Now()) {
-			// Skipping due to rate limit
-			logger.Warn().Time("reset", w.memorySegmentRateLimitUntil).Msg("rate limit hit, skipping scrape")
-			continue
-		}
-
-		for _, target := range w.MemorySegments {
+		for _, target := range w.Segments() {
 			var metricCount, metricSize = -1, -1
 			var profileCount, profileSize = -1, -1
 			if target.MetricSegment() >= 0 {
@@ -371,28 +662,40 @@ func (w *Watcher) WatchMarket(ctx context.Context) {
 	w.reg.MustRegister(marketStatsTransactionCount)
 	w.reg.MustRegister(marketStatsVolume)
 
+	setStats := func(shard string, stat *market.Stats) {
+		marketStatsAvgPrice.WithLabelValues(stat.ResourceType, shard).Set(stat.AvgPrice)
+		marketStatsStdDevPrice.WithLabelValues(stat.ResourceType, shard).Set(stat.StddevPrice)
+		marketStatsTransactionCount.WithLabelValues(stat.ResourceType, shard).Set(float64(stat.Transactions))
+		marketStatsVolume.WithLabelValues(stat.ResourceType, shard).Set(float64(stat.Volume))
+	}
+
+	// Serve the last known stats until the first scrape.
+	saved := w.loadMarkets()
+	for _, target := range w.Markets {
+		if stat, ok := saved[marketKey(target)]; ok {
+			setStats(target.Shard, &stat)
+		}
+	}
+
 	ticker := time.NewTicker(w.marketInterval)
 	logger := w.logger.With().Str("data", "market").Logger()
 	for {
-		if w.marketApiRateLimitUntil.After(time.Now()) {
-			// Skipping due to rate limit
-			logger.Warn().Time("reset", w.marketApiRateLimitUntil).Msg("rate limit hit, skipping scrape")
-			continue
-		}
-
+		scraped := false
 		for _, target := range w.Markets {
-			logger = logger.With().Str("resource_type", target.ResourceType).Str("shard", target.Shard).Logger()
+			logger := logger.With().Str("resource_type", target.ResourceType).Str("shard", target.Shard).Logger()
 			stat, err := w.scrapeMarket(ctx, &target)
 			if err != nil {
-				logger.Err(err).
+				logEvent(logger, err).
 					Msg("failed to scrape market")
 				continue
 			}
 
-			marketStatsAvgPrice.WithLabelValues(stat.ResourceType, target.Shard).Set(stat.AvgPrice)
-			marketStatsStdDevPrice.WithLabelValues(stat.ResourceType, target.Shard).Set(stat.StddevPrice)
-			marketStatsTransactionCount.WithLabelValues(stat.ResourceType, target.Shard).Set(float64(stat.Transactions))
-			marketStatsVolume.WithLabelValues(stat.ResourceType, target.Shard).Set(float64(stat.Volume))
+			setStats(target.Shard, stat)
+			saved[marketKey(target)] = *stat
+			scraped = true
+		}
+		if scraped && w.state != nil {
+			w.saveState(marketsKey, saved)
 		}
 		logger.Info().Msg("scrape markets complete")
 
@@ -405,61 +708,135 @@ func (w *Watcher) WatchMarket(ctx context.Context) {
 }
 
 func (w *Watcher) scrapeMarket(ctx context.Context, target *MarketTargets) (*market.Stats, error) {
+	shard := target.Shard
+	if shard == "" {
+		shard = "none"
+	}
+	scrape, ctx := w.stats.start(ctx, shard, marketStatsPath, "market:"+target.ResourceType)
+
 	data, err := w.Market(ctx, target.ResourceType, target.Shard)
 	if err != nil {
+		scrape.failed(FailureReason(err), err)
 		return nil, fmt.Errorf("failed to get market data: %w", err)
 	}
 
 	stats, err := market.ParseMarketResponse(data)
 	if err != nil {
+		scrape.failed(ReasonParse, err)
 		return nil, fmt.Errorf("parse market data: %w", err)
 	}
-	return stats.Today()
+
+	today, err := stats.Today()
+	if err != nil {
+		scrape.failed(ReasonParse, err)
+		return nil, err
+	}
+	// One series per market metric.
+	scrape.succeeded(4)
+	return today, nil
 }
 
 func (w *Watcher) scrapeProfile(ctx context.Context, target *MemoryTargets) (int, int) {
 	logger := w.logger.With().
 		Str("shard", target.Shard).
-		Int("segment", target.ProfileSegment()).Logger()
+		Str("segment", joinIDs(target.ProfileSegmentIDs())).Logger()
 
 	if !target.collector.SupportsProfiling() {
 		logger.Error().Msg("profile collector not supported")
 		return -1, -1
 	}
 
-	data, size, err := w.MemorySegment(ctx, target.ProfileSegment(), target.Shard)
+	scrape, ctx := w.stats.start(ctx, target.Shard, memorySegmentPath, target.profileName())
+	data, size, err := w.fetchSegments(ctx, target.Shard, target.ProfileSegmentIDs(), target.decodeOptions())
 	if err != nil {
-		logger.Error().Msg("failed to get profile memory segment")
+		scrape.failed(FailureReason(err), err)
+		logEvent(logger, err).Msg("failed to get profile memory segment")
 		return 0, size
 	}
 
 	count, err := target.collector.SetProfileMemory(memcollector.ProfileName(target.serverName, target.Shard), data)
 	if err != nil {
+		scrape.failed(ReasonParse, err)
 		logger.Error().
 			Err(err).
 			Int("decoded_size", size).
 			Msg("failed to set memory metrics")
+		return count, size
 	}
+	scrape.succeeded(count)
 	return count, size
 }
 
 func (w *Watcher) scrapeMetrics(ctx context.Context, target *MemoryTargets) (int, int) {
 	logger := w.logger.With().
 		Str("shard", target.Shard).
-		Int("segment", target.MetricSegment()).Logger()
+		Str("segment", joinIDs(target.MetricSegmentIDs())).Logger()
 
-	data, size, err := w.MemorySegment(ctx, target.MetricSegment(), target.Shard)
+	scrape, ctx := w.stats.start(ctx, target.Shard, memorySegmentPath, target.metricsName())
+	data, size, err := w.fetchSegments(ctx, target.Shard, target.MetricSegmentIDs(), target.decodeOptions())
 	if err != nil {
-		logger.Error().Msg("failed to get metric memory segment")
+		scrape.failed(FailureReason(err), err)
+		logEvent(logger, err).Msg("failed to get metric memory segment")
 		return 0, size
 	}
 
 	count, err := target.collector.SetMetricMemory(data)
 	if err != nil {
+		scrape.failed(ReasonParse, err)
 		logger.Error().
 			Err(err).
 			Int("decoded_size", size).
 			Msg("failed to set memory metrics")
+		return count, size
 	}
+	scrape.succeeded(count)
+	w.saveMetrics(target, data)
 	return count, size
 }
+
+// fetchSegments fetches the segments of a target and merges them into one
+// document.
+func (w *Watcher) fetchSegments(ctx context.Context, shard string, ids []int, opts memory.DecodeOptions) (json.RawMessage, int, error) {
+	if len(ids) == 1 {
+		data, size, err := w.MemorySegment(ctx, ids[0], shard, opts)
+		if err == nil {
+			w.stats.segmentSize.WithLabelValues(shard, strconv.Itoa(ids[0])).Set(float64(len(data)))
+		}
+		return data, size, err
+	}
+
+	segments, size, err := w.MemorySegments(ctx, ids, shard, opts)
+	if err != nil {
+		return nil, size, err
+	}
+	for i, segment := range segments {
+		w.stats.segmentSize.WithLabelValues(shard, strconv.Itoa(ids[i])).Set(float64(len(segment)))
+	}
+
+	raw := make([][]byte, 0, len(segments))
+	for _, segment := range segments {
+		raw = append(raw, segment)
+	}
+	merged, err := memory.Merge(raw)
+	if err != nil {
+		return nil, size, fmt.Errorf("merge segments %s: %w", joinIDs(ids), err)
+	}
+	return merged, size, nil
+}
+
+// logEvent logs rate limited requests as a warning with the reason they were
+// skipped, and everything else as an error.
+func logEvent(logger zerolog.Logger, err error) *zerolog.Event {
+	var limited *ratelimit.Error
+	if errors.As(err, &limited) {
+		return logger.Warn().
+			Err(err).
+			Str("endpoint", limited.Endpoint).
+			Time("reset", limited.Until).
+			Str("reason", "rate_limited")
+	}
+	if errors.Is(err, memory.ErrTornRead) {
+		return logger.Warn().Err(err).Str("reason", ReasonTornRead)
+	}
+	return logger.Error().Err(err)
+}